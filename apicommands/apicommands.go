@@ -1,5 +1,7 @@
 package apicommands
 
+import "sort"
+
 type CommandType int
 type commandName string
 
@@ -11,8 +13,23 @@ const (
 	ServerSignalUpdateListPush
 	ServerNConnectionsPush
 	ServerSignalUpdatePush
+	ClientRefreshToken
+	ServerTokenExpiringPush
+	ClientStats
+	ClientJoinTopics
+	ClientLeaveTopics
+	ServerTopicPush
+	ServerResumePush
+	ServerPingPush
+	ClientPong
+	ServerLatencyPush
+	ClientConnections
 )
 
+// ClientHello negotiates the protocol. Its ID is fixed, so clients can always find out the IDs of the other
+// commands whatever their order.
+const ClientHello CommandType = 1000
+
 var cmap commandMap
 
 func init() {
@@ -22,4 +39,31 @@ func init() {
 	cmap[ServerSignalUpdateListPush] = "SignalUpdateListPush"
 	cmap[ServerNConnectionsPush] = "NConnectionsPush"
 	cmap[ServerSignalUpdatePush] = "SignalUpdatePush"
+	cmap[ClientRefreshToken] = "RefreshToken"
+	cmap[ServerTokenExpiringPush] = "TokenExpiringPush"
+	cmap[ClientStats] = "Stats"
+	cmap[ClientJoinTopics] = "JoinTopics"
+	cmap[ClientLeaveTopics] = "LeaveTopics"
+	cmap[ServerTopicPush] = "TopicPush"
+	cmap[ServerResumePush] = "ResumePush"
+	cmap[ServerPingPush] = "PingPush"
+	cmap[ClientPong] = "Pong"
+	cmap[ServerLatencyPush] = "LatencyPush"
+	cmap[ClientConnections] = "Connections"
+	cmap[ClientHello] = "Hello"
+}
+
+// Name returns the name of the command, or an empty string if it's unknown.
+func (ct CommandType) Name() string {
+	return string(cmap[ct])
+}
+
+// Commands returns every known command, sorted by ID.
+func Commands() []CommandType {
+	commands := make([]CommandType, 0, len(cmap))
+	for command := range cmap {
+		commands = append(commands, command)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i] < commands[j] })
+	return commands
 }
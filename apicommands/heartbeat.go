@@ -0,0 +1,56 @@
+package apicommands
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+type ApiPing struct {
+	// Server clock when the ping was sent, in nanoseconds since the epoch
+	Sent int64 `json:"sent"`
+}
+
+// PingPush asks a client to answer with a pong, to measure its latency.
+type PingPush struct {
+	ApiResponseHeader
+	ApiPing
+}
+
+func (r *PingPush) Stringify() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// ApiPongRequest answers a ping. Received and Replied are read on the clock of the client, Replied may be left out.
+type ApiPongRequest struct {
+	ApiRequestHeader
+	Sent     int64 `json:"sent"`
+	Received int64 `json:"received"`
+	Replied  int64 `json:"replied,omitempty"`
+}
+
+func (r *ApiPongRequest) Validate() error {
+	if r.Sent <= 0 || r.Received <= 0 {
+		return errors.New("The pong must carry the sent and received timestamps")
+	}
+	if r.Replied != 0 && r.Replied < r.Received {
+		return errors.New("The pong was replied before the ping was received")
+	}
+	return nil
+}
+
+type ApiLatency struct {
+	RTT         float64 `json:"rtt"`
+	SmoothedRTT float64 `json:"smoothedRtt"`
+	ClockOffset float64 `json:"clockOffset"`
+	Samples     int     `json:"samples"`
+}
+
+// LatencyPush tells a client its latency as measured by the server, in milliseconds.
+type LatencyPush struct {
+	ApiResponseHeader
+	ApiLatency
+}
+
+func (r *LatencyPush) Stringify() ([]byte, error) {
+	return json.Marshal(r)
+}
@@ -0,0 +1,93 @@
+package apicommands
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+type ResponseStatusType int
+
+type ApiRequestHeader struct {
+	Command CommandType `json:"command"`
+}
+
+type ApiResponseHeader struct {
+	Command CommandType        `json:"command"`
+	Status  ResponseStatusType `json:"status"`
+	Error   string             `json:"error,omitempty"`
+
+	// Sequence number of the broadcasts
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+func (r *ApiResponseHeader) Stringify() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+type ApiHelloRequest struct {
+	ApiRequestHeader
+	Version   int      `json:"version"`
+	Features  []string `json:"features"`
+	Encodings []string `json:"encodings"`
+}
+
+type ApiCommandDescription struct {
+	ID   CommandType `json:"id"`
+	Name string      `json:"name"`
+}
+
+type ApiHello struct {
+	Version  int                     `json:"version"`
+	Features []string                `json:"features"`
+	Encoding string                  `json:"encoding"`
+	Stream   string                  `json:"stream"`
+	Commands []ApiCommandDescription `json:"commands"`
+}
+
+type HelloResponse struct {
+	ApiResponseHeader
+	ApiHello
+}
+
+func (r *HelloResponse) Stringify() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+type ApiRefreshTokenRequest struct {
+	ApiRequestHeader
+	Token string `json:"token"`
+}
+
+func (r *ApiRefreshTokenRequest) Validate() error {
+	if r.Token == "" {
+		return errors.New("The token is empty")
+	}
+	return nil
+}
+
+type ApiTokenExpiration struct {
+	Expire time.Time `json:"expire"`
+}
+
+type TokenExpirationResponse struct {
+	ApiResponseHeader
+	ApiTokenExpiration
+}
+
+func (r *TokenExpirationResponse) Stringify() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+type ApiNClients struct {
+	Number int `json:"number"`
+}
+
+type NCurrentClientsResponse struct {
+	ApiResponseHeader
+	ApiNClients
+}
+
+func (r *NCurrentClientsResponse) Stringify() ([]byte, error) {
+	return json.Marshal(r)
+}
@@ -0,0 +1,65 @@
+package apicommands
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type PidType int
+
+const (
+	AnalogicalPidType PidType = iota
+	DiscretePidType
+	DigitalPidType
+)
+
+type PidStaticData struct {
+	Name         string        `json:"name"`
+	Index        int           `json:"index"`
+	Type         PidType       `json:"type"`
+	SamplePeriod time.Duration `json:"period"`
+}
+
+type PidState int
+
+const InternalErrorPidState = -1
+const (
+	NeverUpdatedPidState PidState = iota
+	OkPidState
+	BadPidState
+)
+
+type PidDynamicData struct {
+	Value       float32  `json:"value"`
+	State       PidState `json:"state"`
+	Updates     int      `json:"-"`
+	LastUpdated int64    `json:"timestamp"`
+}
+
+type PidData struct {
+	PidStaticData
+	PidDynamicData
+}
+
+type PidIndexedDynamicData struct {
+	Index int `json:"index"`
+	PidDynamicData
+}
+
+type ApiPidListResponse struct {
+	ApiResponseHeader
+	List []PidData `json:"pids"`
+}
+
+func (r ApiPidListResponse) Stringify() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+type ApiPidListUpdateResponse struct {
+	ApiResponseHeader
+	List []PidIndexedDynamicData `json:"pids"`
+}
+
+func (r ApiPidListUpdateResponse) Stringify() ([]byte, error) {
+	return json.Marshal(r)
+}
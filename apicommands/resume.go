@@ -0,0 +1,47 @@
+package apicommands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ResumePoint is the last broadcast a client got before losing its connection, written "stream:seq".
+type ResumePoint struct {
+	Stream string
+	Seq    uint64
+}
+
+func ParseResumePoint(s string) (ResumePoint, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 1 {
+		return ResumePoint{}, errors.New("The resume point must be written stream:seq")
+	}
+	seq, err := strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil {
+		return ResumePoint{}, fmt.Errorf("Bad sequence number in the resume point: %v", err)
+	}
+	return ResumePoint{Stream: s[:i], Seq: seq}, nil
+}
+
+func (p ResumePoint) String() string {
+	return fmt.Sprint(p.Stream, ":", p.Seq)
+}
+
+type ApiResume struct {
+	Stream   string `json:"stream"`
+	Resumed  bool   `json:"resumed"`
+	Replayed int    `json:"replayed"`
+}
+
+// ResumePush tells a client whether its stream was resumed. If it wasn't, a snapshot follows.
+type ResumePush struct {
+	ApiResponseHeader
+	ApiResume
+}
+
+func (r *ResumePush) Stringify() ([]byte, error) {
+	return json.Marshal(r)
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type registration struct {
+	Username string `json:"Username"`
+	Password string `json:"Password"`
+}
+
+// tokenResponse is the body of the /login and /auth/refresh_token responses.
+type tokenResponse struct {
+	Code    int       `json:"code"`
+	Token   string    `json:"token"`
+	Expire  time.Time `json:"expire"`
+	Message string    `json:"message"`
+}
+
+// AuthError is the refusal of the server to authenticate the client. Trying again won't help, the credentials
+// must be fixed or the client must slow down.
+type AuthError struct {
+	Status  string
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status, e.Message)
+}
+
+// responseError returns the error of a response that isn't OK, an *AuthError if the server refused to
+// authenticate the client.
+func responseError(response *http.Response, message string) error {
+	switch response.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return &AuthError{Status: response.Status, Message: message}
+	}
+	return fmt.Errorf("%s: %s", response.Status, message)
+}
+
+func (c *Client) postJSON(path string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return c.httpClient.Post(c.baseURL+path, "application/json", bytes.NewReader(data))
+}
+
+func (c *Client) setToken(response *http.Response) error {
+	defer response.Body.Close()
+	var body tokenResponse
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return fmt.Errorf("Unexpected response (%s): %v", response.Status, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return responseError(response, body.Message)
+	}
+	c.mutex.Lock()
+	c.token = body.Token
+	c.expire = body.Expire
+	c.mutex.Unlock()
+	return nil
+}
+
+// Register creates the account of the configured user.
+func (c *Client) Register() error {
+	response, err := c.postJSON("/register", registration{Username: c.config.Username, Password: c.config.Password})
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		return errors.New("Unable to register: " + response.Status)
+	}
+	return nil
+}
+
+// Login gets a new session token for the configured user.
+func (c *Client) Login() error {
+	response, err := c.postJSON("/login", credentials{Username: c.config.Username, Password: c.config.Password})
+	if err != nil {
+		return err
+	}
+	return c.setToken(response)
+}
+
+// RefreshToken exchanges the current session token for a new one.
+func (c *Client) RefreshToken() error {
+	token, _ := c.Token()
+	request, err := http.NewRequest(http.MethodGet, c.baseURL+"/auth/refresh_token", nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	return c.setToken(response)
+}
+
+// ticketResponse is the body of the /auth/ws_ticket responses.
+type ticketResponse struct {
+	Code    int    `json:"code"`
+	Ticket  string `json:"ticket"`
+	Message string `json:"message"`
+}
+
+// WsTicket returns a single use ticket opening a websocket connection for the current session, which must be
+// used right away.
+func (c *Client) WsTicket() (string, error) {
+	token, _ := c.Token()
+	request, err := http.NewRequest(http.MethodPost, c.baseURL+"/auth/ws_ticket", nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	var body ticketResponse
+	if err = json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("Unexpected response (%s): %v", response.Status, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", responseError(response, body.Message)
+	}
+	return body.Ticket, nil
+}
+
+// Token returns the current session token and when it expires.
+func (c *Client) Token() (string, time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.token, c.expire
+}
+
+// ensureToken makes sure there's a session token valid for a while, refreshing it or logging in again.
+func (c *Client) ensureToken() error {
+	token, expire := c.Token()
+	if token != "" && time.Until(expire) > tokenRefreshMargin {
+		return nil
+	}
+	if token != "" && time.Now().Before(expire) {
+		if err := c.RefreshToken(); err == nil {
+			return nil
+		}
+	}
+	return c.Login()
+}
@@ -0,0 +1,469 @@
+// Package client connects to a gintest server, keeping a local mirror of the signal values it streams.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"local/gintest/apicommands"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+
+	// Time allowed to write a message to the server.
+	writeWait = 10 * time.Second
+
+	// The token is refreshed before connecting if it expires sooner than this.
+	tokenRefreshMargin = time.Minute
+
+	protocolVersion = 1
+)
+
+// Config tells the client where to connect, and what to do with the messages of the server.
+type Config struct {
+	// Base URL of the server, like "http://localhost:2021"
+	URL      string
+	Username string
+	Password string
+
+	// Bounds of the wait between reconnection attempts, doubled after each failure.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	HTTPClient *http.Client
+
+	// Optional callbacks, called from the goroutine running the client after the mirror is updated.
+	OnPidList       func(apicommands.ApiPidListResponse)
+	OnPidListUpdate func(apicommands.ApiPidListUpdateResponse)
+	OnNClients      func(apicommands.NCurrentClientsResponse)
+	OnError         func(apicommands.ApiResponseHeader)
+	OnMessage       func(name string, message []byte)
+}
+
+// Client keeps a session with a gintest server: it logs in, streams the signals and reconnects when needed.
+type Client struct {
+	config     Config
+	baseURL    string
+	httpClient *http.Client
+
+	mutex    sync.Mutex
+	token    string
+	expire   time.Time
+	signals  map[int]apicommands.PidData
+	nClients int
+
+	// The stream of broadcasts of the server and the last one received, to resume after reconnecting
+	stream   string
+	lastSeq  uint64
+	resuming bool
+
+	// The latency of the connection, as measured by the server
+	latency apicommands.ApiLatency
+
+	// Command IDs by name, as told by the server on hello
+	commands map[string]apicommands.CommandType
+	names    map[apicommands.CommandType]string
+
+	// The current connection, only written under writeMutex
+	writeMutex sync.Mutex
+	ws         *websocket.Conn
+}
+
+func New(config Config) *Client {
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = defaultMinBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = defaultMaxBackoff
+	}
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Client{
+		config:     config,
+		baseURL:    strings.TrimRight(config.URL, "/"),
+		httpClient: httpClient,
+		signals:    make(map[int]apicommands.PidData),
+	}
+}
+
+// Signals returns a copy of the local mirror of the signals, by index.
+func (c *Client) Signals() map[int]apicommands.PidData {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	signals := make(map[int]apicommands.PidData, len(c.signals))
+	for index, signal := range c.signals {
+		signals[index] = signal
+	}
+	return signals
+}
+
+// Signal returns the last known data of a signal.
+func (c *Client) Signal(index int) (apicommands.PidData, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	signal, ok := c.signals[index]
+	return signal, ok
+}
+
+// NClients returns the last known number of clients connected to the server.
+func (c *Client) NClients() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.nClients
+}
+
+// Latency returns the round trip time and the offset of the local clock to the one of the server, as last
+// measured by the server.
+func (c *Client) Latency() (rtt, clockOffset time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return time.Duration(c.latency.SmoothedRTT * float64(time.Millisecond)), time.Duration(c.latency.ClockOffset * float64(time.Millisecond))
+}
+
+// CommandID returns the ID of a command by its name, once the server told it.
+func (c *Client) CommandID(name string) (apicommands.CommandType, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	command, ok := c.commands[name]
+	return command, ok
+}
+
+// Send writes a request to the server, which must have a "command" field.
+func (c *Client) Send(request interface{}) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.ws == nil {
+		return errors.New("Not connected")
+	}
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+// SendCommand writes a request with no other fields than the command, given by name.
+func (c *Client) SendCommand(name string) error {
+	command, ok := c.CommandID(name)
+	if !ok {
+		return errors.New("The server doesn't support the command " + name)
+	}
+	return c.Send(apicommands.ApiRequestHeader{Command: command})
+}
+
+func (c *Client) wsURL(ticket string) (string, error) {
+	u, err := url.Parse(c.baseURL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/ws"
+	query := url.Values{"ticket": {ticket}}
+
+	c.mutex.Lock()
+	c.resuming = c.stream != "" && c.lastSeq > 0
+	if c.resuming {
+		query.Set("resume", apicommands.ResumePoint{Stream: c.stream, Seq: c.lastSeq}.String())
+	}
+	c.mutex.Unlock()
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Run keeps the client connected until ctx is done, reconnecting with backoff whenever the connection is lost.
+// Every new connection negotiates the protocol and gets the complete list of signals again. It gives up with an
+// *AuthError when the server refuses to authenticate the client.
+func (c *Client) Run(ctx context.Context) error {
+	backoff := c.config.MinBackoff
+	for {
+		connected, err := c.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, ok := err.(*AuthError); ok {
+			return err
+		}
+		if connected {
+			backoff = c.config.MinBackoff
+		}
+		// Spread the reconnections of many clients
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Println("GINTEST CLIENT >>> Connection lost (", err, "), reconnecting in ", wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > c.config.MaxBackoff {
+			backoff = c.config.MaxBackoff
+		}
+	}
+}
+
+// session runs a single connection until it's lost, returning whether it was established at all.
+func (c *Client) session(ctx context.Context) (bool, error) {
+	if err := c.ensureToken(); err != nil {
+		return false, err
+	}
+	ticket, err := c.WsTicket()
+	if err != nil {
+		return false, err
+	}
+	wsURL, err := c.wsURL(ticket)
+	if err != nil {
+		return false, err
+	}
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	c.writeMutex.Lock()
+	c.ws = ws
+	c.writeMutex.Unlock()
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		c.writeMutex.Lock()
+		c.ws = nil
+		c.writeMutex.Unlock()
+		ws.Close()
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.writeMutex.Lock()
+			ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+			c.writeMutex.Unlock()
+			ws.Close()
+		case <-done:
+		}
+	}()
+
+	hello := apicommands.ApiHelloRequest{
+		ApiRequestHeader: apicommands.ApiRequestHeader{Command: apicommands.ClientHello},
+		Version:          protocolVersion,
+		Features:         []string{"tokenRefresh", "batch"},
+		Encodings:        []string{"json"},
+	}
+	if err = c.Send(hello); err != nil {
+		return true, err
+	}
+
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			return true, err
+		}
+		c.handleFrame(message)
+	}
+}
+
+func (c *Client) handleFrame(message []byte) {
+	trimmed := strings.TrimSpace(string(message))
+	if strings.HasPrefix(trimmed, "[") {
+		var responses []json.RawMessage
+		if err := json.Unmarshal(message, &responses); err != nil {
+			log.Println("GINTEST CLIENT >>> Error unmarshalling a batch response: ", err)
+			return
+		}
+		for _, response := range responses {
+			if len(response) > 0 && string(response) != "null" {
+				c.handleMessage(response)
+			}
+		}
+		return
+	}
+	c.handleMessage(message)
+}
+
+func (c *Client) handleMessage(message []byte) {
+	var header apicommands.ApiResponseHeader
+	if err := json.Unmarshal(message, &header); err != nil {
+		log.Println("GINTEST CLIENT >>> Error unmarshalling a message: ", err)
+		return
+	}
+	if header.Status < 0 {
+		if c.config.OnError != nil {
+			c.config.OnError(header)
+		} else {
+			log.Println("GINTEST CLIENT >>> Error on command ", header.Command, ": ", header.Error)
+		}
+		return
+	}
+	if header.Command == apicommands.ClientHello {
+		c.handleHello(message)
+		return
+	}
+
+	c.mutex.Lock()
+	if header.Seq > c.lastSeq {
+		c.lastSeq = header.Seq
+	}
+	name := c.names[header.Command]
+	c.mutex.Unlock()
+
+	switch name {
+	case "CompleteSignalList":
+		var list apicommands.ApiPidListResponse
+		if err := json.Unmarshal(message, &list); err != nil {
+			log.Println("GINTEST CLIENT >>> Error unmarshalling the signal list: ", err)
+			return
+		}
+		c.mutex.Lock()
+		c.signals = make(map[int]apicommands.PidData, len(list.List))
+		for _, signal := range list.List {
+			c.signals[signal.Index] = signal
+		}
+		c.mutex.Unlock()
+		if c.config.OnPidList != nil {
+			c.config.OnPidList(list)
+		}
+
+	case "SignalUpdateListPush":
+		var update apicommands.ApiPidListUpdateResponse
+		if err := json.Unmarshal(message, &update); err != nil {
+			log.Println("GINTEST CLIENT >>> Error unmarshalling a signal update list: ", err)
+			return
+		}
+		c.mutex.Lock()
+		for _, data := range update.List {
+			signal := c.signals[data.Index]
+			signal.Index = data.Index
+			signal.PidDynamicData = data.PidDynamicData
+			c.signals[data.Index] = signal
+		}
+		c.mutex.Unlock()
+		if c.config.OnPidListUpdate != nil {
+			c.config.OnPidListUpdate(update)
+		}
+
+	case "NConnectionsPush":
+		var nClients apicommands.NCurrentClientsResponse
+		if err := json.Unmarshal(message, &nClients); err != nil {
+			log.Println("GINTEST CLIENT >>> Error unmarshalling the number of clients: ", err)
+			return
+		}
+		c.mutex.Lock()
+		c.nClients = nClients.Number
+		c.mutex.Unlock()
+		if c.config.OnNClients != nil {
+			c.config.OnNClients(nClients)
+		}
+
+	case "TokenExpiringPush":
+		go c.refreshSession()
+
+	case "PingPush":
+		var ping apicommands.PingPush
+		if err := json.Unmarshal(message, &ping); err != nil {
+			log.Println("GINTEST CLIENT >>> Error unmarshalling a ping: ", err)
+			return
+		}
+		received := time.Now().UnixNano()
+		command, _ := c.CommandID("Pong")
+		pong := apicommands.ApiPongRequest{
+			ApiRequestHeader: apicommands.ApiRequestHeader{Command: command},
+			Sent:             ping.Sent,
+			Received:         received,
+			Replied:          time.Now().UnixNano(),
+		}
+		if err := c.Send(pong); err != nil {
+			log.Println("GINTEST CLIENT >>> Error answering a ping: ", err)
+		}
+
+	case "LatencyPush":
+		var latency apicommands.LatencyPush
+		if err := json.Unmarshal(message, &latency); err != nil {
+			log.Println("GINTEST CLIENT >>> Error unmarshalling the latency: ", err)
+			return
+		}
+		c.mutex.Lock()
+		c.latency = latency.ApiLatency
+		c.mutex.Unlock()
+
+	case "ResumePush":
+		var resume apicommands.ResumePush
+		if err := json.Unmarshal(message, &resume); err == nil && !resume.Resumed {
+			log.Println("GINTEST CLIENT >>> The stream couldn't be resumed, waiting for a snapshot")
+		}
+	}
+
+	if c.config.OnMessage != nil {
+		c.config.OnMessage(name, message)
+	}
+}
+
+// handleHello learns the IDs of the commands and subscribes again to everything the mirror needs. A resumed
+// connection doesn't need the complete list, the server replays the missed updates or sends it on its own.
+func (c *Client) handleHello(message []byte) {
+	var hello apicommands.HelloResponse
+	if err := json.Unmarshal(message, &hello); err != nil {
+		log.Println("GINTEST CLIENT >>> Error unmarshalling the hello response: ", err)
+		return
+	}
+	c.mutex.Lock()
+	c.commands = make(map[string]apicommands.CommandType, len(hello.Commands))
+	c.names = make(map[apicommands.CommandType]string, len(hello.Commands))
+	for _, command := range hello.Commands {
+		c.commands[command.Name] = command.ID
+		c.names[command.ID] = command.Name
+	}
+	resuming := c.resuming && c.stream == hello.Stream
+	if c.stream != hello.Stream {
+		c.stream = hello.Stream
+		c.lastSeq = 0
+	}
+	c.mutex.Unlock()
+
+	list, _ := c.CommandID("CompleteSignalList")
+	nClients, _ := c.CommandID("NConnectionsPush")
+	batch := []apicommands.ApiRequestHeader{{Command: nClients}}
+	if !resuming {
+		batch = append(batch, apicommands.ApiRequestHeader{Command: list})
+	}
+	if err := c.Send(batch); err != nil {
+		log.Println("GINTEST CLIENT >>> Error requesting the initial snapshots: ", err)
+	}
+}
+
+// refreshSession gets a new token and hands it to the server, so the connection isn't closed on expiration.
+func (c *Client) refreshSession() {
+	if err := c.RefreshToken(); err != nil {
+		log.Println("GINTEST CLIENT >>> Error refreshing the token, logging in again: ", err)
+		if err = c.Login(); err != nil {
+			log.Println("GINTEST CLIENT >>> Error logging in: ", err)
+			return
+		}
+	}
+	command, ok := c.CommandID("RefreshToken")
+	if !ok {
+		return
+	}
+	token, _ := c.Token()
+	refresh := apicommands.ApiRefreshTokenRequest{ApiRequestHeader: apicommands.ApiRequestHeader{Command: command}, Token: token}
+	if err := c.Send(refresh); err != nil {
+		log.Println("GINTEST CLIENT >>> Error sending the refreshed token: ", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Every bucket covers latencies 1% longer than the previous one, from 1µs to about 20 minutes
+	histogramGrowth  = 1.01
+	histogramBuckets = 2100
+)
+
+var logGrowth = math.Log(histogramGrowth)
+
+// histogram counts latencies in logarithmic buckets, so percentiles of millions of samples take constant memory
+// and 1% precision.
+type histogram struct {
+	buckets [histogramBuckets]int64
+	count   int64
+	max     int64
+}
+
+func bucketOf(d time.Duration) int {
+	us := float64(d) / float64(time.Microsecond)
+	if us <= 1 {
+		return 0
+	}
+	b := int(math.Log(us) / logGrowth)
+	if b >= histogramBuckets {
+		return histogramBuckets - 1
+	}
+	return b
+}
+
+// observe is safe to call from several goroutines.
+func (h *histogram) observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	atomic.AddInt64(&h.buckets[bucketOf(d)], 1)
+	atomic.AddInt64(&h.count, 1)
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&h.max, max, int64(d)) {
+			return
+		}
+	}
+}
+
+func (h *histogram) total() int64 {
+	return atomic.LoadInt64(&h.count)
+}
+
+func (h *histogram) maximum() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h.max))
+}
+
+// percentile returns the upper bound of the bucket holding the p-th percentile, p between 0 and 100.
+func (h *histogram) percentile(p float64) time.Duration {
+	count := h.total()
+	if count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(float64(count) * p / 100))
+	var seen int64
+	for b := range h.buckets {
+		if seen += atomic.LoadInt64(&h.buckets[b]); seen >= rank {
+			return time.Duration(math.Pow(histogramGrowth, float64(b+1)) * float64(time.Microsecond))
+		}
+	}
+	return h.maximum()
+}
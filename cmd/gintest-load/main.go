@@ -0,0 +1,286 @@
+// Command gintest-load opens many authenticated WebSocket connections to a gintest server and measures how long
+// signal updates take to get from the tickers to the clients.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"local/gintest/apicommands"
+	"local/gintest/client"
+)
+
+const (
+	writeWait = 10 * time.Second
+
+	// The server pushes the update lists every 250ms, a longer silence means some were dropped
+	updateListPeriod = 250 * time.Millisecond
+)
+
+var (
+	serverURL   = flag.String("url", "http://localhost:2021", "base URL of the server")
+	username    = flag.String("user", os.Getenv("GINTEST_USER"), "user name, $GINTEST_USER by default")
+	password    = flag.String("password", os.Getenv("GINTEST_PASSWORD"), "password, $GINTEST_PASSWORD by default")
+	register    = flag.Bool("register", false, "register the user before logging in")
+	nConns      = flag.Int("n", 100, "number of connections")
+	rampRate    = flag.Float64("rate", 40, "connections opened per second, keep it below the rate limit of a user")
+	duration    = flag.Duration("d", time.Minute, "how long to measure once every connection is open")
+	reportEvery = flag.Duration("report", 10*time.Second, "period of the intermediate reports, 0 for none")
+)
+
+// results are shared by every connection.
+type results struct {
+	// Frames and latencies are only counted once set, after the ramp up
+	measuring int32
+	latency   histogram
+
+	connected    int64
+	failed       int64
+	disconnected int64
+	frames       int64
+	bytes        int64
+	errors       int64
+
+	// Update lists that came more than two periods after the previous one on the same connection
+	gaps int64
+}
+
+func (r *results) report(elapsed time.Duration) {
+	frames := atomic.LoadInt64(&r.frames)
+	fmt.Printf("%8s  conns %d (failed %d, lost %d)  frames %d (%.0f/s, %.1f MB/s)  errors %d  gaps %d\n",
+		elapsed.Round(time.Second), atomic.LoadInt64(&r.connected), atomic.LoadInt64(&r.failed),
+		atomic.LoadInt64(&r.disconnected), frames, float64(frames)/elapsed.Seconds(),
+		float64(atomic.LoadInt64(&r.bytes))/elapsed.Seconds()/1e6, atomic.LoadInt64(&r.errors), atomic.LoadInt64(&r.gaps))
+	fmt.Printf("          latency of %d updates: p50 %v  p90 %v  p99 %v  p99.9 %v  max %v\n", r.latency.total(),
+		r.latency.percentile(50), r.latency.percentile(90), r.latency.percentile(99), r.latency.percentile(99.9),
+		r.latency.maximum().Round(time.Microsecond))
+}
+
+func wsURL(ticket string) (string, error) {
+	u, err := url.Parse(strings.TrimRight(*serverURL, "/"))
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Path += "/ws"
+	u.RawQuery = url.Values{"ticket": {ticket}}.Encode()
+	return u.String(), nil
+}
+
+// statsSnapshot is the part of the snapshot of the server stats the load tool reads.
+type statsSnapshot struct {
+	Counters map[string]struct {
+		Total int64 `json:"total"`
+	} `json:"counters"`
+}
+
+// serverDrops returns the number of messages the server dropped because the queue of a client was full.
+func serverDrops(token string) (int64, error) {
+	request, err := http.NewRequest(http.MethodGet, strings.TrimRight(*serverURL, "/")+"/auth/stats", nil)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return 0, errors.New("Unable to get the server stats: " + response.Status)
+	}
+	var snapshot statsSnapshot
+	if err = json.NewDecoder(response.Body).Decode(&snapshot); err != nil {
+		return 0, err
+	}
+	return snapshot.Counters["ws.drops"].Total, nil
+}
+
+// runConnection asks for the complete list and then measures every update until ctx is done or the connection
+// is lost.
+func runConnection(ctx context.Context, address string, r *results) {
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, address, nil)
+	if err != nil {
+		atomic.AddInt64(&r.failed, 1)
+		log.Println("LOAD >>> Unable to connect: ", err)
+		return
+	}
+	atomic.AddInt64(&r.connected, 1)
+	defer ws.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+			ws.Close()
+		case <-done:
+		}
+	}()
+
+	request := apicommands.ApiRequestHeader{Command: apicommands.ServerCompleteSignalList}
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err = ws.WriteJSON(request); err != nil {
+		atomic.AddInt64(&r.disconnected, 1)
+		return
+	}
+
+	var lastList time.Time
+	for {
+		_, message, err := ws.ReadMessage()
+		received := time.Now()
+		if err != nil {
+			if ctx.Err() == nil {
+				atomic.AddInt64(&r.disconnected, 1)
+				log.Println("LOAD >>> Connection lost: ", err)
+			}
+			return
+		}
+		if atomic.LoadInt32(&r.measuring) == 0 {
+			continue
+		}
+		atomic.AddInt64(&r.frames, 1)
+		atomic.AddInt64(&r.bytes, int64(len(message)))
+
+		var header apicommands.ApiResponseHeader
+		if err = json.Unmarshal(message, &header); err != nil {
+			atomic.AddInt64(&r.errors, 1)
+			continue
+		}
+		if header.Status < 0 {
+			atomic.AddInt64(&r.errors, 1)
+			log.Println("LOAD >>> Error on command ", header.Command, ": ", header.Error)
+			continue
+		}
+		if header.Command != apicommands.ServerSignalUpdateListPush {
+			continue
+		}
+
+		var update apicommands.ApiPidListUpdateResponse
+		if err = json.Unmarshal(message, &update); err != nil {
+			atomic.AddInt64(&r.errors, 1)
+			continue
+		}
+		for _, data := range update.List {
+			r.latency.observe(received.Sub(time.Unix(0, data.LastUpdated)))
+		}
+		if !lastList.IsZero() && received.Sub(lastList) > 2*updateListPeriod {
+			atomic.AddInt64(&r.gaps, 1)
+		}
+		lastList = received
+	}
+}
+
+func main() {
+	flag.Parse()
+	log.SetOutput(ioutil.Discard)
+	if os.Getenv("GINTEST_LOAD_DEBUG") != "" {
+		log.SetOutput(os.Stderr)
+	}
+
+	c := client.New(client.Config{URL: *serverURL, Username: *username, Password: *password})
+	if *register {
+		if err := c.Register(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	// One token for every connection, logging in a thousand times only measures bcrypt
+	if err := c.Login(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	token, _ := c.Token()
+	dropsBefore, err := serverDrops(token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Server drops won't be counted: ", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	r := &results{}
+	var wg sync.WaitGroup
+	start := time.Now()
+	ramp := time.NewTicker(time.Duration(float64(time.Second) / *rampRate))
+	fmt.Printf("Opening %d connections to %s at %.0f/s\n", *nConns, *serverURL, *rampRate)
+	for i := 0; i < *nConns && ctx.Err() == nil; i++ {
+		// Every connection needs a ticket of its own
+		ticket, err := c.WsTicket()
+		var address string
+		if err == nil {
+			address, err = wsURL(ticket)
+		}
+		if err != nil {
+			atomic.AddInt64(&r.failed, 1)
+			log.Println("LOAD >>> Unable to get a ticket: ", err)
+		} else {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runConnection(ctx, address, r)
+			}()
+		}
+		select {
+		case <-ramp.C:
+		case <-ctx.Done():
+		}
+	}
+	ramp.Stop()
+
+	// Measure the steady state only, the ramp up latencies would hide it
+	fmt.Println("Ramp up done in", time.Since(start).Round(time.Millisecond), ", measuring for", *duration)
+	atomic.StoreInt32(&r.measuring, 1)
+	start = time.Now()
+	stop := time.After(*duration)
+	var reports <-chan time.Time
+	if *reportEvery > 0 {
+		reports = time.Tick(*reportEvery)
+	}
+measuring:
+	for {
+		select {
+		case <-reports:
+			r.report(time.Since(start))
+		case <-stop:
+			break measuring
+		case <-ctx.Done():
+			break measuring
+		}
+	}
+	elapsed := time.Since(start)
+	cancel()
+	wg.Wait()
+
+	fmt.Println("Results")
+	r.report(elapsed)
+	if dropsAfter, err := serverDrops(token); err == nil {
+		fmt.Println("          messages dropped by the server:", dropsAfter-dropsBefore)
+	}
+}
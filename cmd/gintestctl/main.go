@@ -0,0 +1,126 @@
+// Command gintestctl registers, logs in and follows the signals of a gintest server from the terminal.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"local/gintest/client"
+)
+
+const usage = `Usage: gintestctl [flags] <command>
+
+Commands:
+  register                 create the account of the user
+  login                    print a session token of the user
+  signals list [flags]     print the signals, see gintestctl signals list -h
+  signals watch <names…>   follow the values of the named signals
+  clients count            print the number of clients connected to the server
+
+Flags:
+`
+
+var (
+	serverURL = flag.String("url", "http://localhost:2021", "base URL of the server")
+	username  = flag.String("user", os.Getenv("GINTEST_USER"), "user name, $GINTEST_USER by default")
+	password  = flag.String("password", os.Getenv("GINTEST_PASSWORD"), "password, $GINTEST_PASSWORD by default")
+	timeout   = flag.Duration("timeout", 30*time.Second, "time allowed to get an answer from the server, besides watch")
+	verbose   = flag.Bool("v", false, "log the client internals")
+)
+
+func newClient(config client.Config) *client.Client {
+	config.URL = *serverURL
+	config.Username = *username
+	config.Password = *password
+	return client.New(config)
+}
+
+func fail(v ...interface{}) {
+	fmt.Fprintln(os.Stderr, v...)
+	os.Exit(1)
+}
+
+// answerContext returns the context of a command waiting for a single answer of the server, cancelled once it
+// arrives.
+func answerContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), *timeout)
+}
+
+// runUntilAnswered runs a client until ctx is done, and fails if the server didn't answer in time. It logs in
+// first, so that bad credentials fail right away instead of when the timeout expires.
+func runUntilAnswered(ctx context.Context, config client.Config) {
+	c := newClient(config)
+	if err := c.Login(); err != nil {
+		fail(err)
+	}
+	err := c.Run(ctx)
+	if ctx.Err() == context.DeadlineExceeded {
+		fail("No answer from the server within ", *timeout)
+	}
+	if err != nil && err != context.Canceled {
+		fail(err)
+	}
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "register":
+		if err := newClient(client.Config{}).Register(); err != nil {
+			fail(err)
+		}
+		fmt.Println("User", *username, "registered")
+
+	case "login":
+		c := newClient(client.Config{})
+		if err := c.Login(); err != nil {
+			fail(err)
+		}
+		token, expire := c.Token()
+		fmt.Println(token)
+		fmt.Fprintln(os.Stderr, "Expires on", expire.Format(time.RFC1123))
+
+	case "signals":
+		if len(args) < 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		switch args[1] {
+		case "list":
+			listSignals(args[2:])
+		case "watch":
+			watchSignals(args[2:])
+		default:
+			fail("Unknown signals command ", args[1])
+		}
+
+	case "clients":
+		if len(args) < 2 || args[1] != "count" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		countClients()
+
+	default:
+		fail("Unknown command ", args[0])
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"local/gintest/apicommands"
+	"local/gintest/client"
+)
+
+const watchRefreshPeriod = 250 * time.Millisecond
+
+var typeNames = map[apicommands.PidType]string{
+	apicommands.AnalogicalPidType: "analogical",
+	apicommands.DiscretePidType:   "discrete",
+	apicommands.DigitalPidType:    "digital",
+}
+
+var stateNames = map[apicommands.PidState]string{
+	apicommands.NeverUpdatedPidState: "never",
+	apicommands.OkPidState:           "ok",
+	apicommands.BadPidState:          "bad",
+}
+
+func stateName(state apicommands.PidState) string {
+	if name, ok := stateNames[state]; ok {
+		return name
+	}
+	return fmt.Sprint("unknown(", int(state), ")")
+}
+
+func timestamp(t int64) string {
+	return time.Unix(0, t).Format("15:04:05.000")
+}
+
+func sortByIndex(signals []apicommands.PidData) {
+	sort.Slice(signals, func(i, j int) bool { return signals[i].Index < signals[j].Index })
+}
+
+func listSignals(args []string) {
+	flags := flag.NewFlagSet("signals list", flag.ExitOnError)
+	name := flags.String("name", "*", "only the signals whose name matches this pattern, like Sig1*")
+	typ := flags.String("type", "", "only the signals of this type: analogical, discrete or digital")
+	state := flags.String("state", "", "only the signals in this state: never, ok or bad")
+	output := flags.String("o", "table", "output format: table or json")
+	flags.Parse(args)
+
+	if *output != "table" && *output != "json" {
+		fail("Unknown output format ", *output)
+	}
+	if _, err := path.Match(*name, ""); err != nil {
+		fail("Bad name pattern: ", err)
+	}
+
+	var signals []apicommands.PidData
+	ctx, cancel := answerContext()
+	defer cancel()
+	runUntilAnswered(ctx, client.Config{
+		OnPidList: func(list apicommands.ApiPidListResponse) {
+			for _, signal := range list.List {
+				if matched, _ := path.Match(*name, signal.Name); !matched {
+					continue
+				}
+				if *typ != "" && typeNames[signal.Type] != *typ {
+					continue
+				}
+				if *state != "" && stateName(signal.State) != *state {
+					continue
+				}
+				signals = append(signals, signal)
+			}
+			cancel()
+		},
+	})
+	sortByIndex(signals)
+
+	if *output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(signals)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tNAME\tTYPE\tPERIOD\tVALUE\tSTATE\tUPDATED")
+	for _, signal := range signals {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%v\t%.3f\t%s\t%s\n", signal.Index, signal.Name, typeNames[signal.Type],
+			signal.SamplePeriod.Round(time.Millisecond), signal.Value, stateName(signal.State), timestamp(signal.LastUpdated))
+	}
+	w.Flush()
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// watchSignals follows the values of the named signals until interrupted. On a terminal the table is redrawn in
+// place, otherwise every update is printed as a line.
+func watchSignals(names []string) {
+	if len(names) == 0 {
+		fail("Which signals? Usage: gintestctl signals watch <names…>")
+	}
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	terminal := isTerminal(os.Stdout)
+
+	var mutex sync.Mutex
+	watched := make(map[int]string)
+	changed := false
+
+	c := newClient(client.Config{
+		OnPidList: func(list apicommands.ApiPidListResponse) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, signal := range list.List {
+				if wanted[signal.Name] {
+					watched[signal.Index] = signal.Name
+				}
+			}
+			if len(watched) < len(wanted) {
+				fmt.Fprintln(os.Stderr, "Only", len(watched), "of the", len(wanted), "signals exist")
+			}
+			changed = true
+		},
+		OnPidListUpdate: func(update apicommands.ApiPidListUpdateResponse) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, data := range update.List {
+				if name, ok := watched[data.Index]; ok {
+					changed = true
+					if !terminal {
+						fmt.Printf("%s\t%s\t%.3f\t%s\n", timestamp(data.LastUpdated), name, data.Value, stateName(data.State))
+					}
+				}
+			}
+		},
+		OnError: func(header apicommands.ApiResponseHeader) {
+			fmt.Fprintln(os.Stderr, "Error on command", header.Command, ":", header.Error)
+		},
+	})
+
+	if terminal {
+		go func() {
+			for range time.Tick(watchRefreshPeriod) {
+				mutex.Lock()
+				redraw := changed
+				changed = false
+				mutex.Unlock()
+				if redraw {
+					drawWatched(c, watched, &mutex)
+				}
+			}
+		}()
+	}
+	if err := c.Run(context.Background()); err != nil {
+		fail(err)
+	}
+}
+
+func drawWatched(c *client.Client, watched map[int]string, mutex *sync.Mutex) {
+	mutex.Lock()
+	indexes := make([]int, 0, len(watched))
+	for index := range watched {
+		indexes = append(indexes, index)
+	}
+	mutex.Unlock()
+	sort.Ints(indexes)
+
+	// Clear the screen and go back home before drawing the table
+	fmt.Print("\033[H\033[2J")
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVALUE\tSTATE\tUPDATED")
+	for _, index := range indexes {
+		signal, _ := c.Signal(index)
+		fmt.Fprintf(w, "%s\t%.3f\t%s\t%s\n", signal.Name, signal.Value, stateName(signal.State), timestamp(signal.LastUpdated))
+	}
+	w.Flush()
+	fmt.Println(strings.Repeat("-", 40))
+	fmt.Println(c.NClients(), "clients connected, Ctrl+C to quit")
+}
+
+func countClients() {
+	var nClients int
+	ctx, cancel := answerContext()
+	defer cancel()
+	runUntilAnswered(ctx, client.Config{
+		OnNClients: func(response apicommands.NCurrentClientsResponse) {
+			nClients = response.Number
+			cancel()
+		},
+	})
+	fmt.Println(nClients)
+}
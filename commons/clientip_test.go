@@ -0,0 +1,36 @@
+package commons
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	defer SetTrustedProxies(nil)
+	request := func(remoteAddr string, forwardedFor string) *http.Request {
+		r := &http.Request{RemoteAddr: remoteAddr, Header: http.Header{}}
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		return r
+	}
+
+	if ip := ClientIP(request("203.0.113.7:4242", "198.51.100.1")); ip != "203.0.113.7" {
+		t.Error("X-Forwarded-For was believed without a trusted proxy: ", ip)
+	}
+	if err := SetTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if ip := ClientIP(request("10.1.2.3:4242", "198.51.100.1, 203.0.113.7, 192.0.2.1")); ip != "203.0.113.7" {
+		t.Error("Wrong address behind the proxies: ", ip)
+	}
+	if ip := ClientIP(request("10.1.2.3:4242", "")); ip != "10.1.2.3" {
+		t.Error("Wrong address of a request of the proxy: ", ip)
+	}
+	if ip := ClientIP(request("203.0.113.7:4242", "198.51.100.1")); ip != "203.0.113.7" {
+		t.Error("X-Forwarded-For was believed from an untrusted address: ", ip)
+	}
+	if err := SetTrustedProxies([]string{"10.0.0.300"}); err == nil {
+		t.Error("A bad proxy address was accepted")
+	}
+}
@@ -0,0 +1,175 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"local/gintest/commons"
+	"local/gintest/services/audit"
+	"local/gintest/services/db"
+	"local/gintest/services/dbheap"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// ApiAuditEvent is a record of the audit log.
+type ApiAuditEvent struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Actor   string    `json:"actor"`
+	Target  string    `json:"target"`
+	IP      string    `json:"ip"`
+	Details string    `json:"details,omitempty"`
+}
+
+func newApiAuditEvent(event db.DBAuditEvent) ApiAuditEvent {
+	return ApiAuditEvent{
+		Time:    event.Time,
+		Action:  event.Action,
+		Actor:   event.Actor,
+		Target:  event.Target,
+		IP:      event.IP,
+		Details: event.Details,
+	}
+}
+
+type eventsPage struct {
+	Events []ApiAuditEvent `json:"events"`
+	Page   int             `json:"page"`
+	Limit  int             `json:"limit"`
+	Total  int             `json:"total"`
+}
+
+func respond(c *gin.Context, code int, message string) {
+	c.JSON(code, gin.H{
+		"code":    code,
+		"message": message,
+	})
+}
+
+func parseTime(c *gin.Context, name string) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("The %s parameter must be an RFC 3339 time", name)
+	}
+	return t, nil
+}
+
+// parseFilter reads the actor, action, target, ip, since and until query parameters. The action may end with *
+// to match the actions starting with the rest, like user.*.
+func parseFilter(c *gin.Context) (db.DBAuditFilter, error) {
+	filter := db.DBAuditFilter{
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+		Target: c.Query("target"),
+		IP:     c.Query("ip"),
+	}
+	var err error
+	if filter.Since, err = parseTime(c, "since"); err != nil {
+		return filter, err
+	}
+	filter.Until, err = parseTime(c, "until")
+	return filter, err
+}
+
+// parsePage reads the page, counted from 1, and the limit query parameters.
+func parsePage(c *gin.Context) (int, int, error) {
+	page, limit := 1, defaultPageSize
+	var err error
+	if value := c.Query("page"); value != "" {
+		if page, err = strconv.Atoi(value); err != nil || page < 1 {
+			return 0, 0, fmt.Errorf("The page must be a number from 1")
+		}
+	}
+	if value := c.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxPageSize {
+			return 0, 0, fmt.Errorf("The limit must be a number from 1 to %d", maxPageSize)
+		}
+	}
+	return page, limit, nil
+}
+
+// ListEvents answers with a page of the audit events matching the filter of the query, the newest first.
+func ListEvents(c *gin.Context) {
+	filter, err := parseFilter(c)
+	if err != nil {
+		respond(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, limit, err := parsePage(c)
+	if err != nil {
+		respond(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	session, err := dbheap.GetSession()
+	if err != nil {
+		respond(c, http.StatusServiceUnavailable, "The database is not available")
+		return
+	}
+	defer session.Close()
+	var events []db.DBAuditEvent
+	total, err := session.ClientSession.GetAuditEvents(filter, (page-1)*limit, limit, &events)
+	if err != nil {
+		respond(c, http.StatusInternalServerError, "Unable to read the audit log")
+		return
+	}
+	response := eventsPage{Events: make([]ApiAuditEvent, 0, len(events)), Page: page, Limit: limit, Total: total}
+	for _, event := range events {
+		response.Events = append(response.Events, newApiAuditEvent(event))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// ExportEvents streams every audit event matching the filter of the query as JSON lines, the oldest first.
+func ExportEvents(c *gin.Context) {
+	filter, err := parseFilter(c)
+	if err != nil {
+		respond(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	session, err := dbheap.GetSession()
+	if err != nil {
+		respond(c, http.StatusServiceUnavailable, "The database is not available")
+		return
+	}
+	defer session.Close()
+
+	userID, _ := c.Get("userID")
+	actor, _ := userID.(string)
+	audit.Record(audit.Event{Action: audit.AuditExport, Actor: actor, IP: commons.ClientIP(c.Request), Details: c.Request.URL.RawQuery})
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.jsonl"`, time.Now().UTC().Format("20060102T150405Z")))
+	c.Status(http.StatusOK)
+
+	iter := session.ClientSession.IterAuditEvents(filter)
+	encoder := json.NewEncoder(c.Writer)
+	var event db.DBAuditEvent
+	n := 0
+	for iter.Next(&event) {
+		if err = encoder.Encode(newApiAuditEvent(event)); err != nil {
+			// The client went away
+			break
+		}
+		n++
+		if n%maxPageSize == 0 {
+			c.Writer.Flush()
+		}
+	}
+	if err := iter.Close(); err != nil {
+		// Too late for an error status, the export is cut short
+		log.Println("Error exporting the audit log after ", n, " events: ", err)
+	}
+}
@@ -0,0 +1,63 @@
+package sse
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"local/gintest/commons"
+	"local/gintest/middleware/jwt"
+	"local/gintest/wslogic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parsePids reads the indexes of the "pids" query parameters, like ?pids=1,2,3&pids=7
+func parsePids(values []string) ([]int, error) {
+	var pids []int
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			index, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, err
+			}
+			pids = append(pids, index)
+		}
+	}
+	return pids, nil
+}
+
+// ServeEvents streams the signal updates and the number of connected clients as Server-Sent Events, for clients
+// that can't use a websocket. Like a websocket, the stream is authorized by a single use ticket from
+// /auth/ws_ticket, so the automatic reconnections of EventSource are refused: clients reconnect on their own with a
+// new ticket, passing the ID of the last event they got as the "resume" query parameter.
+func ServeEvents(c *gin.Context) {
+	uid, _ := c.Get("userID")
+	userID := uid.(string)
+	log.Println("User ID: ", userID)
+
+	pids, err := parsePids(c.QueryArray("pids"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    http.StatusBadRequest,
+			"message": "The pids filter must be a comma separated list of indexes",
+		})
+		return
+	}
+
+	conn := wslogic.NewEventStreamConn(wslogic.Session(jwt.TokenSession(c)), pids)
+	if resume := c.Query("resume"); resume != "" {
+		if point, err := wslogic.ParseResumePoint(resume); err == nil {
+			conn.ResumeFrom(point)
+		} else {
+			log.Println("Ignoring the resume point: ", err)
+		}
+	}
+	conn.SetClientIP(commons.ClientIP(c.Request))
+	wslogic.Register(conn)
+	conn.EventStreamPump(c.Writer, c.Request)
+}
@@ -0,0 +1,145 @@
+package user
+
+import (
+	"fmt"
+	"local/gintest/commons"
+	"local/gintest/middleware/jwt"
+	"local/gintest/services/audit"
+	"local/gintest/services/db"
+	"local/gintest/services/rbac"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+)
+
+const (
+	defaultApiKeyDays = 90
+	maxApiKeyDays     = 365
+)
+
+type createApiKeyRequest struct {
+	Name string `json:"name"`
+
+	// The roles the key may act with, none above the ones of the user
+	Scopes []string `json:"scopes"`
+
+	ExpiresInDays int `json:"expiresInDays"`
+}
+
+// ApiKey describes an API key. Its secret is only known when it's created.
+type ApiKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	Key        string     `json:"key,omitempty"`
+}
+
+func newApiKey(key db.DBApiKey) ApiKey {
+	return ApiKey{
+		ID:         key.KeyID,
+		Name:       key.Name,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: optionalTime(key.LastUsedAt),
+	}
+}
+
+// CreateApiKey creates an API key for the user of the request, answering with its secret, which isn't kept.
+func CreateApiKey(c *gin.Context) {
+	var request createApiKeyRequest
+	if err := c.ShouldBindJSON(&request); err != nil || strings.TrimSpace(request.Name) == "" || len(request.Scopes) == 0 {
+		respond(c, http.StatusBadRequest, "The name and the scopes of the key are required")
+		return
+	}
+	if request.ExpiresInDays == 0 {
+		request.ExpiresInDays = defaultApiKeyDays
+	}
+	if request.ExpiresInDays < 0 || request.ExpiresInDays > maxApiKeyDays {
+		respond(c, http.StatusBadRequest, fmt.Sprint("The keys expire in 1 to ", maxApiKeyDays, " days"))
+		return
+	}
+	roles := jwt.TokenRoles(c)
+	scopes := make([]string, 0, len(request.Scopes))
+	for _, name := range request.Scopes {
+		role, err := rbac.ParseRole(name)
+		if err != nil {
+			respond(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !rbac.Has(roles, role) {
+			respond(c, http.StatusForbidden, fmt.Sprint("The scope ", role, " exceeds your roles"))
+			return
+		}
+		scopes = append(scopes, string(role))
+	}
+
+	secret, keyID, hashedSecret, err := jwt.NewApiKey()
+	if err != nil {
+		respond(c, http.StatusInternalServerError, "Unable to generate the key")
+		return
+	}
+	now := time.Now()
+	key := db.DBApiKey{
+		KeyID:        keyID,
+		UserID:       actor(c),
+		Name:         strings.TrimSpace(request.Name),
+		HashedSecret: hashedSecret,
+		Scopes:       scopes,
+		CreatedAt:    now,
+		ExpiresAt:    now.AddDate(0, 0, request.ExpiresInDays),
+	}
+	withSession(c, func(session *db.DB) {
+		if err := session.InsertApiKey(key); err != nil {
+			respond(c, http.StatusInternalServerError, "Unable to store the key")
+			return
+		}
+		audit.Record(audit.Event{Action: audit.ApiKeyCreate, Actor: key.UserID, Target: keyID, IP: commons.ClientIP(c.Request),
+			Details: key.Name + " " + strings.Join(scopes, ",")})
+		response := newApiKey(key)
+		response.Key = secret
+		c.JSON(http.StatusCreated, response)
+	})
+}
+
+// ListApiKeys answers with the API keys of the user of the request.
+func ListApiKeys(c *gin.Context) {
+	withSession(c, func(session *db.DB) {
+		var keys []db.DBApiKey
+		if err := session.GetUserApiKeys(actor(c), &keys); err != nil {
+			respond(c, http.StatusInternalServerError, "Unable to read the keys")
+			return
+		}
+		apiKeys := make([]ApiKey, 0, len(keys))
+		for _, key := range keys {
+			apiKeys = append(apiKeys, newApiKey(key))
+		}
+		c.JSON(http.StatusOK, apiKeys)
+	})
+}
+
+// DeleteApiKey revokes the API key of the user of the request given by the "id" route parameter, closing the
+// connections opened with it.
+func DeleteApiKey(c *gin.Context) {
+	keyID, userID := c.Param("id"), actor(c)
+	withSession(c, func(session *db.DB) {
+		err := session.DeleteApiKey(keyID, userID)
+		if err == mgo.ErrNotFound {
+			respond(c, http.StatusNotFound, "No API key "+keyID)
+			return
+		}
+		if err != nil {
+			respond(c, http.StatusInternalServerError, "Unable to delete the key")
+			return
+		}
+		jwt.GetHInstance().RevokeApiKey(userID, keyID)
+		audit.Record(audit.Event{Action: audit.ApiKeyRevoke, Actor: userID, Target: keyID, IP: commons.ClientIP(c.Request)})
+		respond(c, http.StatusOK, "Deleted the API key "+keyID)
+	})
+}
@@ -0,0 +1,256 @@
+package user
+
+import (
+	"fmt"
+	"local/gintest/commons"
+	"local/gintest/middleware/jwt"
+	"local/gintest/services/audit"
+	"local/gintest/services/db"
+	"local/gintest/services/rbac"
+	"local/gintest/services/totp"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+)
+
+const (
+	// The issuer shown by the authenticator apps
+	totpIssuer = "gintest"
+
+	recoveryCodesCount = 10
+)
+
+// ApiMFAStatus describes the second factor of a user.
+type ApiMFAStatus struct {
+	Enrolled          bool `json:"enrolled"`
+	Required          bool `json:"required"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+}
+
+type codeRequest struct {
+	Code string `json:"code"`
+}
+
+// mfaRequired tells whether the user must have a second factor.
+func mfaRequired(session *db.DB, user db.DBUser) (bool, error) {
+	var settings db.DBMFASettings
+	if err := session.GetMFASettings(&settings); err != nil {
+		return false, err
+	}
+	return jwt.MFARequired(rbac.UserRoles(user.Roles), settings.Roles), nil
+}
+
+// withUser runs f with the user of the request, answering on its own when it can't be read.
+func withUser(c *gin.Context, f func(session *db.DB, user db.DBUser)) {
+	withSession(c, func(session *db.DB) {
+		var user db.DBUser
+		if err := session.GetUser(actor(c), &user); err != nil {
+			respond(c, http.StatusInternalServerError, "Unable to read the user")
+			return
+		}
+		f(session, user)
+	})
+}
+
+// failedCode refuses a wrong code of the second factor of the user of the request, auditing it like a failed login
+// on action.
+func failedCode(c *gin.Context, username string, action string) {
+	audit.Record(audit.Event{Action: audit.LoginFailure, Actor: username, Target: username, IP: commons.ClientIP(c.Request), Details: "Wrong second factor on " + action})
+	respond(c, http.StatusForbidden, jwt.ErrFailedSecondFactor.Error())
+}
+
+// GetMFA answers with the second factor of the user of the request.
+func GetMFA(c *gin.Context) {
+	withUser(c, func(session *db.DB, user db.DBUser) {
+		required, err := mfaRequired(session, user)
+		if err != nil {
+			respond(c, http.StatusInternalServerError, "Unable to read the second factor settings")
+			return
+		}
+		status := ApiMFAStatus{Enrolled: jwt.MFAEnrolled(user), Required: required}
+		if status.Enrolled {
+			status.RecoveryCodesLeft = len(user.TOTP.RecoveryCodes)
+		}
+		c.JSON(http.StatusOK, status)
+	})
+}
+
+// EnrollMFA starts the enrollment of a TOTP secret for the user of the request, answering with its provisioning
+// URI. It's only asked for at login once confirmed with ConfirmMFA.
+func EnrollMFA(c *gin.Context) {
+	secret, err := totp.NewSecret()
+	if err != nil {
+		respond(c, http.StatusInternalServerError, "Unable to generate the secret")
+		return
+	}
+	username := actor(c)
+	withSession(c, func(session *db.DB) {
+		switch err := session.EnrollTOTP(username, secret, time.Now()); err {
+		case nil:
+			c.JSON(http.StatusOK, gin.H{
+				"code":   http.StatusOK,
+				"secret": secret,
+				"uri":    totp.ProvisioningURI(totpIssuer, username, secret),
+			})
+		case mgo.ErrNotFound:
+			respond(c, http.StatusConflict, "A second factor is already enrolled, disable it first")
+		default:
+			respond(c, http.StatusInternalServerError, "Unable to enroll the second factor")
+		}
+	})
+}
+
+// ConfirmMFA confirms the enrollment with a first code of the app, answering with the recovery codes, which aren't
+// kept. The codes count as login attempts. The users who had to enroll get a token granting their roles by
+// refreshing theirs.
+func ConfirmMFA(c *gin.Context) {
+	var request codeRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.Code == "" {
+		respond(c, http.StatusBadRequest, "The code is required")
+		return
+	}
+	withUser(c, func(session *db.DB, user db.DBUser) {
+		if user.TOTP == nil || user.TOTP.Confirmed {
+			respond(c, http.StatusConflict, "No second factor is being enrolled")
+			return
+		}
+		if !attemptCredentials(c, user.Username) {
+			return
+		}
+		now := time.Now()
+		step, ok := totp.Verify(user.TOTP.Secret, request.Code, now, 0)
+		if !ok {
+			failedCode(c, user.Username, audit.MFAEnroll)
+			return
+		}
+		jwt.GetHInstance().CredentialsSucceeded(user.Username, c)
+		codes, err := totp.NewRecoveryCodes(recoveryCodesCount)
+		if err != nil {
+			respond(c, http.StatusInternalServerError, "Unable to generate the recovery codes")
+			return
+		}
+		hashes := make([]string, len(codes))
+		for i, code := range codes {
+			hashes[i] = totp.HashRecoveryCode(code)
+		}
+		switch err = session.ConfirmTOTP(user.Username, user.TOTP.Secret, step, hashes, now); err {
+		case nil:
+			audit.Record(audit.Event{Action: audit.MFAEnroll, Actor: user.Username, Target: user.Username, IP: commons.ClientIP(c.Request)})
+			c.JSON(http.StatusOK, gin.H{
+				"code":          http.StatusOK,
+				"message":       "The second factor is enrolled, keep the recovery codes safe",
+				"recoveryCodes": codes,
+			})
+		case mgo.ErrNotFound:
+			respond(c, http.StatusConflict, "The enrollment changed meanwhile, enroll again")
+		default:
+			respond(c, http.StatusInternalServerError, "Unable to confirm the second factor")
+		}
+	})
+}
+
+// DisableMFA removes the second factor of the user of the request, given a current code or a recovery code counting
+// as a login attempt, unless its roles require one.
+func DisableMFA(c *gin.Context) {
+	var request codeRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.Code == "" {
+		respond(c, http.StatusBadRequest, "The code is required")
+		return
+	}
+	withUser(c, func(session *db.DB, user db.DBUser) {
+		if !jwt.MFAEnrolled(user) {
+			respond(c, http.StatusConflict, "No second factor is enrolled")
+			return
+		}
+		required, err := mfaRequired(session, user)
+		if err != nil {
+			respond(c, http.StatusInternalServerError, "Unable to read the second factor settings")
+			return
+		}
+		if required {
+			respond(c, http.StatusForbidden, "The roles of the user require a second factor")
+			return
+		}
+		if !attemptCredentials(c, user.Username) {
+			return
+		}
+		now := time.Now()
+		if step, ok := totp.Verify(user.TOTP.Secret, request.Code, now, user.TOTP.LastStep); ok {
+			err = session.UseTOTPStep(user.Username, step)
+		} else {
+			err = session.UseRecoveryCode(user.Username, totp.HashRecoveryCode(request.Code))
+		}
+		if err == mgo.ErrNotFound {
+			failedCode(c, user.Username, audit.MFADisable)
+			return
+		}
+		if err == nil {
+			jwt.GetHInstance().CredentialsSucceeded(user.Username, c)
+			err = session.ClearTOTP(user.Username, now)
+		}
+		if err != nil {
+			respond(c, http.StatusInternalServerError, "Unable to disable the second factor")
+			return
+		}
+		audit.Record(audit.Event{Action: audit.MFADisable, Actor: user.Username, Target: user.Username, IP: commons.ClientIP(c.Request)})
+		respond(c, http.StatusOK, "Disabled the second factor")
+	})
+}
+
+// ResetMFA removes the second factor of a user who lost it. If its roles require one, it must enroll again on its
+// next login.
+func ResetMFA(c *gin.Context) {
+	withSession(c, func(session *db.DB) {
+		err := session.ClearTOTP(c.Param("username"), time.Now())
+		if err == nil {
+			record(c, audit.MFAReset, "")
+		}
+		respondUpdate(c, err, "Reset the second factor of "+c.Param("username"))
+	})
+}
+
+// GetMFARoles answers with the roles that must log in with a second factor.
+func GetMFARoles(c *gin.Context) {
+	withSession(c, func(session *db.DB) {
+		var settings db.DBMFASettings
+		if err := session.GetMFASettings(&settings); err != nil {
+			respond(c, http.StatusInternalServerError, "Unable to read the second factor settings")
+			return
+		}
+		roles := settings.Roles
+		if roles == nil {
+			roles = []string{}
+		}
+		c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "roles": roles})
+	})
+}
+
+// SetMFARoles sets the roles that must log in with a second factor, the higher roles included. Their users without
+// one must enroll it before using anything else once their tokens are refreshed.
+func SetMFARoles(c *gin.Context) {
+	var request rolesRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.Roles == nil {
+		respond(c, http.StatusBadRequest, "The roles are required, possibly none")
+		return
+	}
+	roles := make([]string, 0, len(request.Roles))
+	for _, name := range request.Roles {
+		role, err := rbac.ParseRole(name)
+		if err != nil {
+			respond(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		roles = append(roles, string(role))
+	}
+	withSession(c, func(session *db.DB) {
+		settings := db.DBMFASettings{Roles: roles, UpdatedAt: time.Now(), UpdatedBy: actor(c)}
+		if err := session.SetMFASettings(settings); err != nil {
+			respond(c, http.StatusInternalServerError, "Unable to save the second factor settings")
+			return
+		}
+		audit.Record(audit.Event{Action: audit.MFARoles, Actor: actor(c), IP: commons.ClientIP(c.Request), Details: fmt.Sprint(roles)})
+		respond(c, http.StatusOK, "Set the roles requiring a second factor")
+	})
+}
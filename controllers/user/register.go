@@ -3,12 +3,14 @@ package user
 import (
 	"encoding/json"
 	"errors"
+	"local/gintest/commons"
+	"local/gintest/services/audit"
 	"local/gintest/services/db"
 	"local/gintest/services/dbheap"
+	"local/gintest/services/rbac"
 	"log"
 	"net/http"
-
-	"golang.org/x/crypto/bcrypt"
+	"time"
 )
 
 type userRegisterStruct struct {
@@ -38,7 +40,6 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	}
 	header := w.Header()
 	header.Add("ASD", "EFG")
-	log.Println("Info read from the body: ", string(bodyData))
 	if !json.Valid(bodyData) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -50,19 +51,24 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	log.Println("User: ", userData.UserName)
-	log.Println("Password: ", userData.Password)
+	log.Println("Registering the user: ", userData.UserName)
 
-	hash, herr := bcrypt.GenerateFromPassword([]byte(userData.Password), bcrypt.DefaultCost)
-	if herr != nil {
-		log.Println("Error generating hash: ", herr)
+	hash, err := passwordHash(userData.Password)
+	if err == errShortPassword {
 		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	dbUser := db.DBUser{
 		Username:       userData.UserName,
-		HashedPassword: string(hash),
+		HashedPassword: hash,
+		Roles:          []string{string(rbac.DefaultRole)},
+		CreatedAt:      time.Now(),
 	}
 	session, err := dbheap.GetSession()
 	if err != nil {
@@ -77,7 +83,8 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
+	audit.Record(audit.Event{Action: audit.UserRegister, Actor: dbUser.Username, Target: dbUser.Username, IP: commons.ClientIP(r)})
 
+	// The body holds the password, it's not echoed back
 	w.WriteHeader(http.StatusCreated)
-	w.Write(bodyData)
 }
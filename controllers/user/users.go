@@ -0,0 +1,382 @@
+package user
+
+import (
+	"fmt"
+	"local/gintest/commons"
+	"local/gintest/middleware/jwt"
+	"local/gintest/services/audit"
+	"local/gintest/services/db"
+	"local/gintest/services/dbheap"
+	"local/gintest/services/rbac"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+// ApiUser describes a user, without its password.
+type ApiUser struct {
+	Username          string     `json:"username"`
+	Roles             []string   `json:"roles"`
+	Disabled          bool       `json:"disabled"`
+	MFAEnrolled       bool       `json:"mfaEnrolled"`
+	CreatedAt         *time.Time `json:"createdAt,omitempty"`
+	UpdatedAt         *time.Time `json:"updatedAt,omitempty"`
+	PasswordChangedAt *time.Time `json:"passwordChangedAt,omitempty"`
+}
+
+// optionalTime leaves out the times the users registered before they were recorded don't have.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func newApiUser(user db.DBUser) ApiUser {
+	return ApiUser{
+		Username:          user.Username,
+		Roles:             rbac.UserRoles(user.Roles),
+		Disabled:          user.Disabled,
+		MFAEnrolled:       jwt.MFAEnrolled(user),
+		CreatedAt:         optionalTime(user.CreatedAt),
+		UpdatedAt:         optionalTime(user.UpdatedAt),
+		PasswordChangedAt: optionalTime(user.PasswordChangedAt),
+	}
+}
+
+type passwordRequest struct {
+	Password string `json:"password"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type rolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+func respond(c *gin.Context, code int, message string) {
+	c.JSON(code, gin.H{
+		"code":    code,
+		"message": message,
+	})
+}
+
+// withSession runs f with a database session, answering on its own when there's none.
+func withSession(c *gin.Context, f func(session *db.DB)) {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		log.Println("Error getting session: ", err)
+		respond(c, http.StatusServiceUnavailable, "The database is not available")
+		return
+	}
+	defer session.Close()
+	f(session.ClientSession)
+}
+
+// PromoteAdmins gives the admin role to the registered users among usernames, so a new deployment has someone to
+// assign the roles. The role is stored like any other, it stays until an admin takes it back.
+func PromoteAdmins(usernames []string) error {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	for _, username := range usernames {
+		if username = strings.TrimSpace(username); username == "" {
+			continue
+		}
+		var user db.DBUser
+		err = session.ClientSession.GetUser(username, &user)
+		if err == mgo.ErrNotFound {
+			log.Println("Unable to make ", username, " an admin, there's no such user")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		roles := rbac.UserRoles(user.Roles)
+		if rbac.Has(roles, rbac.Admin) {
+			continue
+		}
+		roles = append(roles, string(rbac.Admin))
+		if err = session.ClientSession.SetUserRoles(username, roles, time.Now()); err != nil {
+			return err
+		}
+		audit.Record(audit.Event{Action: audit.UserRoles, Target: username, Details: strings.Join(roles, ",")})
+	}
+	return nil
+}
+
+// respondUpdate answers an update of the user of the request, with ok if it succeeded.
+func respondUpdate(c *gin.Context, err error, ok string) {
+	switch err {
+	case nil:
+		respond(c, http.StatusOK, ok)
+	case mgo.ErrNotFound:
+		respond(c, http.StatusNotFound, "No user "+c.Param("username"))
+	default:
+		respond(c, http.StatusInternalServerError, "Unable to update the user")
+	}
+}
+
+// actor returns the user sending the request.
+func actor(c *gin.Context) string {
+	userID, _ := c.Get("userID")
+	actor, _ := userID.(string)
+	return actor
+}
+
+func record(c *gin.Context, action string, details string) {
+	audit.Record(audit.Event{Action: action, Actor: actor(c), Target: c.Param("username"), IP: commons.ClientIP(c.Request), Details: details})
+}
+
+// notOnSelf refuses what would let an admin lock itself out, answering on its own if it's the case.
+func notOnSelf(c *gin.Context) bool {
+	if c.Param("username") == actor(c) {
+		respond(c, http.StatusConflict, "Admins can't do that to themselves")
+		return false
+	}
+	return true
+}
+
+// revokeSessions logs a user out everywhere once its account changed.
+func revokeSessions(username string) {
+	if err := jwt.GetHInstance().RevokeUser(username); err != nil {
+		log.Println("Error revoking the sessions of ", username, ": ", err)
+	}
+}
+
+// attemptCredentials counts an attempt of the user of the request to prove itself again on the lockouts of its
+// logins, answering on its own when it must wait.
+func attemptCredentials(c *gin.Context, username string) bool {
+	err := jwt.GetHInstance().AttemptCredentials(username, c)
+	if throttled, ok := err.(*jwt.LoginThrottledError); ok {
+		c.Header("Retry-After", throttled.RetryAfterHeader())
+		respond(c, http.StatusTooManyRequests, throttled.Error())
+		return false
+	}
+	if err != nil {
+		respond(c, http.StatusInternalServerError, "Unable to count the attempt")
+		return false
+	}
+	return true
+}
+
+func hashPassword(c *gin.Context, password string) (string, bool) {
+	hash, err := passwordHash(password)
+	if err == errShortPassword {
+		respond(c, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	if err != nil {
+		respond(c, http.StatusInternalServerError, "Unable to hash the password")
+		return "", false
+	}
+	return hash, true
+}
+
+var errShortPassword = fmt.Errorf("The password must have at least %d characters", minPasswordLength)
+
+// passwordHash checks a new password is long enough and hashes it.
+func passwordHash(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", errShortPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Println("Error generating hash: ", err)
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// ListUsers answers with every user.
+func ListUsers(c *gin.Context) {
+	withSession(c, func(session *db.DB) {
+		var users []db.DBUser
+		if err := session.GetUsers(&users); err != nil {
+			respond(c, http.StatusInternalServerError, "Unable to read the users")
+			return
+		}
+		apiUsers := make([]ApiUser, 0, len(users))
+		for _, user := range users {
+			apiUsers = append(apiUsers, newApiUser(user))
+		}
+		c.JSON(http.StatusOK, apiUsers)
+	})
+}
+
+// GetUser answers with the user named by the "username" route parameter.
+func GetUser(c *gin.Context) {
+	withSession(c, func(session *db.DB) {
+		var user db.DBUser
+		err := session.GetUser(c.Param("username"), &user)
+		if err == mgo.ErrNotFound {
+			respond(c, http.StatusNotFound, "No user "+c.Param("username"))
+			return
+		}
+		if err != nil {
+			respond(c, http.StatusInternalServerError, "Unable to read the user")
+			return
+		}
+		c.JSON(http.StatusOK, newApiUser(user))
+	})
+}
+
+// DisableUser stops a user from logging in and logs it out everywhere.
+func DisableUser(c *gin.Context) {
+	if !notOnSelf(c) {
+		return
+	}
+	withSession(c, func(session *db.DB) {
+		err := session.SetUserDisabled(c.Param("username"), true, time.Now())
+		if err == nil {
+			revokeSessions(c.Param("username"))
+			record(c, audit.UserDisable, "")
+		}
+		respondUpdate(c, err, "Disabled "+c.Param("username"))
+	})
+}
+
+// EnableUser lets a disabled user log in again.
+func EnableUser(c *gin.Context) {
+	withSession(c, func(session *db.DB) {
+		err := session.SetUserDisabled(c.Param("username"), false, time.Now())
+		if err == nil {
+			record(c, audit.UserEnable, "")
+		}
+		respondUpdate(c, err, "Enabled "+c.Param("username"))
+	})
+}
+
+// DeleteUser deletes a user and logs it out everywhere.
+func DeleteUser(c *gin.Context) {
+	if !notOnSelf(c) {
+		return
+	}
+	withSession(c, func(session *db.DB) {
+		err := session.DeleteUser(c.Param("username"))
+		if err == nil {
+			revokeSessions(c.Param("username"))
+			record(c, audit.UserDelete, "")
+		}
+		respondUpdate(c, err, "Deleted "+c.Param("username"))
+	})
+}
+
+// lowered tells whether roles take away any of the stored ones.
+func lowered(stored []string, roles []string) bool {
+	for _, role := range rbac.UserRoles(stored) {
+		if !rbac.Has(roles, rbac.Role(role)) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetUserRoles replaces the roles of a user. They're in the tokens it gets from its next login or refresh on, and
+// it's logged out everywhere if it lost any, so that its current tokens don't keep them.
+func SetUserRoles(c *gin.Context) {
+	var request rolesRequest
+	if err := c.ShouldBindJSON(&request); err != nil || len(request.Roles) == 0 {
+		respond(c, http.StatusBadRequest, "The roles are required")
+		return
+	}
+	roles := make([]string, 0, len(request.Roles))
+	for _, name := range request.Roles {
+		role, err := rbac.ParseRole(name)
+		if err != nil {
+			respond(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		roles = append(roles, string(role))
+	}
+	if c.Param("username") == actor(c) && !rbac.Has(roles, rbac.Admin) {
+		respond(c, http.StatusConflict, "Admins can't drop their own admin role")
+		return
+	}
+	withSession(c, func(session *db.DB) {
+		var user db.DBUser
+		err := session.GetUser(c.Param("username"), &user)
+		if err == nil {
+			err = session.SetUserRoles(c.Param("username"), roles, time.Now())
+		}
+		if err == nil {
+			if lowered(user.Roles, roles) {
+				revokeSessions(c.Param("username"))
+			}
+			record(c, audit.UserRoles, strings.Join(roles, ","))
+		}
+		respondUpdate(c, err, "Set the roles of "+c.Param("username"))
+	})
+}
+
+// ResetPassword sets the password of a user, logging it out everywhere.
+func ResetPassword(c *gin.Context) {
+	var request passwordRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respond(c, http.StatusBadRequest, "The password is required")
+		return
+	}
+	hash, ok := hashPassword(c, request.Password)
+	if !ok {
+		return
+	}
+	withSession(c, func(session *db.DB) {
+		err := session.SetUserPassword(c.Param("username"), hash, time.Now())
+		if err == nil {
+			revokeSessions(c.Param("username"))
+			record(c, audit.UserPasswordReset, "")
+		}
+		respondUpdate(c, err, "Reset the password of "+c.Param("username"))
+	})
+}
+
+// ChangePassword sets the password of the user of the request, given its current one, which counts as a login
+// attempt. Every session of the user, this one included, is logged out.
+func ChangePassword(c *gin.Context) {
+	var request changePasswordRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.CurrentPassword == "" {
+		respond(c, http.StatusBadRequest, "The current and the new passwords are required")
+		return
+	}
+	username := actor(c)
+	withSession(c, func(session *db.DB) {
+		var user db.DBUser
+		if err := session.GetUser(username, &user); err != nil {
+			respond(c, http.StatusInternalServerError, "Unable to read the user")
+			return
+		}
+		// Counted like a login, so that a stolen session can't guess the password
+		if !attemptCredentials(c, username) {
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(user.HashedPassword), []byte(request.CurrentPassword)) != nil {
+			audit.Record(audit.Event{Action: audit.LoginFailure, Actor: username, Target: username, IP: commons.ClientIP(c.Request), Details: "Wrong password on " + audit.UserPasswordChange})
+			respond(c, http.StatusForbidden, "The current password is wrong")
+			return
+		}
+		jwt.GetHInstance().CredentialsSucceeded(username, c)
+		hash, ok := hashPassword(c, request.NewPassword)
+		if !ok {
+			return
+		}
+		if err := session.SetUserPassword(username, hash, time.Now()); err != nil {
+			respond(c, http.StatusInternalServerError, "Unable to change the password")
+			return
+		}
+		revokeSessions(username)
+		audit.Record(audit.Event{Action: audit.UserPasswordChange, Actor: username, Target: username, IP: commons.ClientIP(c.Request)})
+		respond(c, http.StatusOK, "Changed the password, log in again")
+	})
+}
@@ -0,0 +1,71 @@
+package user
+
+import (
+	"local/gintest/middleware/jwt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHash(t *testing.T) {
+	if _, err := passwordHash("short"); err != errShortPassword {
+		t.Error("A short password was accepted: ", err)
+	}
+	hash, err := passwordHash("long enough")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte("long enough")) != nil {
+		t.Error("The hash doesn't match the password")
+	}
+}
+
+func TestLowered(t *testing.T) {
+	tests := []struct {
+		stored  []string
+		roles   []string
+		lowered bool
+	}{
+		{[]string{"viewer"}, []string{"viewer", "operator"}, false},
+		{[]string{"viewer", "operator"}, []string{"viewer"}, true},
+		{[]string{"operator"}, []string{"admin"}, false},
+		{[]string{"admin"}, []string{"operator"}, true},
+		// The users registered before the roles are viewers
+		{nil, []string{"viewer"}, false},
+	}
+	for _, test := range tests {
+		if lowered(test.stored, test.roles) != test.lowered {
+			t.Error("Wrong lowering from ", test.stored, " to ", test.roles)
+		}
+	}
+}
+
+// throttledLockouts refuses every attempt.
+type throttledLockouts struct{}
+
+func (throttledLockouts) Attempt(username string, ip string, now time.Time) error {
+	return &jwt.LoginThrottledError{RetryAfter: 1500 * time.Millisecond}
+}
+func (throttledLockouts) Forgive(ip string)                  {}
+func (throttledLockouts) Succeed(username string, ip string) {}
+
+func TestAttemptCredentials(t *testing.T) {
+	mw := jwt.GetHInstance()
+	lockouts := mw.Lockouts
+	mw.Lockouts = throttledLockouts{}
+	defer func() { mw.Lockouts = lockouts }()
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("PUT", "/auth/password", nil)
+	if attemptCredentials(c, "alice") {
+		t.Fatal("A throttled attempt went on")
+	}
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "2" {
+		t.Error("Wrong refusal: ", recorder.Code, recorder.Header())
+	}
+}
@@ -3,6 +3,8 @@ package ws
 import (
 	"log"
 
+	"local/gintest/commons"
+	"local/gintest/middleware/jwt"
 	"local/gintest/wslogic"
 
 	"github.com/gin-gonic/gin"
@@ -14,21 +16,28 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
-// ServeWs handles websocket requests from the peer.
+// ServeWs handles websocket requests from the peer, authorized by a ticket redeemed beforehand.
 func ServeWs(c *gin.Context) {
 	uid, _ := c.Get("userID")
 	userID := uid.(string)
 	log.Println("User ID: ", userID)
 	w := c.Writer
 	r := c.Request
-	token := r.URL.Query().Get("token")
-	log.Println("WS Token: ", token)
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	conn := wslogic.NewConn(ws)
+	conn := wslogic.NewConn(ws, wslogic.Session(jwt.TokenSession(c)))
+	// A reconnecting client gets what it missed since the last broadcast it saw
+	if resume := r.URL.Query().Get("resume"); resume != "" {
+		if point, err := wslogic.ParseResumePoint(resume); err == nil {
+			conn.ResumeFrom(point)
+		} else {
+			log.Println("Ignoring the resume point: ", err)
+		}
+	}
+	conn.SetClientIP(commons.ClientIP(c.Request))
 	wslogic.Register(conn)
 	go conn.WritePump()
 	go conn.ReadPump()
@@ -1,18 +1,96 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
 
+	"local/gintest/apicommands"
+	"local/gintest/commons"
+	"local/gintest/controllers/auditlog"
+	"local/gintest/controllers/sse"
 	"local/gintest/controllers/user"
 	"local/gintest/controllers/ws"
 	"local/gintest/middleware/jwt"
+	"local/gintest/middleware/oidc"
+	"local/gintest/services/audit"
+	"local/gintest/services/backplane"
+	"local/gintest/services/dbheap"
 	"local/gintest/services/pid"
+	"local/gintest/services/rbac"
+	"local/gintest/services/stats"
 	"local/gintest/wslogic"
 )
 
+var (
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "time allowed to shut down gracefully after SIGINT or SIGTERM")
+	backplaneURL    = flag.String("backplane", "memory", "backplane shared with the other instances: memory or a redis://host:port url")
+	admins          = flag.String("admins", "", "comma separated registered users given the admin role on startup, to assign the first roles")
+	rateLimits      = flag.String("rate-limits", "", "JSON file overriding the default limits of the websocket messages, per connection, user and command")
+	jwtKeys         = flag.String("jwt-keys", "", "comma separated PEM key files signing the tokens, the first private one issues them; reloaded on SIGHUP")
+	trustedProxies  = flag.String("trusted-proxies", "", "comma separated IPs or CIDR ranges of the reverse proxies whose X-Forwarded-For is believed")
+	oidcIssuer      = flag.String("oidc-issuer", "", "URL of an OpenID Connect provider to log in with besides the local accounts, none if empty")
+	oidcClientID    = flag.String("oidc-client-id", "", "client ID of the service on the OpenID Connect provider, whose secret is read from GINTEST_OIDC_CLIENT_SECRET")
+	oidcRedirectURL = flag.String("oidc-redirect-url", "http://localhost:2021/oidc/callback", "callback of the service registered on the OpenID Connect provider")
+)
+
 func main() {
 
+	flag.Parse()
+
+	bp, err := backplane.Dial(*backplaneURL)
+	if err != nil {
+		log.Fatalln("Error connecting to the backplane: ", err)
+	}
+	wslogic.SetBackplane(bp)
+	if *rateLimits != "" {
+		limits, err := wslogic.LoadRateLimits(*rateLimits)
+		if err != nil {
+			log.Fatalln("Error loading the rate limits: ", err)
+		}
+		wslogic.SetRateLimits(limits)
+	}
+	wslogic.SetTokenValidator(func(token string) (wslogic.Session, error) {
+		session, err := jwt.ValidateToken(token)
+		return wslogic.Session(session), err
+	})
+	// The commands needing more than the viewer role are audited, even when they're refused
+	wslogic.UseMessagesMiddleware(
+		wslogic.AuditCommands(func(command apicommands.CommandType) bool { return rbac.CommandRole(command) != rbac.Viewer }),
+		wslogic.AuthorizeRoles(rbac.AuthorizeCommand),
+	)
+	wslogic.SetTopicAuthorizer(rbac.AuthorizeTopic)
+
+	if err = commons.SetTrustedProxies(strings.Split(*trustedProxies, ",")); err != nil {
+		log.Fatalln("Error setting the trusted proxies: ", err)
+	}
+
+	var keysFiles []string
+	if *jwtKeys != "" {
+		keysFiles = strings.Split(*jwtKeys, ",")
+	}
+	if err = jwt.LoadKeys(keysFiles); err != nil {
+		log.Fatalln("Error loading the JWT keys: ", err)
+	}
+
+	// Logging out closes the connections opened with the revoked tokens
+	jwt.GetHInstance().OnRevoke = func(userID string, sessionID string, before time.Time) {
+		wslogic.RevokeSessions(wslogic.SessionRevocation{UserID: userID, SessionID: sessionID, Before: before})
+	}
+
+	audit.Init()
+	if err = user.PromoteAdmins(strings.Split(*admins, ",")); err != nil {
+		log.Fatalln("Error promoting the admins: ", err)
+	}
 	wslogic.Init()
 	pid.Init()
 
@@ -24,17 +102,41 @@ func main() {
 		c.HTML(200, "index.html", nil)
 	})
 
+	// The tokens in the URLs would end up in the logs, a websocket or an event stream is opened with a single use
+	// ticket instead
 	r.GET(
 		"/ws",
-		jwt.GetQInstance().MiddlewareFunc(),
+		jwt.GetHInstance().TicketMiddlewareFunc(),
 		ws.ServeWs,
 	)
 
+	r.GET(
+		"/sse",
+		jwt.GetHInstance().TicketMiddlewareFunc(),
+		sse.ServeEvents,
+	)
+
 	r.POST("/register", func(c *gin.Context) {
 		user.Register(c.Writer, c.Request)
 	})
 
 	r.POST("/login", jwt.GetHInstance().LoginHandler)
+	r.POST("/login/challenge", jwt.GetHInstance().ChallengeHandler)
+
+	if *oidcIssuer != "" {
+		sso := oidc.NewHandler(oidc.Config{
+			Issuer:       *oidcIssuer,
+			ClientID:     *oidcClientID,
+			ClientSecret: os.Getenv("GINTEST_OIDC_CLIENT_SECRET"),
+			RedirectURL:  *oidcRedirectURL,
+			Scopes:       []string{"profile", "email"},
+		}, jwt.GetHInstance())
+		r.GET("/oidc/login", sso.Login)
+		r.GET("/oidc/callback", sso.Callback)
+	}
+
+	// The public keys verifying the tokens, for other services
+	r.GET("/.well-known/jwks.json", jwt.JWKSHandler)
 
 	auth := r.Group("/auth")
 
@@ -42,7 +144,90 @@ func main() {
 	{
 		auth.GET("/hello", jwt.HelloHandler)
 		auth.GET("/refresh_token", jwt.GetHInstance().RefreshHandler)
+		auth.POST("/ws_ticket", jwt.GetHInstance().TicketHandler)
+		auth.POST("/logout", jwt.GetHInstance().LogoutHandler)
+		auth.POST("/logout_all", jwt.GetHInstance().LogoutEverywhereHandler)
+		auth.GET("/lockouts", jwt.LockoutsHandler)
+		auth.DELETE("/lockouts/:kind/:value", jwt.UnlockHandler)
+
+		auth.POST("/password", user.ChangePassword)
+		auth.GET("/apikeys", user.ListApiKeys)
+		auth.POST("/apikeys", user.CreateApiKey)
+		auth.DELETE("/apikeys/:id", user.DeleteApiKey)
+		auth.GET("/users", user.ListUsers)
+		auth.GET("/users/:username", user.GetUser)
+		auth.DELETE("/users/:username", user.DeleteUser)
+		auth.POST("/users/:username/disable", user.DisableUser)
+		auth.POST("/users/:username/enable", user.EnableUser)
+		auth.POST("/users/:username/password", user.ResetPassword)
+		auth.PUT("/users/:username/roles", user.SetUserRoles)
+		auth.DELETE("/users/:username/mfa", user.ResetMFA)
+
+		auth.GET("/mfa", user.GetMFA)
+		auth.POST("/mfa/enroll", user.EnrollMFA)
+		auth.POST("/mfa/confirm", user.ConfirmMFA)
+		auth.DELETE("/mfa", user.DisableMFA)
+		auth.GET("/mfa/roles", user.GetMFARoles)
+		auth.PUT("/mfa/roles", user.SetMFARoles)
+
+		auth.GET("/audit", auditlog.ListEvents)
+		auth.GET("/audit/export", auditlog.ExportEvents)
+		auth.GET("/stats", func(c *gin.Context) {
+			c.JSON(200, stats.TakeSnapshot())
+		})
+		auth.GET("/connections", func(c *gin.Context) {
+			c.JSON(200, wslogic.Connections())
+		})
+	}
+
+	srv := &http.Server{
+		Addr:    "localhost:2021",
+		Handler: r,
 	}
+	srv.RegisterOnShutdown(wslogic.CloseEventStreams)
 
-	r.Run("localhost:2021")
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalln("Error running the server: ", err)
+		}
+	}()
+
+	// Rotate the keys without restarting
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := jwt.ReloadKeys(); err != nil {
+				log.Println("Error reloading the JWT keys: ", err)
+			} else {
+				log.Println("JWT keys reloaded")
+			}
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
+	log.Println("Got ", sig, ", shutting down within ", *shutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	// Stop taking requests first, then the producers, the websocket clients and finally the DB
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down the HTTP server: ", err)
+	}
+	if err := pid.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down the PIDs: ", err)
+	}
+	if err := wslogic.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down the websocket hubs: ", err)
+	}
+	if err := audit.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down the audit log: ", err)
+	}
+	if err := dbheap.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down the DB heap: ", err)
+	}
+	log.Println("Server stopped")
 }
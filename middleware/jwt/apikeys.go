@@ -0,0 +1,168 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"local/gintest/services/db"
+	"local/gintest/services/dbheap"
+	"local/gintest/services/rbac"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	jwtgo "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+const (
+	// API keys read gtk_<id>_<secret>, so they're told apart from the tokens and easy to spot in leaked files
+	apiKeyPrefix = "gtk_"
+
+	apiKeyIDSize     = 6
+	apiKeySecretSize = 32
+
+	// How precisely the last use of the keys is recorded
+	apiKeyUsePrecision = time.Minute
+)
+
+var (
+	ErrInvalidApiKey      = errors.New("The API key is invalid or expired")
+	ErrApiKeyAccountRoute = errors.New("API keys can't manage the accounts, log in")
+)
+
+// The routes managing the accounts, which API keys can't use so that a leaked key can't be turned into more access.
+var accountRoutes = []string{"/auth/users", "/auth/mfa", "/auth/lockouts", "/auth/apikeys", "/auth/password"}
+
+// accountRoute tells whether a route, as registered in gin, manages the accounts.
+func accountRoute(path string) bool {
+	for _, route := range accountRoutes {
+		if path == route || strings.HasPrefix(path, route+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// IsApiKey tells an API key apart from a token.
+func IsApiKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+func hashApiKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewApiKey returns a new key with its ID and the hash of its secret, the only parts to be stored.
+func NewApiKey() (key string, keyID string, hashedSecret string, err error) {
+	id := make([]byte, apiKeyIDSize)
+	secret := make([]byte, apiKeySecretSize)
+	if _, err = rand.Read(id); err != nil {
+		return
+	}
+	if _, err = rand.Read(secret); err != nil {
+		return
+	}
+	keyID = hex.EncodeToString(id)
+	secretString := base64.RawURLEncoding.EncodeToString(secret)
+	return apiKeyPrefix + keyID + "_" + secretString, keyID, hashApiKeySecret(secretString), nil
+}
+
+// parseApiKey splits a key into its ID and its secret.
+func parseApiKey(key string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(key, apiKeyPrefix), "_", 2)
+	if !IsApiKey(key) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", ErrInvalidApiKey
+	}
+	return parts[0], parts[1], nil
+}
+
+const apiKeySessionPrefix = "apikey:"
+
+// apiKeySessionID is the session of the requests made with a key, to close their connections when it's deleted.
+func apiKeySessionID(keyID string) string {
+	return apiKeySessionPrefix + keyID
+}
+
+// sessionApiKeyID returns the key of a session of the requests made with one, empty for the sessions of tokens.
+func sessionApiKeyID(sessionID string) string {
+	if !strings.HasPrefix(sessionID, apiKeySessionPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(sessionID, apiKeySessionPrefix)
+}
+
+// apiKeyClaims are the claims of the requests made with a key: its user, with the roles allowed by its scopes.
+func apiKeyClaims(key db.DBApiKey, user db.DBUser) jwtgo.MapClaims {
+	roles := rbac.Capped(rbac.UserRoles(user.Roles), key.Scopes)
+	claimsRoles := make([]interface{}, 0, len(roles))
+	for _, role := range roles {
+		claimsRoles = append(claimsRoles, role)
+	}
+	return jwtgo.MapClaims{
+		"id":       key.UserID,
+		"roles":    claimsRoles,
+		"sid":      apiKeySessionID(key.KeyID),
+		"orig_iat": float64(key.CreatedAt.Unix()),
+		"exp":      float64(key.ExpiresAt.Unix()),
+		"apikey":   key.KeyID,
+	}
+}
+
+// ValidateApiKey checks a key against the stored ones and their users, returning the claims of its requests.
+func ValidateApiKey(apiKey string) (jwtgo.MapClaims, error) {
+	keyID, secret, err := parseApiKey(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	session, err := dbheap.GetSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	var key db.DBApiKey
+	if err = session.ClientSession.GetApiKey(keyID, &key); err == mgo.ErrNotFound {
+		return nil, ErrInvalidApiKey
+	} else if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if subtle.ConstantTimeCompare([]byte(hashApiKeySecret(secret)), []byte(key.HashedSecret)) != 1 || !key.ExpiresAt.After(now) {
+		return nil, ErrInvalidApiKey
+	}
+	// The key can't do more than its user can now
+	var user db.DBUser
+	if err = session.ClientSession.GetUser(key.UserID, &user); err != nil {
+		return nil, ErrInvalidApiKey
+	}
+	if user.Disabled {
+		return nil, ErrDisabledUser
+	}
+	if err = session.ClientSession.TouchApiKey(keyID, now, apiKeyUsePrecision); err != nil {
+		log.Println("Error recording the use of the API key ", keyID, ": ", err)
+	}
+	return apiKeyClaims(key, user), nil
+}
+
+// ApiKeyID returns the key the claims were read from, empty for the tokens.
+func ApiKeyID(claims jwtgo.MapClaims) string {
+	keyID, _ := claims["apikey"].(string)
+	return keyID
+}
+
+// FromApiKey tells whether a request authorized by one of the middlewares was made with an API key.
+func FromApiKey(c *gin.Context) bool {
+	return ApiKeyID(ExtractClaims(c)) != ""
+}
+
+// RevokeApiKey closes the connections opened with a deleted key.
+func (mw *Middleware) RevokeApiKey(userID string, keyID string) {
+	if mw.OnRevoke != nil {
+		mw.OnRevoke(userID, apiKeySessionID(keyID), mw.now())
+	}
+}
@@ -0,0 +1,90 @@
+package jwt
+
+import (
+	"local/gintest/services/db"
+	"local/gintest/services/rbac"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwtgo "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+func TestApiKey(t *testing.T) {
+	key, keyID, hashedSecret, err := NewApiKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsApiKey(key) || IsApiKey("eyJhbGciOiJFUzI1NiJ9.e30.sig") {
+		t.Fatal("API keys and tokens mixed up")
+	}
+	if strings.Contains(key, hashedSecret) {
+		t.Error("The key contains the stored hash")
+	}
+	id, secret, err := parseApiKey(key)
+	if err != nil || id != keyID || hashApiKeySecret(secret) != hashedSecret {
+		t.Fatal("The key doesn't match its ID and hash: ", id, err)
+	}
+	for _, bad := range []string{"gtk_", "gtk_abc", "gtk__secret", "abc_def"} {
+		if _, _, err := parseApiKey(bad); err != ErrInvalidApiKey {
+			t.Error("Parsed the bad key ", bad)
+		}
+	}
+}
+
+func TestApiKeyClaims(t *testing.T) {
+	key := db.DBApiKey{KeyID: "id", UserID: "user", Scopes: []string{"operator"}, CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	claims := apiKeyClaims(key, db.DBUser{Username: "user", Roles: []string{"admin"}})
+	if roles := claimsRoles(claims); !rbac.Has(roles, rbac.Operator) || rbac.Has(roles, rbac.Engineer) {
+		t.Error("The scopes didn't cap the roles: ", roles)
+	}
+	if ApiKeyID(claims) != "id" || claimsSessionID(claims) != apiKeySessionID("id") {
+		t.Error("Wrong key claims: ", claims)
+	}
+
+	// A demoted user takes its keys down with it
+	claims = apiKeyClaims(key, db.DBUser{Username: "user", Roles: []string{"viewer"}})
+	if roles := claimsRoles(claims); rbac.Has(roles, rbac.Operator) {
+		t.Error("The key kept the roles of the user: ", roles)
+	}
+}
+
+// authorize runs the authorizator on a request to path, made with claims on the route registered in gin.
+func authorize(claims jwtgo.MapClaims, method string, route string, path string) error {
+	var err error
+	engine := gin.New()
+	engine.Handle(method, route, func(c *gin.Context) {
+		c.Set(payloadKey, claims)
+		err = authorizator(claims["id"].(string), c)
+	})
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, path, nil))
+	return err
+}
+
+func TestApiKeyAccountRoutes(t *testing.T) {
+	key := db.DBApiKey{KeyID: "id", UserID: "admin", Scopes: []string{"admin"}, CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	claims := apiKeyClaims(key, db.DBUser{Username: "admin", Roles: []string{"admin"}})
+	for _, route := range [][3]string{
+		{"GET", "/auth/users", "/auth/users"},
+		{"DELETE", "/auth/users/:username", "/auth/users/bob"},
+		{"PUT", "/auth/users/:username/roles", "/auth/users/bob/roles"},
+		{"PUT", "/auth/mfa/roles", "/auth/mfa/roles"},
+		{"DELETE", "/auth/lockouts/:kind/:value", "/auth/lockouts/user/bob"},
+		{"POST", "/auth/apikeys", "/auth/apikeys"},
+		{"POST", "/auth/password", "/auth/password"},
+	} {
+		if err := authorize(claims, route[0], route[1], route[2]); err != ErrApiKeyAccountRoute {
+			t.Error("An API key got to ", route[0], " ", route[2], ": ", err)
+		}
+	}
+	if err := authorize(claims, "GET", "/auth/stats", "/auth/stats"); err != nil {
+		t.Error(err)
+	}
+
+	token := jwtgo.MapClaims{"id": "admin", "roles": []interface{}{"admin"}}
+	if err := authorize(token, "DELETE", "/auth/users/:username", "/auth/users/bob"); err != nil {
+		t.Error("An admin token was refused: ", err)
+	}
+}
@@ -1,38 +1,38 @@
 package jwt
 
 import (
+	"local/gintest/commons"
+	"local/gintest/services/audit"
 	"local/gintest/services/db"
 	"local/gintest/services/dbheap"
+	"local/gintest/services/rbac"
 	"log"
 	"sync"
 	"time"
 
-	"github.com/appleboy/gin-jwt"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
+	jwtgo "gopkg.in/dgrijalva/jwt-go.v3"
 )
 
-const sKey = "secret key"
-
-var jwtHMiddleware *jwt.GinJWTMiddleware
-var jwtQMiddleware *jwt.GinJWTMiddleware
+var jwtHMiddleware *Middleware
 
 var hOnce sync.Once
-var qOnce sync.Once
 
-func GetHInstance() *jwt.GinJWTMiddleware {
+func GetHInstance() *Middleware {
 	hOnce.Do(func() {
-		jwtHMiddleware = &jwt.GinJWTMiddleware{
+		jwtHMiddleware = &Middleware{
 			Realm:         "test zone",
-			Key:           []byte(sKey),
 			Timeout:       time.Hour,
 			MaxRefresh:    time.Hour,
 			Authenticator: authenticator,
-			Authorizator: func(userId string, c *gin.Context) bool {
-				log.Println("In authorizator: ", userId)
-
-				return true
-			},
+			SecondFactors: mongoSecondFactors{},
+			Lockouts:      mongoLockouts{},
+			Authorizator:  authorizator,
+			PayloadFunc:   payload,
+			Revocations:   mongoRevocations{},
+			Tickets:       mongoTickets{},
+			ApiKeys:       ValidateApiKey,
 			Unauthorized: func(c *gin.Context, code int, message string) {
 				log.Println("In unauthorized: ", code, " ", message)
 				c.JSON(code, gin.H{
@@ -61,71 +61,154 @@ func GetHInstance() *jwt.GinJWTMiddleware {
 	return jwtHMiddleware
 }
 
-func GetQInstance() *jwt.GinJWTMiddleware {
-	qOnce.Do(func() {
-		jwtQMiddleware = &jwt.GinJWTMiddleware{
-			Realm:         "test zone",
-			Key:           []byte(sKey),
-			Timeout:       time.Hour,
-			MaxRefresh:    time.Hour,
-			Authenticator: authenticator,
-
-			Authorizator: func(userId string, c *gin.Context) bool {
-				log.Println("In Q authorizator: ", userId)
-
-				return true
-			},
-			Unauthorized: func(c *gin.Context, code int, message string) {
-				log.Println("In Q unauthorized: ", code, " ", message)
-				c.JSON(code, gin.H{
-					"code":    code,
-					"message": message,
-				})
-			},
-			// TokenLookup is a string in the form of "<source>:<name>" that is used
-			// to extract token from the request.
-			// Optional. Default value "header:Authorization".
-			// Possible values:
-			// - "header:<name>"
-			// - "query:<name>"
-			// - "cookie:<name>"
-			//TokenLookup: "header:Authorization",
-			TokenLookup: "query:token",
-			// TokenLookup: "cookie:token",
-
-			// TokenHeadName is a string in the header. Default value is "Bearer"
-			TokenHeadName: "Bearer",
-
-			// TimeFunc provides the current time. You can override it to use another time value. This is useful for testing or if your server uses a different time zone than your tokens.
-			TimeFunc: time.Now,
-		}
-	})
-	return jwtQMiddleware
-}
-
-func authenticator(userId string, password string, c *gin.Context) (string, bool) {
-	log.Println("Inside authenticator: ", userId, " ", password)
-	session, _ := dbheap.GetSession()
+// authenticator checks the password of a user. The middleware counted the attempt beforehand, and takes it back
+// once the login succeeds.
+func authenticator(userId string, password string, c *gin.Context) (string, error) {
+	log.Println("Inside authenticator: ", userId)
+	session, err := dbheap.GetSession()
+	if err != nil {
+		log.Println("Error on authenticator getting session: ", err)
+		return userId, err
+	}
 	defer session.Close()
+	ip := commons.ClientIP(c.Request)
 	userStruct := db.DBUser{}
-	err := session.ClientSession.GetUser(userId, &userStruct)
+	err = session.ClientSession.GetUser(userId, &userStruct)
 	if err != nil {
 		log.Println("Error on authenticator: ", err)
-		return userId, false
+		auditLogin(audit.LoginFailure, userId, ip, "Unknown user")
+		return userId, ErrFailedAuthentication
 	}
 	err = bcrypt.CompareHashAndPassword([]byte(userStruct.HashedPassword), []byte(password))
 	if err != nil {
 		log.Println("Error on authenticator comparing hash and password: ", err)
-		return userId, false
+		auditLogin(audit.LoginFailure, userId, ip, "Wrong password")
+		return userId, ErrFailedAuthentication
+	}
+	if userStruct.Disabled {
+		log.Println("Refusing a login of the disabled user ", userId)
+		auditLogin(audit.LoginFailure, userId, ip, ErrDisabledUser.Error())
+		return userId, ErrDisabledUser
+	}
+	if MFAEnrolled(userStruct) {
+		log.Println("Authentication succeded, awaiting the second factor")
+		auditLogin(audit.LoginChallenge, userId, ip, "")
+		return userId, nil
 	}
 	log.Println("Authentication succeded")
-	return userId, true
+	auditLogin(audit.LoginSuccess, userId, ip, "")
+	return userId, nil
+}
+
+func auditLogin(action string, userID string, ip string, details string) {
+	audit.Record(audit.Event{Action: action, Actor: userID, Target: userID, IP: ip, Details: details})
+}
+
+// payload puts the roles of the user in its tokens, so they're read again from the database on every refresh, and
+// whether the user must enroll a second factor first. It fails rather than guess either, so that no token skips
+// the enrollment.
+func payload(userID string) (map[string]interface{}, error) {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		log.Println("Error on payload getting session: ", err)
+		return nil, err
+	}
+	defer session.Close()
+	userStruct := db.DBUser{}
+	if err = session.ClientSession.GetUser(userID, &userStruct); err != nil {
+		log.Println("Error reading the roles of ", userID, ": ", err)
+		return nil, err
+	}
+	pending, err := mfaEnrollmentPending(session.ClientSession, userStruct)
+	if err != nil {
+		log.Println("Error reading the second factor of ", userID, ": ", err)
+		return nil, err
+	}
+	claims := map[string]interface{}{"roles": rbac.UserRoles(userStruct.Roles)}
+	if pending {
+		claims[mfaEnrollmentClaim] = true
+	}
+	return claims, nil
+}
+
+// authorizator lets the user through the routes its roles allow, only to the enrollment ones if it must enroll a
+// second factor first. API keys never get to the routes managing the accounts.
+func authorizator(userID string, c *gin.Context) error {
+	if FromApiKey(c) && accountRoute(c.FullPath()) {
+		return ErrApiKeyAccountRoute
+	}
+	if claimsMFAEnrollment(ExtractClaims(c)) && !enrollmentRoutes[c.Request.Method+" "+c.FullPath()] {
+		return ErrMFAEnrollmentRequired
+	}
+	return rbac.AuthorizeRoute(TokenRoles(c), c.Request.Method, c.FullPath())
 }
 
 func HelloHandler(c *gin.Context) {
-	claims := jwt.ExtractClaims(c)
+	claims := ExtractClaims(c)
 	c.JSON(200, gin.H{
 		"userID": claims["id"],
 		"text":   "Hello World.",
 	})
 }
+
+// Session is what a token tells about the session it belongs to.
+type Session struct {
+	UserID    string
+	ID        string
+	Roles     []string
+	StartedAt time.Time
+	ExpiresAt time.Time
+}
+
+func claimsSession(claims jwtgo.MapClaims) Session {
+	userID, _ := claims["id"].(string)
+	return Session{
+		UserID:    userID,
+		ID:        claimsSessionID(claims),
+		Roles:     claimsRoles(claims),
+		StartedAt: claimsSessionStart(claims),
+		ExpiresAt: claimsExpiration(claims),
+	}
+}
+
+// ValidateToken checks a token issued by /login or /auth/refresh_token, returning the session it belongs to.
+func ValidateToken(tokenString string) (Session, error) {
+	claims, err := GetHInstance().ValidateToken(tokenString)
+	if err != nil {
+		return Session{}, err
+	}
+	if claimsMFAEnrollment(claims) {
+		return Session{}, ErrMFAEnrollmentRequired
+	}
+	return claimsSession(claims), nil
+}
+
+// TokenSession returns the session of the token of a request authorized by one of the middlewares.
+func TokenSession(c *gin.Context) Session {
+	return claimsSession(ExtractClaims(c))
+}
+
+// TokenRoles returns the roles in the token of a request authorized by one of the middlewares.
+func TokenRoles(c *gin.Context) []string {
+	return claimsRoles(ExtractClaims(c))
+}
+
+// claimsRoles reads the roles of the claims, the default one for the tokens issued before roles existed.
+func claimsRoles(claims jwtgo.MapClaims) []string {
+	values, _ := claims["roles"].([]interface{})
+	roles := make([]string, 0, len(values))
+	for _, value := range values {
+		if role, ok := value.(string); ok {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 {
+		roles = append(roles, string(rbac.DefaultRole))
+	}
+	return roles
+}
+
+func claimsExpiration(claims jwtgo.MapClaims) time.Time {
+	exp, _ := claims["exp"].(float64)
+	return time.Unix(int64(exp), 0)
+}
@@ -0,0 +1,397 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	jwtgo "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+// The environment variables the signing keys are read from, besides the key files.
+const (
+	// Comma separated paths of PEM key files, used when no files are given
+	keysFilesEnv = "GINTEST_JWT_KEYS"
+
+	// A PEM private key
+	keyEnv = "GINTEST_JWT_KEY"
+
+	// A shared secret for HS256, only fit for a single service
+	secretEnv = "GINTEST_JWT_SECRET"
+)
+
+var (
+	ErrUnknownKey              = errors.New("The token was signed with an unknown key")
+	ErrInvalidSigningAlgorithm = errors.New("Invalid signing algorithm")
+)
+
+// Key signs or verifies tokens with a single algorithm, and is told apart by its ID, sent as the "kid" header of
+// the tokens.
+type Key struct {
+	ID        string
+	Algorithm string
+
+	// Nil for the keys that only verify
+	signingKey   interface{}
+	verifyingKey interface{}
+}
+
+func (k *Key) method() jwtgo.SigningMethod {
+	return jwtgo.GetSigningMethod(k.Algorithm)
+}
+
+func (k *Key) canSign() bool {
+	return k.signingKey != nil
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// padded returns the big endian bytes of n, padded to size as the JWK coordinates must be.
+func padded(n *big.Int, size int) []byte {
+	data := n.Bytes()
+	if len(data) >= size {
+		return data
+	}
+	return append(make([]byte, size-len(data)), data...)
+}
+
+// JWK is the public part of a key, as published on the JWKS endpoint.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// publicJWK returns the public key as a JWK, or false for the symmetric keys, which must stay secret.
+func publicJWK(public crypto.PublicKey) (JWK, bool) {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		return JWK{KeyType: "RSA", Use: "sig", Algorithm: "RS256", N: b64(public.N.Bytes()), E: b64(big.NewInt(int64(public.E)).Bytes())}, true
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		return JWK{KeyType: "EC", Use: "sig", Algorithm: "ES256", Curve: public.Curve.Params().Name,
+			X: b64(padded(public.X, size)), Y: b64(padded(public.Y, size))}, true
+	}
+	return JWK{}, false
+}
+
+func unb64(name string, value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("Invalid JWK member %s", name)
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// PublicKey returns the key described by a JWK, RSA or P-256 EC.
+func (jwk JWK) PublicKey() (crypto.PublicKey, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := unb64("n", jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := unb64("e", jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > math.MaxInt32 {
+			return nil, errors.New("Invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return nil, fmt.Errorf("Unsupported curve %q", jwk.Curve)
+		}
+		x, err := unb64("x", jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := unb64("y", jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("The EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %q", jwk.KeyType)
+}
+
+// thumbprint is the RFC 7638 thumbprint of a public key, the ID of the asymmetric keys.
+func thumbprint(jwk JWK) string {
+	var members string
+	switch jwk.KeyType {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk.Curve, jwk.X, jwk.Y)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return b64(sum[:])
+}
+
+func newAsymmetricKey(private crypto.PrivateKey, public crypto.PublicKey) (*Key, error) {
+	jwk, ok := publicJWK(public)
+	if !ok {
+		return nil, errors.New("Unsupported key type")
+	}
+	if ec, isEC := public.(*ecdsa.PublicKey); isEC && ec.Curve != elliptic.P256() {
+		return nil, errors.New("Only P-256 EC keys are supported, for ES256")
+	}
+	var signingKey interface{}
+	if private != nil {
+		signingKey = private
+	}
+	return &Key{ID: thumbprint(jwk), Algorithm: jwk.Algorithm, signingKey: signingKey, verifyingKey: public}, nil
+}
+
+// NewHMACKey returns an HS256 key. Anyone able to verify its tokens can issue them too.
+func NewHMACKey(secret []byte) *Key {
+	sum := sha256.Sum256(secret)
+	return &Key{ID: "hs-" + b64(sum[:8]), Algorithm: "HS256", signingKey: secret, verifyingKey: secret}
+}
+
+// GenerateKey returns a new ES256 key.
+func GenerateKey() (*Key, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return newAsymmetricKey(private, &private.PublicKey)
+}
+
+// ParseKey reads a PEM private key, RSA or EC in PKCS #1, SEC 1 or PKCS #8 form, or a PEM public key, which only
+// verifies tokens.
+func ParseKey(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM data found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newAsymmetricKey(private, &private.PublicKey)
+	case "EC PRIVATE KEY":
+		private, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newAsymmetricKey(private, &private.PublicKey)
+	case "PRIVATE KEY":
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch private := private.(type) {
+		case *rsa.PrivateKey:
+			return newAsymmetricKey(private, &private.PublicKey)
+		case *ecdsa.PrivateKey:
+			return newAsymmetricKey(private, &private.PublicKey)
+		}
+		return nil, errors.New("Unsupported private key type")
+	case "PUBLIC KEY":
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newAsymmetricKey(nil, public)
+	}
+	return nil, fmt.Errorf("Unsupported PEM block %q", block.Type)
+}
+
+// KeySet holds the keys accepted to verify tokens. The first one able to sign issues the new tokens, so a key can
+// be rotated by adding the new one after it, moving it first once every instance knows it, and dropping the old
+// one once its tokens expired.
+type KeySet struct {
+	mutex   sync.RWMutex
+	signing *Key
+	keys    map[string]*Key
+	order   []string
+}
+
+func NewKeySet(keys ...*Key) (*KeySet, error) {
+	s := &KeySet{}
+	return s, s.set(keys)
+}
+
+func (s *KeySet) set(keys []*Key) error {
+	var signing *Key
+	byID := make(map[string]*Key, len(keys))
+	order := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := byID[key.ID]; ok {
+			continue
+		}
+		if signing == nil && key.canSign() {
+			signing = key
+		}
+		byID[key.ID] = key
+		order = append(order, key.ID)
+	}
+	if signing == nil {
+		return errors.New("None of the keys can sign tokens")
+	}
+	s.mutex.Lock()
+	s.signing, s.keys, s.order = signing, byID, order
+	s.mutex.Unlock()
+	return nil
+}
+
+// Sign signs the claims with the signing key, naming it in the "kid" header.
+func (s *KeySet) Sign(claims jwtgo.MapClaims) (string, error) {
+	s.mutex.RLock()
+	key := s.signing
+	s.mutex.RUnlock()
+	if key == nil {
+		return "", errors.New("No signing key loaded")
+	}
+	token := jwtgo.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signingKey)
+}
+
+// Keyfunc finds the key a token was signed with, making sure the token uses the algorithm of that key.
+func (s *KeySet) Keyfunc(token *jwtgo.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	s.mutex.RLock()
+	key, ok := s.keys[kid]
+	s.mutex.RUnlock()
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if token.Method == nil || token.Method.Alg() != key.Algorithm {
+		return nil, ErrInvalidSigningAlgorithm
+	}
+	return key.verifyingKey, nil
+}
+
+// JWKS returns the public keys, for other services to verify the tokens.
+func (s *KeySet) JWKS() []JWK {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	jwks := []JWK{}
+	for _, id := range s.order {
+		if public, ok := s.keys[id].verifyingKey.(crypto.PublicKey); ok {
+			if jwk, ok := publicJWK(public); ok {
+				jwk.ID = id
+				jwks = append(jwks, jwk)
+			}
+		}
+	}
+	return jwks
+}
+
+// readKeys loads the key files and the keys in the environment, in this order.
+func readKeys(files []string) ([]*Key, error) {
+	if len(files) == 0 && os.Getenv(keysFilesEnv) != "" {
+		files = strings.Split(os.Getenv(keysFilesEnv), ",")
+	}
+	var keys []*Key
+	for _, file := range files {
+		if file = strings.TrimSpace(file); file == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParseKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(file), err)
+		}
+		keys = append(keys, key)
+	}
+	if pemKey := os.Getenv(keyEnv); pemKey != "" {
+		key, err := ParseKey([]byte(pemKey))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", keyEnv, err)
+		}
+		keys = append(keys, key)
+	}
+	if secret := os.Getenv(secretEnv); secret != "" {
+		keys = append(keys, NewHMACKey([]byte(secret)))
+	}
+	return keys, nil
+}
+
+var (
+	keySet    = &KeySet{keys: map[string]*Key{}}
+	keysFiles []string
+)
+
+// LoadKeys loads the keys signing and verifying the tokens from files, the first one able to sign being used to
+// issue tokens, and from the environment. With no keys at all a temporary one is generated, whose tokens are only
+// valid on this instance until it stops.
+func LoadKeys(files []string) error {
+	keys, err := readKeys(files)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		log.Println("JWT >>> No signing keys configured, generating a temporary one. Set ", keysFilesEnv, " for tokens valid across restarts and instances")
+		key, err := GenerateKey()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	if err = keySet.set(keys); err != nil {
+		return err
+	}
+	keysFiles = files
+	log.Println("JWT >>> Signing tokens with key ", keySet.signing.ID, " (", keySet.signing.Algorithm, "), ", len(keys), " keys accepted")
+	return nil
+}
+
+// ReloadKeys reads again the keys given to LoadKeys, to rotate them without restarting. A temporary key is kept.
+func ReloadKeys() error {
+	keys, err := readKeys(keysFiles)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("No keys to reload")
+	}
+	return keySet.set(keys)
+}
+
+// JWKSHandler publishes the public keys verifying the tokens as a JSON Web Key Set.
+func JWKSHandler(c *gin.Context) {
+	c.JSON(200, struct {
+		Keys []JWK `json:"keys"`
+	}{Keys: keySet.JWKS()})
+}
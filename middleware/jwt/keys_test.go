@@ -0,0 +1,100 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	jwtgo "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+func ecPEM(t *testing.T) []byte {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func rsaPEM(t *testing.T) ([]byte, []byte) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})
+}
+
+func TestParseKey(t *testing.T) {
+	ec, err := ParseKey(ecPEM(t))
+	if err != nil || ec.Algorithm != "ES256" || !ec.canSign() {
+		t.Fatal("Wrong EC key: ", ec, err)
+	}
+
+	privatePEM, publicPEM := rsaPEM(t)
+	private, err := ParseKey(privatePEM)
+	if err != nil || private.Algorithm != "RS256" || !private.canSign() {
+		t.Fatal("Wrong RSA key: ", private, err)
+	}
+	public, err := ParseKey(publicPEM)
+	if err != nil || public.canSign() {
+		t.Fatal("Wrong RSA public key: ", public, err)
+	}
+	// The ID only depends on the public key
+	if public.ID != private.ID {
+		t.Error("The public and private keys have different IDs: ", public.ID, private.ID)
+	}
+
+	if _, err = ParseKey([]byte("not a key")); err == nil {
+		t.Error("Parsed a bad key")
+	}
+}
+
+func TestKeySet(t *testing.T) {
+	_, publicPEM := rsaPEM(t)
+	public, _ := ParseKey(publicPEM)
+	if _, err := NewKeySet(public); err == nil {
+		t.Fatal("A key set without a signing key was accepted")
+	}
+
+	ec, _ := ParseKey(ecPEM(t))
+	hmac := NewHMACKey([]byte("secret"))
+	keys, err := NewKeySet(public, ec, hmac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.signing != ec {
+		t.Error("The first key able to sign should sign")
+	}
+
+	// The shared secret is never published
+	jwks := keys.JWKS()
+	if len(jwks) != 2 || jwks[0].ID != public.ID || jwks[1].ID != ec.ID || jwks[1].Curve != "P-256" {
+		t.Fatal("Wrong JWKS: ", jwks)
+	}
+
+	token := &jwtgo.Token{Header: map[string]interface{}{"kid": ec.ID}, Method: &jwtgo.SigningMethodECDSA{Name: "ES256"}}
+	if key, err := keys.Keyfunc(token); err != nil || key != ec.verifyingKey {
+		t.Error("Wrong verifying key: ", key, err)
+	}
+	token.Method = &jwtgo.SigningMethodHMAC{Name: "HS256"}
+	if _, err := keys.Keyfunc(token); err != ErrInvalidSigningAlgorithm {
+		t.Error("Accepted a token with the algorithm of another key: ", err)
+	}
+	token.Header["kid"] = "unknown"
+	if _, err := keys.Keyfunc(token); err != ErrUnknownKey {
+		t.Error("Accepted a token signed by an unknown key: ", err)
+	}
+}
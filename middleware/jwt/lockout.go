@@ -0,0 +1,275 @@
+package jwt
+
+import (
+	"fmt"
+	"local/gintest/commons"
+	"local/gintest/services/audit"
+	"local/gintest/services/db"
+	"local/gintest/services/dbheap"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+)
+
+const (
+	// Failed logins allowed before having to wait between attempts
+	freeLoginAttempts = 3
+
+	// The wait after the first failure beyond the free ones, doubled by every new one up to the maximum
+	loginBackoffBase = time.Second
+	loginBackoffMax  = time.Minute
+
+	// Failed logins locking out a username, or a source address trying many of them
+	userLockoutThreshold = 10
+	ipLockoutThreshold   = 50
+
+	lockoutDuration = 15 * time.Minute
+
+	// The failures are forgotten after this long without new ones
+	loginFailuresWindow = time.Hour
+)
+
+// The kinds of the tracked login failures.
+const (
+	userLoginKey = "user"
+	ipLoginKey   = "ip"
+)
+
+func loginKey(kind string, value string) string {
+	return kind + ":" + value
+}
+
+// LoginThrottledError refuses a login without checking the password, because of too many failures.
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprint("Too many failed logins, locked out for ", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprint("Too many failed logins, retry in ", e.RetryAfter.Round(time.Second))
+}
+
+// RetryAfterHeader is the value of the Retry-After header of the refused login, in whole seconds.
+func (e *LoginThrottledError) RetryAfterHeader() string {
+	return strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds())))
+}
+
+// loginBackoff is how long to wait after the last of failures before trying again.
+func loginBackoff(failures int) time.Duration {
+	if failures < freeLoginAttempts {
+		return 0
+	}
+	backoff := float64(loginBackoffBase) * math.Pow(2, float64(failures-freeLoginAttempts))
+	if backoff > float64(loginBackoffMax) {
+		return loginBackoffMax
+	}
+	return time.Duration(backoff)
+}
+
+// loginDelay returns how long failures forbid logging in from now, 0 if they don't.
+func loginDelay(failures db.DBLoginFailures, now time.Time) (time.Duration, bool) {
+	if failures.LockedUntil.After(now) {
+		return failures.LockedUntil.Sub(now), true
+	}
+	if wait := failures.LastFailure.Add(loginBackoff(failures.Failures)).Sub(now); wait > 0 {
+		return wait, false
+	}
+	return 0, false
+}
+
+// attemptDelay returns how long the failures of a key before an attempt forbid it, and whether the key must be
+// locked out now because the attempt goes beyond threshold.
+func attemptDelay(previous db.DBLoginFailures, threshold int, now time.Time) (time.Duration, bool, bool) {
+	wait, locked := loginDelay(previous, now)
+	if !locked && previous.Failures >= threshold {
+		return lockoutDuration, true, true
+	}
+	return wait, locked, false
+}
+
+// attemptLogin counts a login attempt of the username from the address before its credentials are checked, and
+// returns a LoginThrottledError if either has to wait before trying again. Each attempt sees the ones counted before
+// it, so parallel attempts don't all get through. The keys going beyond their threshold are locked out.
+func attemptLogin(session *db.DB, username string, ip string, now time.Time) error {
+	thresholds := map[string]int{userLoginKey: userLockoutThreshold, ipLoginKey: ipLockoutThreshold}
+	values := map[string]string{userLoginKey: username, ipLoginKey: ip}
+	var throttled *LoginThrottledError
+	for _, kind := range []string{userLoginKey, ipLoginKey} {
+		if values[kind] == "" {
+			continue
+		}
+		key := loginKey(kind, values[kind])
+		previous, err := session.RecordLoginAttempt(key, now, now.Add(loginFailuresWindow))
+		if err != nil {
+			return err
+		}
+		wait, locked, lock := attemptDelay(previous, thresholds[kind], now)
+		if lock {
+			if err = session.LockLogin(key, now.Add(lockoutDuration)); err != nil {
+				return err
+			}
+			audit.Record(audit.Event{
+				Action:  audit.LoginLockout,
+				Target:  key,
+				IP:      ip,
+				Details: fmt.Sprint(previous.Failures, " failed logins, locked out for ", lockoutDuration),
+			})
+		}
+		if wait > 0 && (throttled == nil || wait > throttled.RetryAfter) {
+			throttled = &LoginThrottledError{RetryAfter: wait, Locked: locked}
+		}
+	}
+	if throttled != nil {
+		return throttled
+	}
+	return nil
+}
+
+// Lockouts counts the login attempts, throttling and locking out the usernames and the addresses failing too often.
+type Lockouts interface {
+	// Attempt counts an attempt of the username from the address before its credentials are checked, and returns a
+	// LoginThrottledError if either has to wait before trying again.
+	Attempt(username string, ip string, now time.Time) error
+	// Forgive takes back the attempt of the address once its credentials are right. Its other attempts are kept,
+	// logging into an account of its own mustn't let it try more.
+	Forgive(ip string)
+	// Succeed forgets the attempts of the username once it logged in, and forgives the address.
+	Succeed(username string, ip string)
+}
+
+// mongoLockouts counts the attempts in the database, shared by every instance.
+type mongoLockouts struct{}
+
+func (mongoLockouts) Attempt(username string, ip string, now time.Time) error {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return attemptLogin(session.ClientSession, username, ip, now)
+}
+
+func (mongoLockouts) Forgive(ip string) {
+	if ip == "" {
+		return
+	}
+	session, err := dbheap.GetSession()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	session.ClientSession.ForgiveLoginAttempt(loginKey(ipLoginKey, ip))
+}
+
+func (l mongoLockouts) Succeed(username string, ip string) {
+	l.Forgive(ip)
+	session, err := dbheap.GetSession()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	session.ClientSession.ClearLoginFailures(loginKey(userLoginKey, username))
+}
+
+// noLockouts never throttles.
+type noLockouts struct{}
+
+func (noLockouts) Attempt(username string, ip string, now time.Time) error { return nil }
+func (noLockouts) Forgive(ip string)                                       {}
+func (noLockouts) Succeed(username string, ip string)                      {}
+
+func (mw *Middleware) lockouts() Lockouts {
+	if mw.Lockouts != nil {
+		return mw.Lockouts
+	}
+	return noLockouts{}
+}
+
+// AttemptCredentials counts an attempt of a logged in user to prove itself again, with its password or its second
+// factor, as a login attempt before the credentials are checked. It returns a LoginThrottledError if the user or the
+// address has to wait, auditing the refusal like a failed login.
+func (mw *Middleware) AttemptCredentials(userID string, c *gin.Context) error {
+	ip := commons.ClientIP(c.Request)
+	err := mw.lockouts().Attempt(userID, ip, mw.now())
+	if err != nil {
+		auditLogin(audit.LoginFailure, userID, ip, err.Error())
+	}
+	return err
+}
+
+// CredentialsSucceeded forgets the attempts of a user whose credentials were right.
+func (mw *Middleware) CredentialsSucceeded(userID string, c *gin.Context) {
+	mw.lockouts().Succeed(userID, commons.ClientIP(c.Request))
+}
+
+// ApiLockout is a username or an address locked out of logging in.
+type ApiLockout struct {
+	Kind        string    `json:"kind"`
+	Value       string    `json:"value"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+// LockoutsHandler lists the usernames and the addresses currently locked out.
+func LockoutsHandler(c *gin.Context) {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"code": http.StatusServiceUnavailable, "message": "The database is not available"})
+		return
+	}
+	defer session.Close()
+	var locked []db.DBLoginFailures
+	if err = session.ClientSession.GetLockedLogins(time.Now(), &locked); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": http.StatusInternalServerError, "message": "Unable to read the lockouts"})
+		return
+	}
+	lockouts := make([]ApiLockout, 0, len(locked))
+	for _, l := range locked {
+		parts := strings.SplitN(l.Key, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		lockouts = append(lockouts, ApiLockout{Kind: parts[0], Value: parts[1], Failures: l.Failures, LastFailure: l.LastFailure, LockedUntil: l.LockedUntil})
+	}
+	c.JSON(http.StatusOK, lockouts)
+}
+
+// UnlockHandler forgets the failed logins of a username or an address, given by the "kind" (user or ip) and
+// "value" route parameters, lifting its lockout.
+func UnlockHandler(c *gin.Context) {
+	kind, value := c.Param("kind"), c.Param("value")
+	if (kind != userLoginKey && kind != ipLoginKey) || value == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "message": "Only a user or an ip can be unlocked"})
+		return
+	}
+	session, err := dbheap.GetSession()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"code": http.StatusServiceUnavailable, "message": "The database is not available"})
+		return
+	}
+	defer session.Close()
+	key := loginKey(kind, value)
+	err = session.ClientSession.ClearLoginFailures(key)
+	if err == mgo.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"code": http.StatusNotFound, "message": "No failed logins for " + key})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": http.StatusInternalServerError, "message": "Unable to unlock " + key})
+		return
+	}
+	userID, _ := ExtractClaims(c)["id"].(string)
+	audit.Record(audit.Event{Action: audit.LoginUnlock, Actor: userID, Target: key, IP: commons.ClientIP(c.Request)})
+	log.Println("Unlocked ", key)
+	c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "message": "Unlocked " + key})
+}
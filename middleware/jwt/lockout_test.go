@@ -0,0 +1,128 @@
+package jwt
+
+import (
+	"local/gintest/services/db"
+	"local/gintest/services/totp"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{
+		0:                      0,
+		freeLoginAttempts - 1:  0,
+		freeLoginAttempts:      loginBackoffBase,
+		freeLoginAttempts + 2:  4 * loginBackoffBase,
+		freeLoginAttempts + 30: loginBackoffMax,
+	} {
+		if backoff := loginBackoff(failures); backoff != expected {
+			t.Errorf("Backoff after %d failures is %v, expected %v", failures, backoff, expected)
+		}
+	}
+}
+
+func TestLoginDelay(t *testing.T) {
+	now := time.Now()
+	failures := db.DBLoginFailures{Failures: freeLoginAttempts + 1, LastFailure: now.Add(-time.Second)}
+	if wait, locked := loginDelay(failures, now); wait != time.Second || locked {
+		t.Error("Wrong backoff: ", wait, locked)
+	}
+	failures.LastFailure = now.Add(-time.Minute)
+	if wait, _ := loginDelay(failures, now); wait != 0 {
+		t.Error("Still waiting after the backoff: ", wait)
+	}
+	failures.LockedUntil = now.Add(time.Minute)
+	if wait, locked := loginDelay(failures, now); wait != time.Minute || !locked {
+		t.Error("Wrong lockout: ", wait, locked)
+	}
+}
+
+func TestAttemptDelay(t *testing.T) {
+	now := time.Now()
+	// A burst of attempts at once, each seeing the ones counted before it
+	allowed := 0
+	for failures := 0; failures < userLockoutThreshold; failures++ {
+		wait, locked, lock := attemptDelay(db.DBLoginFailures{Failures: failures, LastFailure: now}, userLockoutThreshold, now)
+		if wait == 0 {
+			allowed++
+		}
+		if locked || lock {
+			t.Error("Locked out after ", failures, " failures")
+		}
+	}
+	if allowed != freeLoginAttempts {
+		t.Errorf("%d attempts of a burst got through, expected %d", allowed, freeLoginAttempts)
+	}
+	if wait, locked, lock := attemptDelay(db.DBLoginFailures{Failures: userLockoutThreshold, LastFailure: now}, userLockoutThreshold, now); wait != lockoutDuration || !locked || !lock {
+		t.Error("Not locked out beyond the threshold: ", wait, locked, lock)
+	}
+	// A key already locked out isn't locked again
+	failures := db.DBLoginFailures{Failures: userLockoutThreshold + 1, LastFailure: now, LockedUntil: now.Add(time.Minute)}
+	if wait, locked, lock := attemptDelay(failures, userLockoutThreshold, now); wait != time.Minute || !locked || lock {
+		t.Error("Wrong lockout: ", wait, locked, lock)
+	}
+}
+
+// memoryLockouts refuses the attempts beyond the allowed ones, and remembers the calls.
+type memoryLockouts struct {
+	allowed int
+	calls   []string
+}
+
+func (m *memoryLockouts) Attempt(username string, ip string, now time.Time) error {
+	m.calls = append(m.calls, "attempt "+username)
+	if m.allowed == 0 {
+		return &LoginThrottledError{RetryAfter: time.Minute}
+	}
+	m.allowed--
+	return nil
+}
+
+func (m *memoryLockouts) Forgive(ip string) {
+	m.calls = append(m.calls, "forgive")
+}
+
+func (m *memoryLockouts) Succeed(username string, ip string) {
+	m.calls = append(m.calls, "succeed "+username)
+}
+
+func TestLoginLockouts(t *testing.T) {
+	mw, secret := mfaMiddleware(t, "abcde-fghij")
+	lockouts := &memoryLockouts{allowed: 3}
+	mw.Lockouts = lockouts
+	authenticated := 0
+	authenticator := mw.Authenticator
+	mw.Authenticator = func(userID string, password string, c *gin.Context) (string, error) {
+		authenticated++
+		return authenticator(userID, password, c)
+	}
+
+	if status, answer := post(mw.LoginHandler, Login{Username: "bob", Password: "password"}); status != http.StatusOK || answer["token"] == nil {
+		t.Fatal("The login was refused: ", status, answer)
+	}
+	// The attempts of alice are kept until she answers the challenge
+	challenge := logInWithChallenge(t, mw)
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, answer := post(mw.ChallengeHandler, ChallengeAnswer{Challenge: challenge, Code: code}); status != http.StatusOK || answer["token"] == nil {
+		t.Fatal("The code was refused: ", status, answer)
+	}
+	expected := []string{"attempt bob", "succeed bob", "attempt alice", "forgive", "attempt alice", "succeed alice"}
+	if strings.Join(lockouts.calls, ", ") != strings.Join(expected, ", ") {
+		t.Error("Wrong lockouts calls: ", lockouts.calls)
+	}
+
+	// A throttled attempt doesn't get to the password
+	if status, answer := post(mw.LoginHandler, Login{Username: "bob", Password: "password"}); status != http.StatusTooManyRequests || answer["token"] != nil {
+		t.Error("A throttled login wasn't refused: ", status, answer)
+	}
+	if authenticated != 2 {
+		t.Error("The password was checked ", authenticated, " times, expected 2")
+	}
+}
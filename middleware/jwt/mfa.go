@@ -0,0 +1,245 @@
+package jwt
+
+import (
+	"errors"
+	"local/gintest/commons"
+	"local/gintest/services/audit"
+	"local/gintest/services/db"
+	"local/gintest/services/dbheap"
+	"local/gintest/services/rbac"
+	"local/gintest/services/totp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	jwtgo "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+const (
+	// How long the second factor may be awaited after the password, and how many codes may be tried meanwhile
+	mfaChallengeTimeout = 5 * time.Minute
+	maxMFAAttempts      = 5
+
+	// The claim of the tokens of the users who must enroll a second factor before doing anything else
+	mfaEnrollmentClaim = "mfa_enrollment"
+)
+
+var (
+	ErrInvalidChallenge       = errors.New("The login expired, log in again")
+	ErrFailedSecondFactor     = errors.New("Incorrect code")
+	ErrMFAEnrollmentRequired  = errors.New("A second factor must be enrolled first")
+	ErrMissingChallengeValues = errors.New("Missing challenge or code")
+)
+
+// The routes a user who must enroll a second factor can use until it's done.
+var enrollmentRoutes = map[string]bool{
+	"GET /auth/mfa":           true,
+	"POST /auth/mfa/enroll":   true,
+	"POST /auth/mfa/confirm":  true,
+	"GET /auth/refresh_token": true,
+	"POST /auth/logout":       true,
+	"POST /auth/logout_all":   true,
+	"GET /auth/hello":         true,
+}
+
+// ChallengeAnswer is the body of the second step of the logins needing a second factor.
+type ChallengeAnswer struct {
+	Challenge string `form:"challenge" json:"challenge" binding:"required"`
+	Code      string `form:"code" json:"code" binding:"required"`
+}
+
+// MFAEnrolled tells whether the user logs in with a second factor.
+func MFAEnrolled(user db.DBUser) bool {
+	return user.TOTP != nil && user.TOTP.Confirmed
+}
+
+// MFARequired tells whether roles must log in with a second factor, when it's enforced for the given roles. A role
+// being enforced, the higher ones are too.
+func MFARequired(roles []string, enforced []string) bool {
+	for _, role := range enforced {
+		if rbac.Has(roles, rbac.Role(role)) {
+			return true
+		}
+	}
+	return false
+}
+
+// mfaEnrollmentPending tells whether the user must enroll a second factor before its tokens grant anything.
+func mfaEnrollmentPending(session *db.DB, user db.DBUser) (bool, error) {
+	if MFAEnrolled(user) {
+		return false, nil
+	}
+	var settings db.DBMFASettings
+	if err := session.GetMFASettings(&settings); err != nil {
+		return false, err
+	}
+	return MFARequired(rbac.UserRoles(user.Roles), settings.Roles), nil
+}
+
+func claimsMFAEnrollment(claims jwtgo.MapClaims) bool {
+	pending, _ := claims[mfaEnrollmentClaim].(bool)
+	return pending
+}
+
+// SecondFactors keeps the second factors of the users and the challenges of the logins awaiting them.
+type SecondFactors interface {
+	// User returns the user, with its second factor if it has one.
+	User(userID string) (db.DBUser, error)
+
+	// StartChallenge saves a new challenge.
+	StartChallenge(challenge db.DBMFAChallenge) error
+	// AttemptChallenge counts an answer to a challenge and returns it, or ErrInvalidChallenge if it expired or was
+	// answered maxAttempts times already.
+	AttemptChallenge(challengeID string, maxAttempts int, now time.Time) (db.DBMFAChallenge, error)
+	// EndChallenge ends an answered challenge. Only the first of concurrent calls succeeds, the others get
+	// ErrInvalidChallenge.
+	EndChallenge(challengeID string) error
+
+	// UseTOTPStep accepts a code of the user for step, or returns ErrFailedSecondFactor if a code of the step or a
+	// later one was accepted already.
+	UseTOTPStep(userID string, step int64) error
+	// UseRecoveryCode consumes the recovery code of the user with the given hash, or returns ErrFailedSecondFactor if
+	// the user has no such code left.
+	UseRecoveryCode(userID string, hashedCode string) error
+}
+
+// mongoSecondFactors keeps the second factors with the users in the database, and the challenges next to them.
+type mongoSecondFactors struct{}
+
+func (mongoSecondFactors) User(userID string) (db.DBUser, error) {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		return db.DBUser{}, err
+	}
+	defer session.Close()
+	user := db.DBUser{}
+	err = session.ClientSession.GetUser(userID, &user)
+	return user, err
+}
+
+func (mongoSecondFactors) StartChallenge(challenge db.DBMFAChallenge) error {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return session.ClientSession.InsertMFAChallenge(challenge)
+}
+
+func (mongoSecondFactors) AttemptChallenge(challengeID string, maxAttempts int, now time.Time) (db.DBMFAChallenge, error) {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		return db.DBMFAChallenge{}, err
+	}
+	defer session.Close()
+	challenge, err := session.ClientSession.AttemptMFAChallenge(challengeID, maxAttempts, now)
+	if err == mgo.ErrNotFound {
+		return challenge, ErrInvalidChallenge
+	}
+	return challenge, err
+}
+
+func (mongoSecondFactors) EndChallenge(challengeID string) error {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	if err = session.ClientSession.DeleteMFAChallenge(challengeID); err == mgo.ErrNotFound {
+		return ErrInvalidChallenge
+	}
+	return err
+}
+
+func (mongoSecondFactors) UseTOTPStep(userID string, step int64) error {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	if err = session.ClientSession.UseTOTPStep(userID, step); err == mgo.ErrNotFound {
+		return ErrFailedSecondFactor
+	}
+	return err
+}
+
+func (mongoSecondFactors) UseRecoveryCode(userID string, hashedCode string) error {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	if err = session.ClientSession.UseRecoveryCode(userID, hashedCode); err == mgo.ErrNotFound {
+		return ErrFailedSecondFactor
+	}
+	return err
+}
+
+// SecondFactorChallenge returns a challenge the user must answer with ChallengeHandler before getting a token, or
+// "" if the first factor is enough. Every login of the user, whatever its first factor, must go through it.
+func (mw *Middleware) SecondFactorChallenge(userID string, c *gin.Context) (string, time.Time, error) {
+	if mw.SecondFactors == nil {
+		return "", time.Time{}, nil
+	}
+	user, err := mw.SecondFactors.User(userID)
+	if err != nil || !MFAEnrolled(user) {
+		return "", time.Time{}, err
+	}
+	challenge := db.DBMFAChallenge{
+		ChallengeID: newSessionID(),
+		UserID:      userID,
+		ExpiresAt:   mw.now().Add(mfaChallengeTimeout),
+	}
+	if err = mw.SecondFactors.StartChallenge(challenge); err != nil {
+		return "", time.Time{}, err
+	}
+	return challenge.ChallengeID, challenge.ExpiresAt, nil
+}
+
+// verifySecondFactor checks the answer to a challenge, a TOTP code or a recovery code, and returns the user of the
+// challenge. Every code counts as a login attempt until it's right, so the lockouts stop them being guessed over
+// several challenges.
+func (mw *Middleware) verifySecondFactor(challengeID string, code string, c *gin.Context) (string, error) {
+	ip, now := commons.ClientIP(c.Request), mw.now()
+	challenge, err := mw.SecondFactors.AttemptChallenge(challengeID, maxMFAAttempts, now)
+	if err != nil {
+		return "", err
+	}
+	userID := challenge.UserID
+	if err = mw.lockouts().Attempt(userID, ip, now); err != nil {
+		auditLogin(audit.LoginFailure, userID, ip, err.Error())
+		return userID, err
+	}
+	user, err := mw.SecondFactors.User(userID)
+	if err != nil || !MFAEnrolled(user) {
+		return userID, ErrInvalidChallenge
+	}
+	if user.Disabled {
+		auditLogin(audit.LoginFailure, userID, ip, ErrDisabledUser.Error())
+		return userID, ErrDisabledUser
+	}
+
+	method := "totp"
+	if step, ok := totp.Verify(user.TOTP.Secret, code, now, user.TOTP.LastStep); ok {
+		// Another login may have used the code meanwhile
+		err = mw.SecondFactors.UseTOTPStep(userID, step)
+	} else {
+		method = "recovery code"
+		err = mw.SecondFactors.UseRecoveryCode(userID, totp.HashRecoveryCode(code))
+	}
+	if err == ErrFailedSecondFactor {
+		auditLogin(audit.LoginFailure, userID, ip, "Wrong second factor")
+		return userID, err
+	}
+	if err != nil {
+		return userID, err
+	}
+
+	// A challenge logs in once, even when answered twice at the same time
+	if err = mw.SecondFactors.EndChallenge(challengeID); err != nil {
+		return userID, ErrInvalidChallenge
+	}
+	mw.lockouts().Succeed(userID, ip)
+	auditLogin(audit.LoginSuccess, userID, ip, method)
+	return userID, nil
+}
@@ -0,0 +1,242 @@
+package jwt
+
+import (
+	"encoding/json"
+	"errors"
+	"local/gintest/services/db"
+	"local/gintest/services/totp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwtgo "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+func TestMFARequired(t *testing.T) {
+	tests := []struct {
+		roles    []string
+		enforced []string
+		required bool
+	}{
+		{[]string{"viewer"}, nil, false},
+		{[]string{"viewer"}, []string{"operator"}, false},
+		{[]string{"operator"}, []string{"operator"}, true},
+		// The higher roles are enforced too
+		{[]string{"viewer", "admin"}, []string{"engineer"}, true},
+		{[]string{"engineer"}, []string{"admin", "viewer"}, true},
+	}
+	for _, test := range tests {
+		if MFARequired(test.roles, test.enforced) != test.required {
+			t.Error("Wrong requirement of ", test.roles, " when ", test.enforced, " are enforced")
+		}
+	}
+}
+
+func TestMFAEnrolled(t *testing.T) {
+	if MFAEnrolled(db.DBUser{}) {
+		t.Error("A user without a second factor is enrolled")
+	}
+	if MFAEnrolled(db.DBUser{TOTP: &db.DBTOTP{Secret: "ABCDEF"}}) {
+		t.Error("A user who didn't confirm its second factor is enrolled")
+	}
+	if !MFAEnrolled(db.DBUser{TOTP: &db.DBTOTP{Secret: "ABCDEF", Confirmed: true}}) {
+		t.Error("A user who confirmed its second factor isn't enrolled")
+	}
+}
+
+func TestClaimsMFAEnrollment(t *testing.T) {
+	if claimsMFAEnrollment(jwtgo.MapClaims{"id": "alice"}) {
+		t.Error("A token without the claim requires an enrollment")
+	}
+	if !claimsMFAEnrollment(jwtgo.MapClaims{"id": "alice", mfaEnrollmentClaim: true}) {
+		t.Error("A token with the claim doesn't require an enrollment")
+	}
+	// The refresh and the enrollment itself must stay reachable
+	for _, route := range []string{"POST /auth/mfa/enroll", "POST /auth/mfa/confirm", "GET /auth/refresh_token"} {
+		if !enrollmentRoutes[route] {
+			t.Error("The route ", route, " is refused until the enrollment")
+		}
+	}
+}
+
+func TestPayloadFailure(t *testing.T) {
+	unreadable := errors.New("The database is not available")
+	mw := &Middleware{PayloadFunc: func(string) (map[string]interface{}, error) { return nil, unreadable }}
+	if token, _, err := mw.TokenGenerator("user"); err != unreadable || token != "" {
+		t.Error("Issued a token without knowing whether the user must enroll a second factor: ", token, err)
+	}
+}
+
+// memorySecondFactors keeps the users and the challenges like the database does.
+type memorySecondFactors struct {
+	users      map[string]*db.DBUser
+	challenges map[string]*db.DBMFAChallenge
+}
+
+func (m *memorySecondFactors) User(userID string) (db.DBUser, error) {
+	user, ok := m.users[userID]
+	if !ok {
+		return db.DBUser{}, errors.New("not found")
+	}
+	return *user, nil
+}
+
+func (m *memorySecondFactors) StartChallenge(challenge db.DBMFAChallenge) error {
+	m.challenges[challenge.ChallengeID] = &challenge
+	return nil
+}
+
+func (m *memorySecondFactors) AttemptChallenge(challengeID string, maxAttempts int, now time.Time) (db.DBMFAChallenge, error) {
+	challenge, ok := m.challenges[challengeID]
+	if !ok || challenge.Attempts >= maxAttempts || !challenge.ExpiresAt.After(now) {
+		return db.DBMFAChallenge{}, ErrInvalidChallenge
+	}
+	challenge.Attempts++
+	return *challenge, nil
+}
+
+func (m *memorySecondFactors) EndChallenge(challengeID string) error {
+	if _, ok := m.challenges[challengeID]; !ok {
+		return ErrInvalidChallenge
+	}
+	delete(m.challenges, challengeID)
+	return nil
+}
+
+func (m *memorySecondFactors) UseTOTPStep(userID string, step int64) error {
+	user, ok := m.users[userID]
+	if !ok || !MFAEnrolled(*user) || user.TOTP.LastStep >= step {
+		return ErrFailedSecondFactor
+	}
+	user.TOTP.LastStep = step
+	return nil
+}
+
+func (m *memorySecondFactors) UseRecoveryCode(userID string, hashedCode string) error {
+	user, ok := m.users[userID]
+	if !ok || !MFAEnrolled(*user) {
+		return ErrFailedSecondFactor
+	}
+	for i, code := range user.TOTP.RecoveryCodes {
+		if code == hashedCode {
+			user.TOTP.RecoveryCodes = append(user.TOTP.RecoveryCodes[:i], user.TOTP.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrFailedSecondFactor
+}
+
+// mfaMiddleware logs in any user with any password, alice having a second factor with the given recovery code.
+func mfaMiddleware(t *testing.T, recoveryCode string) (*Middleware, string) {
+	secret, err := totp.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeySet(NewHMACKey([]byte("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &db.DBUser{Username: "alice", TOTP: &db.DBTOTP{Secret: secret, Confirmed: true, RecoveryCodes: []string{totp.HashRecoveryCode(recoveryCode)}}}
+	return &Middleware{
+		Timeout:       time.Hour,
+		MaxRefresh:    time.Hour,
+		Keys:          keys,
+		Authenticator: func(userID string, password string, c *gin.Context) (string, error) { return userID, nil },
+		SecondFactors: &memorySecondFactors{
+			users:      map[string]*db.DBUser{"alice": alice, "bob": {Username: "bob"}},
+			challenges: map[string]*db.DBMFAChallenge{},
+		},
+	}, secret
+}
+
+// post sends body to handler, returning the status and the answer.
+func post(handler gin.HandlerFunc, body interface{}) (int, map[string]interface{}) {
+	engine := gin.New()
+	engine.POST("/", handler)
+	data, _ := json.Marshal(body)
+	request := httptest.NewRequest("POST", "/", strings.NewReader(string(data)))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, request)
+	var answer map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &answer)
+	return recorder.Code, answer
+}
+
+// logInWithChallenge logs alice in and returns the challenge of her second factor.
+func logInWithChallenge(t *testing.T, mw *Middleware) string {
+	status, answer := post(mw.LoginHandler, Login{Username: "alice", Password: "password"})
+	challenge, _ := answer["challenge"].(string)
+	if status != http.StatusOK || challenge == "" || answer["token"] != nil {
+		t.Fatal("No challenge for a user with a second factor: ", status, answer)
+	}
+	return challenge
+}
+
+func TestLoginChallenge(t *testing.T) {
+	mw, _ := mfaMiddleware(t, "abcde-fghij")
+	logInWithChallenge(t, mw)
+	if status, answer := post(mw.LoginHandler, Login{Username: "bob", Password: "password"}); status != http.StatusOK || answer["token"] == nil || answer["challenge"] != nil {
+		t.Error("A user without a second factor didn't get a token: ", status, answer)
+	}
+}
+
+func TestChallengeHandler(t *testing.T) {
+	mw, secret := mfaMiddleware(t, "abcde-fghij")
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := logInWithChallenge(t, mw)
+	if status, answer := post(mw.ChallengeHandler, ChallengeAnswer{Challenge: challenge, Code: "wrong"}); status != http.StatusUnauthorized || answer["message"] != ErrFailedSecondFactor.Error() {
+		t.Error("A wrong code was accepted: ", status, answer)
+	}
+	if status, answer := post(mw.ChallengeHandler, ChallengeAnswer{Challenge: challenge, Code: code}); status != http.StatusOK || answer["token"] == nil {
+		t.Fatal("The code was refused: ", status, answer)
+	}
+	// A challenge logs in once
+	if status, answer := post(mw.ChallengeHandler, ChallengeAnswer{Challenge: challenge, Code: code}); status != http.StatusUnauthorized || answer["message"] != ErrInvalidChallenge.Error() {
+		t.Error("A challenge logged in twice: ", status, answer)
+	}
+	// And a code too
+	if status, answer := post(mw.ChallengeHandler, ChallengeAnswer{Challenge: logInWithChallenge(t, mw), Code: code}); status != http.StatusUnauthorized {
+		t.Error("A code logged in twice: ", status, answer)
+	}
+
+	challenge = logInWithChallenge(t, mw)
+	for i := 0; i < maxMFAAttempts; i++ {
+		post(mw.ChallengeHandler, ChallengeAnswer{Challenge: challenge, Code: "wrong"})
+	}
+	code, _ = totp.Code(secret, totp.Step(time.Now())+1)
+	if status, answer := post(mw.ChallengeHandler, ChallengeAnswer{Challenge: challenge, Code: code}); status != http.StatusUnauthorized || answer["message"] != ErrInvalidChallenge.Error() {
+		t.Error("A challenge was answered after too many attempts: ", status, answer)
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+	mw, _ := mfaMiddleware(t, "abcde-fghij")
+	if status, answer := post(mw.ChallengeHandler, ChallengeAnswer{Challenge: logInWithChallenge(t, mw), Code: "ABCDE FGHIJ"}); status != http.StatusOK || answer["token"] == nil {
+		t.Fatal("The recovery code was refused: ", status, answer)
+	}
+	if status, answer := post(mw.ChallengeHandler, ChallengeAnswer{Challenge: logInWithChallenge(t, mw), Code: "abcde-fghij"}); status != http.StatusUnauthorized || answer["message"] != ErrFailedSecondFactor.Error() {
+		t.Error("A recovery code was used twice: ", status, answer)
+	}
+}
+
+func TestMFAEnrollmentRoutes(t *testing.T) {
+	claims := jwtgo.MapClaims{"id": "alice", "roles": []interface{}{"admin"}, mfaEnrollmentClaim: true}
+	if err := authorize(claims, "POST", "/auth/mfa/enroll", "/auth/mfa/enroll"); err != nil {
+		t.Error("The enrollment was refused: ", err)
+	}
+	if err := authorize(claims, "GET", "/auth/stats", "/auth/stats"); err != ErrMFAEnrollmentRequired {
+		t.Error("A user who must enroll a second factor got to another route: ", err)
+	}
+	delete(claims, mfaEnrollmentClaim)
+	if err := authorize(claims, "GET", "/auth/stats", "/auth/stats"); err != nil {
+		t.Error("An enrolled user was refused: ", err)
+	}
+}
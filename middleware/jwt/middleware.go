@@ -0,0 +1,472 @@
+package jwt
+
+import (
+	"errors"
+	"local/gintest/commons"
+	"local/gintest/services/audit"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwtgo "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+// The keys of the gin context holding the claims and the user of an authorized request.
+const (
+	payloadKey  = "JWT_PAYLOAD"
+	identityKey = "userID"
+)
+
+var (
+	ErrMissingLoginValues   = errors.New("Missing username or password")
+	ErrFailedAuthentication = errors.New("Incorrect username or password")
+	ErrEmptyToken           = errors.New("The authorization token is empty")
+	ErrInvalidAuthHeader    = errors.New("The authorization header is invalid")
+	ErrExpiredToken         = errors.New("The token is expired")
+	ErrMissingExpiration    = errors.New("The token has no expiration")
+	ErrMissingIdentity      = errors.New("The token has no user id")
+	ErrRefreshExpired       = errors.New("The token can no longer be refreshed")
+	ErrForbidden            = errors.New("You don't have permission to access this resource")
+	ErrDisabledUser         = errors.New("The user is disabled")
+)
+
+// Login is the body of the login requests.
+type Login struct {
+	Username string `form:"username" json:"username" binding:"required"`
+	Password string `form:"password" json:"password" binding:"required"`
+}
+
+// Middleware issues tokens signed with the loaded keys and authorizes the requests carrying them. It answers like
+// gin-jwt did, so the clients didn't have to change.
+type Middleware struct {
+	Realm string
+
+	// How long the tokens are valid, and for how long after their first issue they can be refreshed
+	Timeout    time.Duration
+	MaxRefresh time.Duration
+
+	// Authenticator returns the user of the credentials, or why they're refused
+	Authenticator func(userID string, password string, c *gin.Context) (string, error)
+	// The second factors of the users and the challenges of the logins awaiting them, the password is enough if nil
+	SecondFactors SecondFactors
+	// Counts the failed second factors to throttle them, none are if nil
+	Lockouts Lockouts
+	// Authorizator returns why the user can't use the route, or nil if it can
+	Authorizator func(userID string, c *gin.Context) error
+
+	// Extra claims of the tokens of a user. No token is issued when it fails
+	PayloadFunc func(userID string) (map[string]interface{}, error)
+
+	Unauthorized func(c *gin.Context, code int, message string)
+
+	// Where the token is looked for: "header:<name>", "query:<name>" or "cookie:<name>"
+	TokenLookup   string
+	TokenHeadName string
+
+	TimeFunc func() time.Time
+
+	// The keys signing and verifying the tokens, the loaded ones if nil
+	Keys *KeySet
+
+	// The revoked sessions, none are if nil
+	Revocations Revocations
+
+	// The single use tickets standing for tokens, none are issued if nil
+	Tickets Tickets
+
+	// Checks the API keys sent instead of tokens, which are refused if nil
+	ApiKeys func(apiKey string) (jwtgo.MapClaims, error)
+
+	// Called once sessions are revoked by a logout, to close what they opened. sessionID is empty when every session
+	// of the user started up to before was revoked.
+	OnRevoke func(userID string, sessionID string, before time.Time)
+}
+
+func (mw *Middleware) keys() *KeySet {
+	if mw.Keys != nil {
+		return mw.Keys
+	}
+	return keySet
+}
+
+func (mw *Middleware) now() time.Time {
+	if mw.TimeFunc != nil {
+		return mw.TimeFunc()
+	}
+	return time.Now()
+}
+
+func (mw *Middleware) unauthorized(c *gin.Context, code int, message string) {
+	c.Header("WWW-Authenticate", `JWT realm="`+mw.Realm+`"`)
+	if mw.Unauthorized != nil {
+		mw.Unauthorized(c, code, message)
+	} else {
+		c.JSON(code, gin.H{"code": code, "message": message})
+	}
+	c.Abort()
+}
+
+// tokenString reads the token of a request from where TokenLookup says.
+func (mw *Middleware) tokenString(c *gin.Context) (string, error) {
+	lookup := strings.SplitN(strings.TrimSpace(mw.TokenLookup), ":", 2)
+	if len(lookup) != 2 {
+		lookup = []string{"header", "Authorization"}
+	}
+	var token string
+	switch strings.TrimSpace(lookup[0]) {
+	case "query":
+		token = c.Query(strings.TrimSpace(lookup[1]))
+	case "cookie":
+		token, _ = c.Cookie(strings.TrimSpace(lookup[1]))
+	default:
+		header := c.GetHeader(strings.TrimSpace(lookup[1]))
+		if header == "" {
+			return "", ErrEmptyToken
+		}
+		parts := strings.SplitN(header, " ", 2)
+		if len(parts) != 2 || parts[0] != mw.TokenHeadName {
+			return "", ErrInvalidAuthHeader
+		}
+		token = parts[1]
+	}
+	if token == "" {
+		return "", ErrEmptyToken
+	}
+	return token, nil
+}
+
+// parse checks the signature of a token and returns its claims, without checking its expiration.
+func (mw *Middleware) parse(tokenString string) (jwtgo.MapClaims, error) {
+	parser := jwtgo.Parser{SkipClaimsValidation: true}
+	token, err := parser.ParseWithClaims(tokenString, jwtgo.MapClaims{}, mw.keys().Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	claims := token.Claims.(jwtgo.MapClaims)
+	if _, ok := claims["id"].(string); !ok {
+		return nil, ErrMissingIdentity
+	}
+	if _, ok := claims["exp"].(float64); !ok {
+		return nil, ErrMissingExpiration
+	}
+	return claims, nil
+}
+
+// ValidateToken checks the signature and the expiration of a token, and returns its claims.
+func (mw *Middleware) ValidateToken(tokenString string) (jwtgo.MapClaims, error) {
+	claims, err := mw.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if !claimsExpiration(claims).After(mw.now()) {
+		return nil, ErrExpiredToken
+	}
+	if err = mw.checkRevoked(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkRevoked returns ErrRevokedToken if the session of the claims was revoked, or the error checking it.
+func (mw *Middleware) checkRevoked(claims jwtgo.MapClaims) error {
+	if mw.Revocations == nil {
+		return nil
+	}
+	revoked, err := mw.Revocations.Revoked(claims["id"].(string), claimsSessionID(claims), claimsSessionStart(claims))
+	if err != nil {
+		return errors.New("Unable to check the token revocation")
+	}
+	if revoked {
+		return ErrRevokedToken
+	}
+	return nil
+}
+
+// MiddlewareFunc authorizes the requests with a valid token, or a valid API key if ApiKeys is set, making the
+// claims and the user available to the handlers.
+func (mw *Middleware) MiddlewareFunc() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString, err := mw.tokenString(c)
+		if err != nil {
+			mw.unauthorized(c, http.StatusUnauthorized, err.Error())
+			return
+		}
+		var claims jwtgo.MapClaims
+		if IsApiKey(tokenString) && mw.ApiKeys != nil {
+			claims, err = mw.ApiKeys(tokenString)
+		} else {
+			claims, err = mw.ValidateToken(tokenString)
+		}
+		if err != nil {
+			mw.unauthorized(c, http.StatusUnauthorized, err.Error())
+			return
+		}
+		userID := claims["id"].(string)
+		c.Set(payloadKey, claims)
+		c.Set(identityKey, userID)
+		if mw.Authorizator != nil {
+			if err := mw.Authorizator(userID, c); err != nil {
+				mw.unauthorized(c, http.StatusForbidden, ErrForbidden.Error()+": "+err.Error())
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// TokenGenerator issues a token for a user, returning it with its expiration.
+func (mw *Middleware) TokenGenerator(userID string) (string, time.Time, error) {
+	return mw.generate(userID, newSessionID(), mw.now())
+}
+
+func (mw *Middleware) generate(userID string, sessionID string, origIat time.Time) (string, time.Time, error) {
+	claims := jwtgo.MapClaims{}
+	if mw.PayloadFunc != nil {
+		payload, err := mw.PayloadFunc(userID)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		for key, value := range payload {
+			claims[key] = value
+		}
+	}
+	now := mw.now()
+	expire := now.Add(mw.Timeout)
+	claims["id"] = userID
+	claims["iat"] = now.Unix()
+	claims["exp"] = expire.Unix()
+	claims["orig_iat"] = origIat.Unix()
+	claims["sid"] = sessionID
+	token, err := mw.keys().Sign(claims)
+	return token, expire, err
+}
+
+func tokenResponse(c *gin.Context, token string, expire time.Time) {
+	c.JSON(http.StatusOK, gin.H{
+		"code":   http.StatusOK,
+		"token":  token,
+		"expire": expire.Format(time.RFC3339),
+	})
+}
+
+// LoginHandler checks the credentials of a user with the Authenticator and answers with a new token.
+func (mw *Middleware) LoginHandler(c *gin.Context) {
+	var login Login
+	if err := c.ShouldBind(&login); err != nil {
+		mw.unauthorized(c, http.StatusBadRequest, ErrMissingLoginValues.Error())
+		return
+	}
+	if mw.Authenticator == nil {
+		mw.unauthorized(c, http.StatusInternalServerError, "No authenticator configured")
+		return
+	}
+	// Counted before the password is checked, so that parallel guesses don't all get through
+	ip, userID := commons.ClientIP(c.Request), ""
+	err := mw.lockouts().Attempt(login.Username, ip, mw.now())
+	if err == nil {
+		userID, err = mw.Authenticator(login.Username, login.Password, c)
+	} else {
+		auditLogin(audit.LoginFailure, login.Username, ip, err.Error())
+	}
+	if throttled, ok := err.(*LoginThrottledError); ok {
+		c.Header("Retry-After", throttled.RetryAfterHeader())
+		mw.unauthorized(c, http.StatusTooManyRequests, throttled.Error())
+		return
+	}
+	if err == ErrDisabledUser {
+		mw.unauthorized(c, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		// Whatever the reason, don't tell whether the user exists
+		mw.unauthorized(c, http.StatusUnauthorized, ErrFailedAuthentication.Error())
+		return
+	}
+	challenge, expire, err := mw.SecondFactorChallenge(userID, c)
+	if err != nil {
+		mw.unauthorized(c, http.StatusInternalServerError, "Unable to start the second factor check")
+		return
+	}
+	if challenge != "" {
+		// The attempts of the user are kept until the second factor is checked, so the codes can't be guessed
+		mw.lockouts().Forgive(ip)
+		c.JSON(http.StatusOK, gin.H{
+			"code":      http.StatusOK,
+			"message":   "The code of the second factor is required",
+			"challenge": challenge,
+			"expire":    expire.Format(time.RFC3339),
+		})
+		return
+	}
+	mw.lockouts().Succeed(userID, ip)
+	mw.issueToken(c, userID)
+}
+
+func (mw *Middleware) issueToken(c *gin.Context, userID string) {
+	token, expire, err := mw.TokenGenerator(userID)
+	if err != nil {
+		mw.unauthorized(c, http.StatusInternalServerError, "Unable to issue the token")
+		return
+	}
+	tokenResponse(c, token, expire)
+}
+
+// ChallengeHandler is the second step of the logins needing a second factor: it checks the code answering the
+// challenge LoginHandler returned and answers with a new token.
+func (mw *Middleware) ChallengeHandler(c *gin.Context) {
+	var answer ChallengeAnswer
+	if err := c.ShouldBind(&answer); err != nil {
+		mw.unauthorized(c, http.StatusBadRequest, ErrMissingChallengeValues.Error())
+		return
+	}
+	if mw.SecondFactors == nil {
+		mw.unauthorized(c, http.StatusInternalServerError, "No second factor configured")
+		return
+	}
+	userID, err := mw.verifySecondFactor(answer.Challenge, answer.Code, c)
+	if throttled, ok := err.(*LoginThrottledError); ok {
+		c.Header("Retry-After", throttled.RetryAfterHeader())
+		mw.unauthorized(c, http.StatusTooManyRequests, throttled.Error())
+		return
+	}
+	switch err {
+	case nil:
+		mw.issueToken(c, userID)
+	case ErrDisabledUser:
+		mw.unauthorized(c, http.StatusForbidden, err.Error())
+	case ErrInvalidChallenge, ErrFailedSecondFactor:
+		mw.unauthorized(c, http.StatusUnauthorized, err.Error())
+	default:
+		mw.unauthorized(c, http.StatusInternalServerError, "Unable to check the code")
+	}
+}
+
+// RefreshHandler exchanges a token, even an expired one, for a new one, as long as the first token of the session
+// was issued less than MaxRefresh ago.
+func (mw *Middleware) RefreshHandler(c *gin.Context) {
+	tokenString, err := mw.tokenString(c)
+	if err != nil {
+		mw.unauthorized(c, http.StatusUnauthorized, err.Error())
+		return
+	}
+	claims, err := mw.parse(tokenString)
+	if err != nil {
+		mw.unauthorized(c, http.StatusUnauthorized, err.Error())
+		return
+	}
+	origIat, _ := claims["orig_iat"].(float64)
+	if time.Unix(int64(origIat), 0).Add(mw.MaxRefresh).Before(mw.now()) {
+		mw.unauthorized(c, http.StatusUnauthorized, ErrRefreshExpired.Error())
+		return
+	}
+	if err = mw.checkRevoked(claims); err != nil {
+		mw.unauthorized(c, http.StatusUnauthorized, err.Error())
+		return
+	}
+	sessionID := claimsSessionID(claims)
+	if sessionID == "" {
+		sessionID = newSessionID()
+	}
+	token, expire, err := mw.generate(claims["id"].(string), sessionID, time.Unix(int64(origIat), 0))
+	if err != nil {
+		mw.unauthorized(c, http.StatusInternalServerError, "Unable to issue the token")
+		return
+	}
+	audit.Record(audit.Event{Action: audit.TokenRefresh, Actor: claims["id"].(string), Target: sessionID, IP: commons.ClientIP(c.Request)})
+	tokenResponse(c, token, expire)
+}
+
+// revoke revokes the session of the claims or, if everywhere, every session of the user started until now.
+func (mw *Middleware) revoke(c *gin.Context, everywhere bool) {
+	if mw.Revocations == nil {
+		mw.unauthorized(c, http.StatusNotImplemented, "Tokens can't be revoked")
+		return
+	}
+	claims := ExtractClaims(c)
+	userID, _ := claims["id"].(string)
+	if userID == "" {
+		mw.unauthorized(c, http.StatusUnauthorized, ErrMissingIdentity.Error())
+		return
+	}
+	if ApiKeyID(claims) != "" {
+		mw.unauthorized(c, http.StatusBadRequest, "API keys are revoked by deleting them")
+		return
+	}
+	// Tokens issued before sessions had IDs are revoked with every session started up to the same second
+	sessionID, before := claimsSessionID(claims), claimsSessionStart(claims).Add(time.Second)
+	if everywhere || sessionID == "" {
+		sessionID = ""
+		if everywhere {
+			before = mw.now()
+		}
+	}
+	if err := mw.revokeSessions(userID, sessionID, before); err != nil {
+		mw.unauthorized(c, http.StatusInternalServerError, "Unable to revoke the token")
+		return
+	}
+	target := sessionID
+	if target == "" {
+		target = "every session"
+	}
+	audit.Record(audit.Event{Action: audit.SessionLogout, Actor: userID, Target: target, IP: commons.ClientIP(c.Request)})
+	c.JSON(http.StatusOK, gin.H{
+		"code":    http.StatusOK,
+		"message": "Logged out",
+	})
+}
+
+func (mw *Middleware) revokeSessions(userID string, sessionID string, before time.Time) error {
+	// The sessions start on the second in the tokens, the ones started within the second of the revocation may as
+	// well be later ones and are kept
+	before = before.Truncate(time.Second)
+	// The refreshed tokens of the sessions live at most this long
+	until := before.Add(mw.MaxRefresh + mw.Timeout)
+	if err := mw.Revocations.Revoke(userID, sessionID, before, until); err != nil {
+		return err
+	}
+	if mw.OnRevoke != nil {
+		mw.OnRevoke(userID, sessionID, before)
+	}
+	return nil
+}
+
+// RevokeUser revokes the tokens of every session of a user started until now, like a logout everywhere.
+func (mw *Middleware) RevokeUser(userID string) error {
+	if mw.Revocations == nil {
+		return nil
+	}
+	return mw.revokeSessions(userID, "", mw.now())
+}
+
+// LogoutHandler revokes the tokens of the session of the request, which must have gone through MiddlewareFunc.
+func (mw *Middleware) LogoutHandler(c *gin.Context) {
+	mw.revoke(c, false)
+}
+
+// LogoutEverywhereHandler revokes the tokens of every session of the user of the request, which must have gone
+// through MiddlewareFunc.
+func (mw *Middleware) LogoutEverywhereHandler(c *gin.Context) {
+	mw.revoke(c, true)
+}
+
+// ExtractClaims returns the claims of the token of a request authorized by one of the middlewares.
+func ExtractClaims(c *gin.Context) jwtgo.MapClaims {
+	claims, ok := c.Get(payloadKey)
+	if !ok {
+		return jwtgo.MapClaims{}
+	}
+	return claims.(jwtgo.MapClaims)
+}
+
+// claimsSessionID returns the ID of the session of the claims, empty for the tokens issued before sessions had IDs.
+func claimsSessionID(claims jwtgo.MapClaims) string {
+	sessionID, _ := claims["sid"].(string)
+	return sessionID
+}
+
+// claimsSessionStart returns when the first token of the session of the claims was issued.
+func claimsSessionStart(claims jwtgo.MapClaims) time.Time {
+	origIat, _ := claims["orig_iat"].(float64)
+	return time.Unix(int64(origIat), 0)
+}
@@ -0,0 +1,55 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"local/gintest/services/db"
+	"local/gintest/services/dbheap"
+	"time"
+)
+
+var ErrRevokedToken = errors.New("The token was revoked")
+
+// Revocations keeps the sessions whose tokens were revoked before they expired.
+type Revocations interface {
+	// Revoked tells whether the tokens of a session started at startedAt were revoked.
+	Revoked(userID string, sessionID string, startedAt time.Time) (bool, error)
+
+	// Revoke revokes the tokens of a session or, with an empty sessionID, the tokens of every session of the user
+	// started before before. The revocation can be forgotten after until, when none of those tokens is valid anymore.
+	Revoke(userID string, sessionID string, before time.Time, until time.Time) error
+}
+
+// mongoRevocations keeps the revocations in the database, shared by every instance.
+type mongoRevocations struct{}
+
+func (mongoRevocations) Revoked(userID string, sessionID string, startedAt time.Time) (bool, error) {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+	return session.ClientSession.IsRevoked(userID, sessionID, startedAt)
+}
+
+func (mongoRevocations) Revoke(userID string, sessionID string, before time.Time, until time.Time) error {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return session.ClientSession.InsertRevocation(db.DBRevocation{
+		UserID:    userID,
+		SessionID: sessionID,
+		Before:    before,
+		ExpiresAt: until,
+	})
+}
+
+// newSessionID returns the ID of a new session, kept by the tokens refreshed from its first one.
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
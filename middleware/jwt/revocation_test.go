@@ -0,0 +1,81 @@
+package jwt
+
+import (
+	"testing"
+	"time"
+
+	jwtgo "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+// memoryRevocations keeps the revocations like the database does, without expiring them.
+type memoryRevocations []struct {
+	userID, sessionID string
+	before            time.Time
+}
+
+func (m *memoryRevocations) Revoked(userID string, sessionID string, startedAt time.Time) (bool, error) {
+	for _, r := range *m {
+		if r.userID == userID && (r.sessionID == sessionID || r.sessionID == "" && r.before.After(startedAt)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryRevocations) Revoke(userID string, sessionID string, before time.Time, until time.Time) error {
+	*m = append(*m, struct {
+		userID, sessionID string
+		before            time.Time
+	}{userID, sessionID, before})
+	return nil
+}
+
+func TestCheckRevoked(t *testing.T) {
+	revocations := &memoryRevocations{}
+	mw := &Middleware{Revocations: revocations}
+	start := time.Now().Truncate(time.Second).Add(-time.Minute)
+	claims := func(sessionID string, startedAt time.Time) jwtgo.MapClaims {
+		return jwtgo.MapClaims{"id": "user", "sid": sessionID, "orig_iat": float64(startedAt.Unix())}
+	}
+
+	if err := mw.checkRevoked(claims("a", start)); err != nil {
+		t.Fatal(err)
+	}
+	revocations.Revoke("user", "a", start, start.Add(time.Hour))
+	if err := mw.checkRevoked(claims("a", start)); err != ErrRevokedToken {
+		t.Fatal("The revoked session was accepted: ", err)
+	}
+	if err := mw.checkRevoked(claims("b", start)); err != nil {
+		t.Fatal("Another session was revoked: ", err)
+	}
+
+	// Logging out everywhere revokes the sessions started until then, not the later ones
+	revocations.Revoke("user", "", start.Add(time.Second), start.Add(time.Hour))
+	if err := mw.checkRevoked(claims("b", start)); err != ErrRevokedToken {
+		t.Fatal("An older session was accepted: ", err)
+	}
+	if err := mw.checkRevoked(claims("c", start.Add(time.Second))); err != nil {
+		t.Fatal("A newer session was revoked: ", err)
+	}
+}
+
+func TestRevokeSameSecond(t *testing.T) {
+	revocations := &memoryRevocations{}
+	second := time.Now().Truncate(time.Second).Add(-time.Minute)
+	now := second.Add(300 * time.Millisecond)
+	mw := &Middleware{Revocations: revocations, TimeFunc: func() time.Time { return now }}
+	claims := func(sessionID string, startedAt time.Time) jwtgo.MapClaims {
+		return jwtgo.MapClaims{"id": "user", "sid": sessionID, "orig_iat": float64(startedAt.Unix())}
+	}
+
+	if err := mw.RevokeUser("user"); err != nil {
+		t.Fatal(err)
+	}
+	// orig_iat only has seconds, a session logged into right after the revocation starts on the same one
+	if err := mw.checkRevoked(claims("new", second.Add(700*time.Millisecond))); err != nil {
+		t.Fatal("A session started after the revocation within the same second was revoked: ", err)
+	}
+	if err := mw.checkRevoked(claims("old", second.Add(-time.Second))); err != ErrRevokedToken {
+		t.Fatal("A session started the second before the revocation was accepted: ", err)
+	}
+}
@@ -0,0 +1,169 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"local/gintest/services/db"
+	"local/gintest/services/dbheap"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	jwtgo "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+// How long a ticket can be redeemed after it's issued, enough to open the connection right away
+const ticketTimeout = 30 * time.Second
+
+var (
+	ErrEmptyTicket   = errors.New("The ticket is empty")
+	ErrInvalidTicket = errors.New("The ticket is invalid, expired or already used")
+)
+
+// Tickets keeps the single use tickets standing for the session of a token where it can't be sent in a header,
+// like in the URL opening a websocket, which ends up in the logs.
+type Tickets interface {
+	// Issue returns a new ticket for the session, valid until expiresAt.
+	Issue(session Session, expiresAt time.Time) (string, error)
+
+	// Redeem returns the session of a ticket valid at now, only once, or ErrInvalidTicket.
+	Redeem(ticket string, now time.Time) (Session, error)
+}
+
+func newTicket() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashTicket is what's kept of a ticket, which is random enough for a plain hash.
+func hashTicket(ticket string) string {
+	sum := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(sum[:])
+}
+
+// mongoTickets keeps the tickets in the database, so any instance can redeem them.
+type mongoTickets struct{}
+
+func (mongoTickets) Issue(session Session, expiresAt time.Time) (string, error) {
+	dbSession, err := dbheap.GetSession()
+	if err != nil {
+		return "", err
+	}
+	defer dbSession.Close()
+	ticket := newTicket()
+	err = dbSession.ClientSession.InsertWsTicket(db.DBWsTicket{
+		TicketHash:       hashTicket(ticket),
+		UserID:           session.UserID,
+		SessionID:        session.ID,
+		Roles:            session.Roles,
+		SessionStart:     session.StartedAt,
+		SessionExpiresAt: session.ExpiresAt,
+		ExpiresAt:        expiresAt,
+	})
+	return ticket, err
+}
+
+func (mongoTickets) Redeem(ticket string, now time.Time) (Session, error) {
+	dbSession, err := dbheap.GetSession()
+	if err != nil {
+		return Session{}, err
+	}
+	defer dbSession.Close()
+	redeemed, err := dbSession.ClientSession.RedeemWsTicket(hashTicket(ticket), now)
+	if err == mgo.ErrNotFound {
+		return Session{}, ErrInvalidTicket
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	return Session{
+		UserID:    redeemed.UserID,
+		ID:        redeemed.SessionID,
+		Roles:     redeemed.Roles,
+		StartedAt: redeemed.SessionStart,
+		ExpiresAt: redeemed.SessionExpiresAt,
+	}, nil
+}
+
+// sessionClaims are the claims of a token of the session, as parsed from the token.
+func sessionClaims(session Session) jwtgo.MapClaims {
+	roles := make([]interface{}, len(session.Roles))
+	for i, role := range session.Roles {
+		roles[i] = role
+	}
+	claims := jwtgo.MapClaims{
+		"id":       session.UserID,
+		"sid":      session.ID,
+		"roles":    roles,
+		"orig_iat": float64(session.StartedAt.Unix()),
+		"exp":      float64(session.ExpiresAt.Unix()),
+	}
+	if keyID := sessionApiKeyID(session.ID); keyID != "" {
+		claims["apikey"] = keyID
+	}
+	return claims
+}
+
+// TicketHandler answers with a ticket for the session of the token of the request, to open a websocket with.
+func (mw *Middleware) TicketHandler(c *gin.Context) {
+	if mw.Tickets == nil {
+		mw.unauthorized(c, http.StatusInternalServerError, "No tickets configured")
+		return
+	}
+	session := TokenSession(c)
+	// The ticket can't outlive the token
+	expire := mw.now().Add(ticketTimeout)
+	if session.ExpiresAt.Before(expire) {
+		expire = session.ExpiresAt
+	}
+	ticket, err := mw.Tickets.Issue(session, expire)
+	if err != nil {
+		mw.unauthorized(c, http.StatusInternalServerError, "Unable to issue the ticket")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":   http.StatusOK,
+		"ticket": ticket,
+		"expire": expire.Format(time.RFC3339),
+	})
+}
+
+// TicketMiddlewareFunc authorizes the requests with a valid ticket in the ticket query parameter, redeeming it,
+// and makes the claims of the session and its user available to the handlers like MiddlewareFunc does.
+func (mw *Middleware) TicketMiddlewareFunc() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ticket := c.Query("ticket")
+		if ticket == "" || mw.Tickets == nil {
+			mw.unauthorized(c, http.StatusUnauthorized, ErrEmptyTicket.Error())
+			return
+		}
+		session, err := mw.Tickets.Redeem(ticket, mw.now())
+		if err != nil {
+			mw.unauthorized(c, http.StatusUnauthorized, ErrInvalidTicket.Error())
+			return
+		}
+		claims := sessionClaims(session)
+		// The session may have been logged out since the ticket was issued. The keys are deleted rather than revoked
+		// with the sessions of their user, so their sessions aren't checked, like in MiddlewareFunc.
+		if ApiKeyID(claims) == "" {
+			if err = mw.checkRevoked(claims); err != nil {
+				mw.unauthorized(c, http.StatusUnauthorized, err.Error())
+				return
+			}
+		}
+		c.Set(payloadKey, claims)
+		c.Set(identityKey, session.UserID)
+		if mw.Authorizator != nil {
+			if err := mw.Authorizator(session.UserID, c); err != nil {
+				mw.unauthorized(c, http.StatusForbidden, ErrForbidden.Error()+": "+err.Error())
+				return
+			}
+		}
+		c.Next()
+	}
+}
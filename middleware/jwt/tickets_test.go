@@ -0,0 +1,154 @@
+package jwt
+
+import (
+	"encoding/json"
+	"local/gintest/services/db"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTicket(t *testing.T) {
+	ticket, other := newTicket(), newTicket()
+	if len(ticket) != 43 || ticket == other {
+		t.Fatal("Wrong tickets: ", ticket, other)
+	}
+	if hashTicket(ticket) != hashTicket(ticket) || hashTicket(ticket) == hashTicket(other) || hashTicket(ticket) == ticket {
+		t.Error("Wrong ticket hashes")
+	}
+}
+
+// The handlers must see the session of a ticket like the one of the token it was issued for
+func TestSessionClaims(t *testing.T) {
+	session := Session{
+		UserID:    "alice",
+		ID:        "0123456789abcdef",
+		Roles:     []string{"viewer", "operator"},
+		StartedAt: time.Unix(1600000000, 0),
+		ExpiresAt: time.Unix(1600003600, 0),
+	}
+	if got := claimsSession(sessionClaims(session)); !reflect.DeepEqual(got, session) {
+		t.Error("Wrong session of the ticket claims: ", got)
+	}
+}
+
+// memoryTickets keeps the tickets like the database does, redeeming them once.
+type memoryTickets map[string]struct {
+	session   Session
+	expiresAt time.Time
+}
+
+func (m memoryTickets) Issue(session Session, expiresAt time.Time) (string, error) {
+	ticket := newTicket()
+	m[hashTicket(ticket)] = struct {
+		session   Session
+		expiresAt time.Time
+	}{session, expiresAt}
+	return ticket, nil
+}
+
+func (m memoryTickets) Redeem(ticket string, now time.Time) (Session, error) {
+	issued, ok := m[hashTicket(ticket)]
+	if !ok || !issued.expiresAt.After(now) {
+		return Session{}, ErrInvalidTicket
+	}
+	delete(m, hashTicket(ticket))
+	return issued.session, nil
+}
+
+func TestTicketMiddleware(t *testing.T) {
+	now := time.Now()
+	mw := &Middleware{
+		Timeout:     time.Hour,
+		MaxRefresh:  time.Hour,
+		Tickets:     memoryTickets{},
+		Revocations: &memoryRevocations{},
+		TimeFunc:    func() time.Time { return now },
+	}
+	session := Session{UserID: "alice", ID: "session", Roles: []string{"viewer"}, StartedAt: now.Truncate(time.Second).Add(-time.Minute), ExpiresAt: now.Add(time.Hour)}
+	withToken := func(c *gin.Context) {
+		c.Set(payloadKey, sessionClaims(session))
+	}
+	engine := gin.New()
+	engine.POST("/auth/ws_ticket", withToken, mw.TicketHandler)
+	engine.POST("/auth/logout", withToken, mw.LogoutHandler)
+	engine.GET("/ws", mw.TicketMiddlewareFunc(), func(c *gin.Context) {
+		if got := TokenSession(c); got.UserID != session.UserID || got.ID != session.ID {
+			t.Error("Wrong session of the ticket: ", got)
+		}
+		c.Status(http.StatusOK)
+	})
+	request := func(method string, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+	ticket := func() string {
+		var answer struct{ Ticket string }
+		json.Unmarshal(request("POST", "/auth/ws_ticket").Body.Bytes(), &answer)
+		if answer.Ticket == "" {
+			t.Fatal("No ticket issued")
+		}
+		return answer.Ticket
+	}
+
+	issued := ticket()
+	if status := request("GET", "/ws?ticket="+issued).Code; status != http.StatusOK {
+		t.Fatal("The ticket was refused: ", status)
+	}
+	if status := request("GET", "/ws?ticket="+issued).Code; status != http.StatusUnauthorized {
+		t.Error("A ticket was redeemed twice: ", status)
+	}
+	if status := request("GET", "/ws").Code; status != http.StatusUnauthorized {
+		t.Error("A request without a ticket was let through: ", status)
+	}
+
+	issued = ticket()
+	now = now.Add(ticketTimeout)
+	if status := request("GET", "/ws?ticket="+issued).Code; status != http.StatusUnauthorized {
+		t.Error("An expired ticket was redeemed: ", status)
+	}
+
+	// The session may be logged out between the issue and the redemption of its ticket
+	issued = ticket()
+	if status := request("POST", "/auth/logout").Code; status != http.StatusOK {
+		t.Fatal("Unable to log out: ", status)
+	}
+	if status := request("GET", "/ws?ticket="+issued).Code; status != http.StatusUnauthorized {
+		t.Error("A ticket of a logged out session was redeemed: ", status)
+	}
+}
+
+// The keys aren't revoked with the sessions of their user, whether their requests come with the key or a ticket
+func TestApiKeyTicket(t *testing.T) {
+	now := time.Now()
+	revocations := &memoryRevocations{}
+	mw := &Middleware{Tickets: memoryTickets{}, Revocations: revocations, TimeFunc: func() time.Time { return now }}
+	key := db.DBApiKey{KeyID: "key", UserID: "alice", Scopes: []string{"viewer"}, CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)}
+	tokenSession := Session{UserID: "alice", ID: "session", Roles: []string{"viewer"}, StartedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)}
+	engine := gin.New()
+	engine.GET("/ws", mw.TicketMiddlewareFunc(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"apikey": FromApiKey(c)})
+	})
+	redeem := func(session Session) (int, bool) {
+		ticket, _ := mw.Tickets.Issue(session, now.Add(ticketTimeout))
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest("GET", "/ws?ticket="+ticket, nil))
+		var answer struct{ ApiKey bool }
+		json.Unmarshal(recorder.Body.Bytes(), &answer)
+		return recorder.Code, answer.ApiKey
+	}
+
+	// Like a password change does
+	revocations.Revoke("alice", "", now, now.Add(time.Hour))
+	if status, apiKey := redeem(claimsSession(apiKeyClaims(key, db.DBUser{Username: "alice"}))); status != http.StatusOK || !apiKey {
+		t.Error("The ticket of a key was refused once its user was logged out: ", status, apiKey)
+	}
+	if status, _ := redeem(tokenSession); status != http.StatusUnauthorized {
+		t.Error("The ticket of a logged out session was redeemed: ", status)
+	}
+}
@@ -0,0 +1,148 @@
+package oidc
+
+import (
+	"crypto/subtle"
+	"errors"
+	"local/gintest/commons"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// The cookie keeping the flow between the login and the callback, and how long a login may take
+	flowCookie  = "oidc_flow"
+	flowTimeout = 10 * time.Minute
+)
+
+// TokenIssuer issues the tokens of the service, like the jwt middleware.
+type TokenIssuer interface {
+	TokenGenerator(userID string) (string, time.Time, error)
+	// SecondFactorChallenge returns a challenge the user must answer before getting a token, or "" if it needs none
+	SecondFactorChallenge(userID string, c *gin.Context) (string, time.Time, error)
+}
+
+// Handler runs the login through the provider alongside the local accounts: once the provider vouches for a user,
+// it's mapped to a local one which gets a token as if it logged in with its password.
+type Handler struct {
+	Provider *Provider
+	Tokens   TokenIssuer
+
+	// MapUser returns the local user of the verified claims, creating it if needed. It defaults to the users of
+	// the database.
+	MapUser func(claims IDClaims, ip string) (string, error)
+
+	// Where the browser is sent back with the token, or the error, in the fragment
+	ReturnURL string
+}
+
+func NewHandler(config Config, tokens TokenIssuer) *Handler {
+	return &Handler{Provider: NewProvider(config, nil), Tokens: tokens, MapUser: mapUser, ReturnURL: "/"}
+}
+
+func (f flow) encode() string {
+	return f.State + "." + f.Nonce + "." + f.Verifier
+}
+
+func decodeFlow(value string) (flow, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return flow{}, false
+	}
+	return flow{State: parts[0], Nonce: parts[1], Verifier: parts[2]}, true
+}
+
+func (h *Handler) setFlowCookie(c *gin.Context, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     flowCookie,
+		Value:    value,
+		Path:     "/oidc",
+		MaxAge:   maxAge,
+		Secure:   c.Request.TLS != nil,
+		HttpOnly: true,
+		// Lax so the cookie comes back with the top level redirect of the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Login sends the browser to the provider.
+func (h *Handler) Login(c *gin.Context) {
+	f := newFlow()
+	location, err := h.Provider.AuthCodeURL(c.Request.Context(), f)
+	if err != nil {
+		log.Println("Error on OIDC login reaching the provider: ", err)
+		c.JSON(http.StatusBadGateway, gin.H{"code": http.StatusBadGateway, "message": "The identity provider can't be reached"})
+		return
+	}
+	h.setFlowCookie(c, f.encode(), int(flowTimeout/time.Second))
+	c.Redirect(http.StatusFound, location)
+}
+
+// Callback finishes the login the provider sent back, handing a token to the browser in the fragment of the
+// return URL, where it isn't sent to any server nor logged. The users with a second factor get the challenge to
+// answer instead, like with their password.
+func (h *Handler) Callback(c *gin.Context) {
+	userID, err := h.callback(c)
+	if err != nil {
+		log.Println("Error on OIDC callback: ", err)
+		h.returnTo(c, url.Values{"error": {err.Error()}})
+		return
+	}
+	challenge, expire, err := h.Tokens.SecondFactorChallenge(userID, c)
+	if err != nil {
+		log.Println("Error on OIDC callback starting the second factor check: ", err)
+		h.returnTo(c, url.Values{"error": {"The second factor check can't be started"}})
+		return
+	}
+	if challenge != "" {
+		h.returnTo(c, url.Values{"challenge": {challenge}, "expire": {expire.Format(time.RFC3339)}})
+		return
+	}
+	token, expire, err := h.Tokens.TokenGenerator(userID)
+	if err != nil {
+		log.Println("Error on OIDC callback issuing a token: ", err)
+		h.returnTo(c, url.Values{"error": {"The token can't be issued"}})
+		return
+	}
+	h.returnTo(c, url.Values{"token": {token}, "expire": {expire.Format(time.RFC3339)}})
+}
+
+var ErrInvalidState = errors.New("The login expired or was started elsewhere")
+
+func (h *Handler) callback(c *gin.Context) (string, error) {
+	cookie, err := c.Request.Cookie(flowCookie)
+	// The flow is good for one callback only
+	h.setFlowCookie(c, "", -1)
+	if err != nil {
+		return "", ErrInvalidState
+	}
+	f, ok := decodeFlow(cookie.Value)
+	state := c.Query("state")
+	if !ok || state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(f.State)) != 1 {
+		return "", ErrInvalidState
+	}
+	if reason := c.Query("error"); reason != "" {
+		return "", errors.New("The identity provider refused the login: " + reason)
+	}
+	code := c.Query("code")
+	if code == "" {
+		return "", errors.New("The identity provider sent no code")
+	}
+	idToken, err := h.Provider.Exchange(c.Request.Context(), code, f.Verifier)
+	if err != nil {
+		return "", err
+	}
+	claims, err := h.Provider.VerifyIDToken(c.Request.Context(), idToken, f.Nonce, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return h.MapUser(claims, commons.ClientIP(c.Request))
+}
+
+func (h *Handler) returnTo(c *gin.Context, fragment url.Values) {
+	c.Redirect(http.StatusFound, h.ReturnURL+"#"+fragment.Encode())
+}
@@ -0,0 +1,363 @@
+// Package oidc logs users in with an OpenID Connect provider, through the authorization code flow with PKCE, and
+// hands them the usual tokens of the service.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"local/gintest/middleware/jwt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How far the clock of the provider may be off
+	clockSkew = time.Minute
+
+	// The biggest response of the provider read
+	maxResponseSize = 1 << 20
+
+	// The keys of the provider are fetched again at most this often when a token names an unknown one
+	minKeysRefresh = time.Minute
+)
+
+var (
+	ErrInvalidIDToken = errors.New("The ID token is invalid")
+	ErrUnknownKey     = errors.New("The ID token was signed with an unknown key")
+)
+
+// Config is what the provider was told about the service when registering it.
+type Config struct {
+	// The URL of the provider, where its discovery document is found
+	Issuer string
+
+	ClientID     string
+	ClientSecret string
+
+	// The callback of the service, as registered on the provider
+	RedirectURL string
+
+	// The scopes asked for besides openid
+	Scopes []string
+}
+
+// discovery is the part of the discovery document of the provider the flow needs.
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider is an OpenID Connect provider. Its discovery document is read on the first use, and read again until
+// it succeeds, so the service starts even when the provider is down.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mutex         sync.Mutex
+	endpoints     *discovery
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+func NewProvider(config Config, client *http.Client) *Provider {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	return &Provider{config: config, client: client}
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := p.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, response.Status)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, maxResponseSize)).Decode(v)
+}
+
+// discover returns the endpoints of the provider, reading its discovery document if it's not known yet.
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+	var d discovery
+	if err := p.getJSON(ctx, p.config.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	// Otherwise a provider could pass for another one
+	if strings.TrimSuffix(d.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("The provider claims to be %q instead of %q", d.Issuer, p.config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("The discovery document lacks endpoints")
+	}
+	p.endpoints = &d
+	return p.endpoints, nil
+}
+
+func randomString(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// pkceChallenge is the S256 challenge of a PKCE code verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// flow is what the callback must get back to finish a login: the state guards against forged callbacks, the
+// nonce against replayed ID tokens and the verifier against stolen codes.
+type flow struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+func newFlow() flow {
+	return flow{State: randomString(24), Nonce: randomString(24), Verifier: randomString(48)}
+}
+
+// AuthCodeURL returns where to send the browser to log in on the provider.
+func (p *Provider) AuthCodeURL(ctx context.Context, f flow) (string, error) {
+	endpoints, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, p.config.Scopes...), " ")},
+		"state":                 {f.State},
+		"nonce":                 {f.Nonce},
+		"code_challenge":        {pkceChallenge(f.Verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(endpoints.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return endpoints.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange trades the code the provider sent to the callback for an ID token.
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string) (string, error) {
+	endpoints, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	request, err := http.NewRequest(http.MethodPost, endpoints.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	response, err := p.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxResponseSize))
+	if err != nil {
+		return "", err
+	}
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.Unmarshal(body, &tokens); err != nil {
+		return "", fmt.Errorf("The token endpoint answered %s", response.Status)
+	}
+	if response.StatusCode != http.StatusOK || tokens.Error != "" {
+		return "", fmt.Errorf("The token endpoint refused the code: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("The token endpoint answered without an ID token")
+	}
+	return tokens.IDToken, nil
+}
+
+// key returns the key of the provider with the given ID, fetching the keys again when it's unknown, as the
+// provider may have rotated them.
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	endpoints, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < minKeysRefresh {
+		return nil, ErrUnknownKey
+	}
+	var jwks struct {
+		Keys []jwt.JWK `json:"keys"`
+	}
+	if err = p.getJSON(ctx, endpoints.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.PublicKey(); err == nil {
+			keys[jwk.ID] = key
+		}
+	}
+	p.keys, p.keysFetchedAt = keys, time.Now()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// IDClaims are the claims of an ID token used to find or create the user.
+type IDClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	AuthorizedParty   string          `json:"azp"`
+	Expiry            int64           `json:"exp"`
+	IssuedAt          int64           `json:"iat"`
+	Nonce             string          `json:"nonce"`
+	PreferredUsername string          `json:"preferred_username"`
+	Email             string          `json:"email"`
+	EmailVerified     bool            `json:"email_verified"`
+	Name              string          `json:"name"`
+}
+
+// audiences reads the audience, a string or an array of strings.
+func (c IDClaims) audiences() []string {
+	var single string
+	if json.Unmarshal(c.Audience, &single) == nil {
+		return []string{single}
+	}
+	var several []string
+	json.Unmarshal(c.Audience, &several)
+	return several
+}
+
+// verifySignature checks the signature of a JWS with an RSA or a P-256 EC key. The ID tokens are checked here
+// rather than by the jwt-go package, which can't check audiences given as arrays.
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	sum := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrInvalidIDToken
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, sum[:], signature)
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return ErrInvalidIDToken
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, sum[:], r, s) {
+			return ErrInvalidIDToken
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported ID token algorithm %q", alg)
+}
+
+// VerifyIDToken checks the signature, the issuer, the audience, the expiration and the nonce of an ID token and
+// returns its claims.
+func (p *Provider) VerifyIDToken(ctx context.Context, idToken string, nonce string, now time.Time) (IDClaims, error) {
+	var claims IDClaims
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return claims, ErrInvalidIDToken
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, ErrInvalidIDToken
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err = json.Unmarshal(headerData, &header); err != nil {
+		return claims, ErrInvalidIDToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrInvalidIDToken
+	}
+	key, err := p.key(ctx, header.KeyID)
+	if err != nil {
+		return claims, err
+	}
+	if err = verifySignature(header.Algorithm, key, parts[0]+"."+parts[1], signature); err != nil {
+		return claims, ErrInvalidIDToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return claims, ErrInvalidIDToken
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != p.config.Issuer {
+		return claims, fmt.Errorf("The ID token was issued by %q", claims.Issuer)
+	}
+	audiences := claims.audiences()
+	audienceOK := false
+	for _, audience := range audiences {
+		audienceOK = audienceOK || audience == p.config.ClientID
+	}
+	if !audienceOK || (len(audiences) > 1 && claims.AuthorizedParty != p.config.ClientID) {
+		return claims, errors.New("The ID token is meant for another client")
+	}
+	if claims.Subject == "" {
+		return claims, errors.New("The ID token has no subject")
+	}
+	if !time.Unix(claims.Expiry, 0).Add(clockSkew).After(now) {
+		return claims, errors.New("The ID token is expired")
+	}
+	if time.Unix(claims.IssuedAt, 0).Add(-clockSkew).After(now) {
+		return claims, errors.New("The ID token was issued in the future")
+	}
+	if claims.Nonce != nonce {
+		return claims, errors.New("The ID token nonce doesn't match the login")
+	}
+	return claims, nil
+}
@@ -0,0 +1,247 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mockProvider is a local identity provider handing out an ID token for a single code.
+type mockProvider struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	code      string
+	challenge string
+	claims    map[string]interface{}
+
+	// The issuer the discovery document claims, the URL of the server if empty
+	issuer string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockProvider{key: key, code: "the-code"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := m.issuer
+		if issuer == "" {
+			issuer = m.server.URL
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		r.ParseForm()
+		if id != "client" || secret != "secret" || r.PostForm.Get("code") != m.code ||
+			pkceChallenge(r.PostForm.Get("code_verifier")) != m.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(t, "key-1", m.claims)})
+	})
+	m.server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockProvider) sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (m *mockProvider) validClaims(nonce string, now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                m.server.URL,
+		"sub":                "12345",
+		"aud":                "client",
+		"exp":                now.Add(time.Hour).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              nonce,
+		"preferred_username": "alice",
+	}
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	m := newMockProvider(t)
+	defer m.server.Close()
+	p := NewProvider(Config{Issuer: m.server.URL, ClientID: "client", ClientSecret: "secret", RedirectURL: "http://localhost/oidc/callback"}, nil)
+	ctx := context.Background()
+
+	f := newFlow()
+	location, err := p.AuthCodeURL(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(location)
+	query := u.Query()
+	if u.Path != "/authorize" || query.Get("state") != f.State || query.Get("nonce") != f.Nonce ||
+		query.Get("code_challenge_method") != "S256" || query.Get("scope") != "openid" ||
+		query.Get("redirect_uri") != "http://localhost/oidc/callback" {
+		t.Fatal("Wrong authorization URL: ", location)
+	}
+	m.challenge = query.Get("code_challenge")
+
+	now := time.Now()
+	m.claims = m.validClaims(f.Nonce, now)
+	if _, err = p.Exchange(ctx, m.code, "another verifier"); err == nil {
+		t.Error("The code was exchanged without the PKCE verifier")
+	}
+	idToken, err := p.Exchange(ctx, m.code, f.Verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := p.VerifyIDToken(ctx, idToken, f.Nonce, now)
+	if err != nil || claims.Subject != "12345" || claims.PreferredUsername != "alice" {
+		t.Fatal("Wrong claims: ", claims, err)
+	}
+	if usernameOf(claims) != "alice" {
+		t.Error("Wrong username: ", usernameOf(claims))
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	m := newMockProvider(t)
+	defer m.server.Close()
+	p := NewProvider(Config{Issuer: m.server.URL, ClientID: "client"}, nil)
+	ctx, now := context.Background(), time.Now()
+
+	tests := []struct {
+		name   string
+		change func(claims map[string]interface{})
+		ok     bool
+	}{
+		{"valid", func(map[string]interface{}) {}, true},
+		{"audience array", func(c map[string]interface{}) { c["aud"] = []string{"other", "client"}; c["azp"] = "client" }, true},
+		{"audience array without azp", func(c map[string]interface{}) { c["aud"] = []string{"other", "client"} }, false},
+		{"other audience", func(c map[string]interface{}) { c["aud"] = "other" }, false},
+		{"other issuer", func(c map[string]interface{}) { c["iss"] = "https://elsewhere" }, false},
+		{"wrong nonce", func(c map[string]interface{}) { c["nonce"] = "replayed" }, false},
+		{"expired", func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() }, false},
+		{"no subject", func(c map[string]interface{}) { delete(c, "sub") }, false},
+	}
+	for _, test := range tests {
+		claims := m.validClaims("nonce", now)
+		test.change(claims)
+		_, err := p.VerifyIDToken(ctx, m.sign(t, "key-1", claims), "nonce", now)
+		if (err == nil) != test.ok {
+			t.Error(test.name, ": wrong verification: ", err)
+		}
+	}
+
+	token := m.sign(t, "key-1", m.validClaims("nonce", now))
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(map[string]interface{}{"iss": m.server.URL, "sub": "admin", "aud": "client", "exp": now.Add(time.Hour).Unix(), "nonce": "nonce"})
+	if _, err := p.VerifyIDToken(ctx, parts[0]+"."+base64.RawURLEncoding.EncodeToString(forged)+"."+parts[2], "nonce", now); err != ErrInvalidIDToken {
+		t.Error("Accepted a forged token: ", err)
+	}
+	if _, err := p.VerifyIDToken(ctx, m.sign(t, "key-2", m.validClaims("nonce", now)), "nonce", now); err != ErrUnknownKey {
+		t.Error("Accepted a token signed with an unknown key: ", err)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	m := newMockProvider(t)
+	defer m.server.Close()
+	m.issuer = "https://elsewhere"
+	p := NewProvider(Config{Issuer: m.server.URL, ClientID: "client"}, nil)
+	if _, err := p.AuthCodeURL(context.Background(), newFlow()); err == nil {
+		t.Error("Trusted a provider claiming to be another one")
+	}
+}
+
+// fakeIssuer issues tokens to the users, asking the ones in challenges for a second factor first.
+type fakeIssuer struct {
+	challenges map[string]string
+}
+
+func (f fakeIssuer) TokenGenerator(userID string) (string, time.Time, error) {
+	return "token-of-" + userID, time.Now().Add(time.Hour), nil
+}
+
+func (f fakeIssuer) SecondFactorChallenge(userID string, c *gin.Context) (string, time.Time, error) {
+	return f.challenges[userID], time.Now().Add(time.Minute), nil
+}
+
+// logIn runs a login through the mock provider as the user preferredUsername, returning the fragment the browser
+// is sent back with.
+func logIn(t *testing.T, m *mockProvider, h *Handler, preferredUsername string) url.Values {
+	engine := gin.New()
+	engine.GET("/oidc/login", h.Login)
+	engine.GET("/oidc/callback", h.Callback)
+
+	login := httptest.NewRecorder()
+	engine.ServeHTTP(login, httptest.NewRequest("GET", "/oidc/login", nil))
+	location, err := url.Parse(login.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.challenge = location.Query().Get("code_challenge")
+	m.claims = m.validClaims(location.Query().Get("nonce"), time.Now())
+	m.claims["preferred_username"] = preferredUsername
+
+	request := httptest.NewRequest("GET", "/oidc/callback?"+url.Values{"state": {location.Query().Get("state")}, "code": {m.code}}.Encode(), nil)
+	for _, cookie := range login.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+	callback := httptest.NewRecorder()
+	engine.ServeHTTP(callback, request)
+	returned, err := url.Parse(callback.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fragment, _ := url.ParseQuery(returned.Fragment)
+	return fragment
+}
+
+func TestCallbackSecondFactor(t *testing.T) {
+	m := newMockProvider(t)
+	defer m.server.Close()
+	h := NewHandler(Config{Issuer: m.server.URL, ClientID: "client", ClientSecret: "secret", RedirectURL: "http://localhost/oidc/callback"},
+		fakeIssuer{challenges: map[string]string{"bob": "challenge-of-bob"}})
+	h.MapUser = func(claims IDClaims, ip string) (string, error) { return claims.PreferredUsername, nil }
+
+	if fragment := logIn(t, m, h, "alice"); fragment.Get("token") != "token-of-alice" || fragment.Get("challenge") != "" {
+		t.Error("Wrong fragment of a user without a second factor: ", fragment)
+	}
+	if fragment := logIn(t, m, h, "bob"); fragment.Get("challenge") != "challenge-of-bob" || fragment.Get("token") != "" {
+		t.Error("The second factor was skipped: ", fragment)
+	}
+}
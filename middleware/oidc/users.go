@@ -0,0 +1,87 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"local/gintest/middleware/jwt"
+	"local/gintest/services/audit"
+	"local/gintest/services/db"
+	"local/gintest/services/dbheap"
+	"local/gintest/services/rbac"
+
+	"github.com/globalsign/mgo"
+)
+
+// usernameOf picks the username of a new user from its claims. An email is only used once the provider checked it.
+func usernameOf(claims IDClaims) string {
+	switch {
+	case claims.PreferredUsername != "":
+		return claims.PreferredUsername
+	case claims.Email != "" && claims.EmailVerified:
+		return claims.Email
+	}
+	return "oidc-" + subjectHash(claims)
+}
+
+// subjectHash tells apart the users of the same name on different providers, or on the provider and locally.
+func subjectHash(claims IDClaims) string {
+	sum := sha256.Sum256([]byte(claims.Issuer + " " + claims.Subject))
+	return hex.EncodeToString(sum[:4])
+}
+
+// mapUser finds the user with the identity of the claims, creating it as a viewer the first time. A local user of
+// the same name is never taken over, the new user gets a suffix instead: linking the accounts is up to an admin.
+func mapUser(claims IDClaims, ip string) (string, error) {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	issuer := strings.TrimSuffix(claims.Issuer, "/")
+	details := "oidc " + issuer
+
+	user := db.DBUser{}
+	err = session.ClientSession.GetUserByIdentity(issuer, claims.Subject, &user)
+	if err == nil {
+		if user.Disabled {
+			audit.Record(audit.Event{Action: audit.LoginFailure, Actor: user.Username, Target: user.Username, IP: ip,
+				Details: details + ": " + jwt.ErrDisabledUser.Error()})
+			return "", jwt.ErrDisabledUser
+		}
+		audit.Record(audit.Event{Action: audit.LoginSuccess, Actor: user.Username, Target: user.Username, IP: ip, Details: details})
+		return user.Username, nil
+	}
+	if err != mgo.ErrNotFound {
+		return "", err
+	}
+
+	// No password, the user can only log in through the provider until one is set
+	now := time.Now()
+	user = db.DBUser{
+		Roles:      []string{string(rbac.DefaultRole)},
+		Identities: []db.DBIdentity{{Issuer: issuer, Subject: claims.Subject}},
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	for _, username := range []string{usernameOf(claims), usernameOf(claims) + "-" + subjectHash(claims)} {
+		user.Username = username
+		if err = session.ClientSession.InsertUser(user); !mgo.IsDup(err) {
+			break
+		}
+	}
+	if err != nil {
+		if mgo.IsDup(err) {
+			return "", errors.New("No username is left for the identity")
+		}
+		return "", err
+	}
+	log.Println("Created the user ", user.Username, " for the identity ", claims.Subject, " of ", issuer)
+	audit.Record(audit.Event{Action: audit.UserRegister, Actor: user.Username, Target: user.Username, IP: ip, Details: details})
+	audit.Record(audit.Event{Action: audit.LoginSuccess, Actor: user.Username, Target: user.Username, IP: ip, Details: details})
+	return user.Username, nil
+}
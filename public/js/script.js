@@ -3,8 +3,30 @@ var socket;
 
 var signalsArray;
 
+// The session token, refreshed before it expires
+var token;
+
+// The hello command has a fixed ID, the rest are told by the server on hello
+const helloCommand = 1000;
+const protocolVersion = 1;
+var commands = {};
+
 window.onload = function() {
 
+	// Back from the identity provider, the fragment is dropped so the token, or the challenge of the second factor,
+	// doesn't stay in the history
+	var fragment = new URLSearchParams(window.location.hash.substring(1));
+	if (fragment.has("token") || fragment.has("challenge") || fragment.has("error")) {
+		history.replaceState(null, "", window.location.pathname);
+		if (fragment.has("token")) {
+			onlogin({token: fragment.get("token"), expire: fragment.get("expire")});
+		} else if (fragment.has("challenge")) {
+			onchallenge({challenge: fragment.get("challenge"), expire: fragment.get("expire")});
+		} else {
+			$("#loginStatus").html(`Failed: ${$("<div>").text(fragment.get("error")).html()}`);
+		}
+	}
+
 	var button = $("#loginBtn");
 
 	button.click(()=>{
@@ -22,30 +44,7 @@ window.onload = function() {
 			//contentType: "application/x-www-form-urlencoded",
 			data: JSON.stringify(bodyobj),
 			contentType: "application/json",
-			success: function (data) {
-				console.log("Success");
-				console.log(data);
-				var expirationDate = new Date(data.expire);
-				$("#loginStatus").html("Success");
-				$("#loginToken").html(`Token <b>${data.token.substring(0, 100)}...</b>`);
-				$("#loginTokenExpiration").html(`Expires on ${expirationDate}`);
-
-				if(socket != null && socket.readyState == 1){
-					socket.onclose = ()=>{
-						socket = new WebSocket(`ws://${window.location.host}/ws?token=${data.token}`);
-						socket.onopen = onsocketopen;
-						socket.onmessage = onsocketmessage;
-						socket.onclose = null;
-					};
-					socket.close(1000,"The client has re-logged in");
-				}else{
-					socket = new WebSocket(`ws://${window.location.host}/ws?token=${data.token}`);
-					socket.onopen = onsocketopen;
-					socket.onmessage = onsocketmessage;
-				}
-        
-
-			},
+			success: (data) => data.challenge ? onchallenge(data) : onlogin(data),
 			error: function (xhRequest, ErrorText, thrownError) {
 				console.warn("Failed to process correctly");
 				console.log(xhRequest);
@@ -65,18 +64,98 @@ window.onload = function() {
 };
 
 
+// Logged in with a password or through the identity provider, which hands the token in the URL fragment
+var onlogin = function (data) {
+	console.log("Success");
+	console.log(data);
+	token = data.token;
+	var expirationDate = new Date(data.expire);
+	$("#loginStatus").html("Success");
+	$("#loginToken").html(`Token <b>${data.token.substring(0, 100)}...</b>`);
+	$("#loginTokenExpiration").html(`Expires on ${expirationDate}`);
+
+	if(socket != null && socket.readyState == 1){
+		socket.onclose = ()=>{
+			socket.onclose = null;
+			opensocket();
+		};
+		socket.close(1000,"The client has re-logged in");
+	}else{
+		opensocket();
+	}
+};
+
+// The token would end up in the logs if sent in the URL, the socket is opened with a single use ticket instead
+var opensocket = function () {
+	$.ajax({
+		url: "http://"+window.location.host+"/auth/ws_ticket",
+		type: "POST",
+		headers: {Authorization: `Bearer ${token}`},
+		success: function (data) {
+			socket = new WebSocket(`ws://${window.location.host}/ws?ticket=${encodeURIComponent(data.ticket)}`);
+			socket.onopen = onsocketopen;
+			socket.onmessage = onsocketmessage;
+		},
+		error: function (xhRequest) {
+			console.warn("Unable to get a websocket ticket");
+			$("#loginStatus").html("Failed to connect");
+		}
+	});
+};
+
+// The user has a second factor, the token comes once its code answers the challenge
+var onchallenge = function (data) {
+	var code = window.prompt("Code of the authenticator app, or a recovery code");
+	if (code == null) {
+		$("#loginStatus").html("Cancelled");
+		return;
+	}
+	$.ajax({
+		url: "http://"+window.location.host+"/login/challenge",
+		type: "POST",
+		data: JSON.stringify({challenge: data.challenge, code: code}),
+		contentType: "application/json",
+		success: onlogin,
+		error: function (xhRequest) {
+			$("#loginStatus").html("Failed");
+		}
+	});
+};
+
 var onsocketopen = function (event) {
 	console.log("Connected!");
-	var command = {command:1};
-	var jsonCommand = JSON.stringify(command);
-	socket.send(jsonCommand);
+	var hello = {command: helloCommand, version: protocolVersion, features: ["tokenRefresh", "batch"], encodings: ["json"]};
+	socket.send(JSON.stringify(hello));
 };
 
-var onsocketmessage = function(event) {
+var onhello = function(message) {
+	console.log(`Speaking protocol version ${message.version} with features ${message.features}`);
+	commands = {};
+	for (var i = 0; i < message.commands.length; i++) {
+		commands[message.commands[i].name] = message.commands[i].id;
+	}
+	if (message.features.includes("batch")) {
+		// Get every initial snapshot in a single round trip
+		socket.send(JSON.stringify([{command: commands.CompleteSignalList}, {command: commands.NConnectionsPush}]));
+	} else {
+		socket.send(JSON.stringify({command: commands.CompleteSignalList}));
+	}
+};
 
+var onsocketmessage = function(event) {
 
 	var message = JSON.parse(event.data);
 
+	// The responses to a batch of commands come in a single array
+	if (Array.isArray(message)) {
+		message.forEach((response) => { if (response != null) handleMessage(response); });
+		return;
+	}
+	handleMessage(message);
+};
+
+var handleMessage = function(message) {
+
 	if(!message.hasOwnProperty("status")){
 		console.warn("This message doesn't include a status field");
 		console.log(message);
@@ -89,18 +168,35 @@ var onsocketmessage = function(event) {
 	}
 
 	switch (message.command) {
-	case 1:
+	case helloCommand:
+		onhello(message);
+		break;
+	case commands.CompleteSignalList:
 		refreshSignals(message);
 		break;
-	case 4:
+	case commands.SignalUpdatePush:
 		refreshPidValues(message);
 		break;
-	case 3:
+	case commands.NConnectionsPush:
 		refreshCurrentUsersCount(message);
 		break;
-	case 2:
+	case commands.SignalUpdateListPush:
 		refresPidListValues(message);
 		break;
+	case commands.RefreshToken:
+		$("#loginTokenExpiration").html(`Expires on ${new Date(message.expire)}`);
+		break;
+	case commands.TokenExpiringPush:
+		refreshToken(message);
+		break;
+	case commands.PingPush:
+		// Timestamps in nanoseconds, like the server ones
+		var received = Date.now() * 1000000;
+		socket.send(JSON.stringify({command: commands.Pong, sent: message.sent, received: received, replied: Date.now() * 1000000}));
+		break;
+	case commands.LatencyPush:
+		refreshLatency(message);
+		break;
 	default:
 		if (message.command < 0) {
 			logError(message);
@@ -114,6 +210,14 @@ var refreshCurrentUsersCount = function(message){
 	$("#connectedClients").html(`${message.number}`);
 };
 
+// Flag poor links, the latency comes in milliseconds
+const poorLinkRtt = 500;
+
+var refreshLatency = function(message){
+	$("#latency").html(`${message.smoothedRtt.toFixed(1)} ms`);
+	$("#latency").toggleClass("alert-danger", message.smoothedRtt > poorLinkRtt);
+};
+
 // Display a message
 var refreshPidValues = function(message) {
 	var dt = new Date(message.timestamp/1000000);
@@ -237,6 +341,24 @@ var getSignalStateStr = function(sigState){
 	}
 };
 
+// The session expires soon: get a new token and hand it to the server so the socket is kept open
+var refreshToken = function(message){
+	console.log(`The session expires on ${new Date(message.expire)}, refreshing the token`);
+	$.ajax({
+		url: "http://"+window.location.host+"/auth/refresh_token",
+		type: "GET",
+		headers: { Authorization: `Bearer ${token}` },
+		success: function (data) {
+			token = data.token;
+			socket.send(JSON.stringify({command: commands.RefreshToken, token: token}));
+		},
+		error: function (xhRequest, ErrorText, thrownError) {
+			console.warn("Failed to refresh the token, the session will be closed on expiration");
+			console.log(ErrorText);
+		}
+	});
+};
+
 var requestCommand = function(command){
 	obj = {command: command};
 	string = JSON.stringify(obj);
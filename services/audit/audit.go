@@ -0,0 +1,150 @@
+// Package audit records the security relevant actions and the ones of the operators, so admins can tell who did
+// what. The records are only ever added, never changed.
+package audit
+
+import (
+	"context"
+	"fmt"
+	"local/gintest/services/db"
+	"local/gintest/services/dbheap"
+	"log"
+	"time"
+)
+
+// The actions.
+const (
+	UserRegister = "user.register"
+
+	LoginSuccess   = "login.success"
+	LoginFailure   = "login.failure"
+	LoginLockout   = "login.lockout"
+	LoginUnlock    = "login.unlock"
+	LoginChallenge = "login.challenge"
+
+	TokenRefresh    = "token.refresh"
+	SessionLogout   = "session.logout"
+	SessionRevoke   = "session.revoke"
+	WsConnect       = "ws.connect"
+	WsDisconnect    = "ws.disconnect"
+	CommandExecuted = "command"
+
+	UserDisable        = "user.disable"
+	UserEnable         = "user.enable"
+	UserDelete         = "user.delete"
+	UserRoles          = "user.roles"
+	UserPasswordReset  = "user.password_reset"
+	UserPasswordChange = "user.password_change"
+
+	ApiKeyCreate = "apikey.create"
+	ApiKeyRevoke = "apikey.revoke"
+
+	MFAEnroll  = "mfa.enroll"
+	MFADisable = "mfa.disable"
+	MFAReset   = "mfa.reset"
+	MFARoles   = "mfa.roles"
+
+	AuditExport = "audit.export"
+)
+
+// The buffer of the events waiting to be stored, beyond which they're dropped rather than slowing down the
+// audited code.
+const sizeEventsBuffer = 1024
+
+// Event is an Action of Actor on Target, from the address IP. Actor is empty for what the server does on its own.
+type Event struct {
+	Action  string
+	Actor   string
+	Target  string
+	IP      string
+	Details string
+}
+
+// Auditor stores the recorded events in the background.
+type Auditor struct {
+	events chan db.DBAuditEvent
+
+	// Shutdown requests
+	shutdown chan struct{}
+
+	// Closed when every queued event has been stored.
+	done chan struct{}
+}
+
+var auditor = Auditor{
+	events:   make(chan db.DBAuditEvent, sizeEventsBuffer),
+	shutdown: make(chan struct{}),
+	done:     make(chan struct{}),
+}
+
+// Record queues up an event to be stored, timestamped now. It never blocks: when the database can't keep up the
+// event is only logged.
+func Record(event Event) {
+	dbEvent := db.DBAuditEvent{
+		Time:    time.Now(),
+		Action:  event.Action,
+		Actor:   event.Actor,
+		Target:  event.Target,
+		IP:      event.IP,
+		Details: event.Details,
+	}
+	select {
+	case auditor.events <- dbEvent:
+	default:
+		log.Println("AUDIT >>> Queue full, dropping ", format(dbEvent))
+	}
+}
+
+func format(event db.DBAuditEvent) string {
+	return fmt.Sprintf("%s by %q on %q from %s: %s", event.Action, event.Actor, event.Target, event.IP, event.Details)
+}
+
+func store(event db.DBAuditEvent) {
+	session, err := dbheap.GetSession()
+	if err != nil {
+		log.Println("AUDIT >>> Error getting session, losing ", format(event), ": ", err)
+		return
+	}
+	defer session.Close()
+	if err = session.ClientSession.InsertAuditEvent(event); err != nil {
+		log.Println("AUDIT >>> Lost ", format(event))
+	}
+}
+
+func (a *Auditor) run() {
+	for {
+		select {
+		case event := <-a.events:
+			store(event)
+
+			// Store whatever is still queued up before quitting
+		case <-a.shutdown:
+			for n := len(a.events); n > 0; n-- {
+				store(<-a.events)
+			}
+			close(a.done)
+			return
+		}
+	}
+}
+
+// Init starts storing the recorded events. The DB heap must be running.
+func Init() {
+	go auditor.run()
+}
+
+// Shutdown stores the queued events and stops, or gives up when ctx expires. The DB heap must still be running.
+func Shutdown(ctx context.Context) error {
+	select {
+	case auditor.shutdown <- struct{}{}:
+	case <-auditor.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-auditor.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,54 @@
+package backplane
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// The buffer of the channel handing the messages of a topic to its subscriber
+	sizeSubscriptionBuffer = 256
+
+	memoryURL = "memory"
+)
+
+var errClosed = errors.New("The backplane is closed")
+
+// Backplane relays the messages published on a topic to every subscriber of that topic, which may live in other
+// server instances. Delivery is best effort: a subscriber that doesn't keep up loses messages.
+type Backplane interface {
+	// Publish sends message to every current subscriber of topic, including the ones of this same instance.
+	Publish(topic string, message []byte) error
+
+	// Subscribe returns a channel receiving the messages published on topic from now on. The channel is closed
+	// when the backplane is.
+	Subscribe(topic string) (<-chan []byte, error)
+
+	// Close ends every subscription and releases the backplane resources.
+	Close() error
+}
+
+// Dial returns the backplane described by url: "memory" (or an empty url) for the in-process one, or a
+// "redis://host:port" url to share messages with every instance using the same Redis server.
+func Dial(url string) (Backplane, error) {
+	switch {
+	case url == "" || url == memoryURL:
+		return NewMemory(), nil
+	case strings.HasPrefix(url, "redis://") || strings.HasPrefix(url, "rediss://"):
+		return DialRedis(url)
+	default:
+		return nil, fmt.Errorf("Unsupported backplane url %q", url)
+	}
+}
+
+// NewInstanceID returns a random identifier for this server instance, so it can tell its own messages apart.
+func NewInstanceID() string {
+	hostname, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprint(hostname, "-", os.Getpid(), "-", hex.EncodeToString(b))
+}
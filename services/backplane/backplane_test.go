@@ -0,0 +1,84 @@
+package backplane_test
+
+import (
+	"local/gintest/services/backplane"
+	"os"
+	"testing"
+	"time"
+)
+
+const testTopic = "gintest.test"
+
+func redisTestURL() string {
+	if url := os.Getenv("GINTEST_REDIS_URL"); url != "" {
+		return url
+	}
+	return "redis://localhost:6379"
+}
+
+func receive(t *testing.T, messages <-chan []byte) string {
+	select {
+	case message, ok := <-messages:
+		if !ok {
+			t.Fatal("The subscription was closed")
+		}
+		return string(message)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No message was received")
+	}
+	return ""
+}
+
+func testFanOut(t *testing.T, publisher, subscriber backplane.Backplane) {
+	first, err := publisher.Subscribe(testTopic)
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+	second, err := subscriber.Subscribe(testTopic)
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+
+	if err = publisher.Publish(testTopic, []byte("hello")); err != nil {
+		t.Fatal("Error publishing: ", err)
+	}
+	if m := receive(t, first); m != "hello" {
+		t.Error("The publisher's own subscription got ", m)
+	}
+	if m := receive(t, second); m != "hello" {
+		t.Error("The other subscription got ", m)
+	}
+
+	subscriber.Close()
+	select {
+	case _, ok := <-second:
+		if ok {
+			t.Error("Got a message after closing the backplane")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("The subscription wasn't closed along with the backplane")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	bp := backplane.NewMemory()
+	testFanOut(t, bp, bp)
+
+	if err := bp.Publish(testTopic, []byte("late")); err == nil {
+		t.Error("Publishing on a closed backplane didn't fail")
+	}
+}
+
+func TestRedis(t *testing.T) {
+	publisher, err := backplane.DialRedis(redisTestURL())
+	if err != nil {
+		t.Skip("No Redis server available: ", err)
+	}
+	defer publisher.Close()
+
+	subscriber, err := backplane.DialRedis(redisTestURL())
+	if err != nil {
+		t.Fatal("Error dialing the second instance: ", err)
+	}
+	testFanOut(t, publisher, subscriber)
+}
@@ -0,0 +1,60 @@
+package backplane
+
+import (
+	"log"
+	"sync"
+)
+
+// Memory is a Backplane living in the current process. It's the default for a single server instance.
+type Memory struct {
+	mutex       sync.Mutex
+	subscribers map[string][]chan []byte
+	closed      bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{subscribers: make(map[string][]chan []byte)}
+}
+
+func (m *Memory) Publish(topic string, message []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return errClosed
+	}
+	for _, subscriber := range m.subscribers[topic] {
+		select {
+		case subscriber <- message:
+		default:
+			log.Println("BACKPLANE >>> Dropping a message on ", topic, ", subscriber queue full")
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Subscribe(topic string) (<-chan []byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return nil, errClosed
+	}
+	subscriber := make(chan []byte, sizeSubscriptionBuffer)
+	m.subscribers[topic] = append(m.subscribers[topic], subscriber)
+	return subscriber, nil
+}
+
+func (m *Memory) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return errClosed
+	}
+	m.closed = true
+	for topic, subscribers := range m.subscribers {
+		for _, subscriber := range subscribers {
+			close(subscriber)
+		}
+		delete(m.subscribers, topic)
+	}
+	return nil
+}
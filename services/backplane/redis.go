@@ -0,0 +1,162 @@
+package backplane
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	redisConnectTimeout = 5 * time.Second
+	redisMaxIdle        = 4
+	redisIdleTimeout    = 4 * time.Minute
+
+	// Bounds of the wait between attempts to subscribe again after losing the connection
+	redisMinResubscribeWait = 100 * time.Millisecond
+	redisMaxResubscribeWait = 10 * time.Second
+)
+
+// Redis is a Backplane on top of the Redis PUBLISH/SUBSCRIBE commands, shared by every instance using the
+// same server.
+type Redis struct {
+	url  string
+	pool *redis.Pool
+
+	mutex         sync.Mutex
+	subscriptions map[redis.Conn]struct{}
+	closed        chan struct{}
+}
+
+// DialRedis connects to the Redis server at url, like "redis://localhost:6379".
+func DialRedis(url string) (*Redis, error) {
+	r := &Redis{
+		url:           url,
+		subscriptions: make(map[redis.Conn]struct{}),
+		closed:        make(chan struct{}),
+	}
+	r.pool = &redis.Pool{
+		MaxIdle:     redisMaxIdle,
+		IdleTimeout: redisIdleTimeout,
+		Dial:        r.dial,
+	}
+
+	c := r.pool.Get()
+	defer c.Close()
+	if _, err := c.Do("PING"); err != nil {
+		r.pool.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Redis) dial() (redis.Conn, error) {
+	return redis.DialURL(r.url, redis.DialConnectTimeout(redisConnectTimeout))
+}
+
+func (r *Redis) Publish(topic string, message []byte) error {
+	c := r.pool.Get()
+	defer c.Close()
+	_, err := c.Do("PUBLISH", topic, message)
+	return err
+}
+
+func (r *Redis) Subscribe(topic string) (<-chan []byte, error) {
+	psc, err := r.subscribe(topic)
+	if err != nil {
+		return nil, err
+	}
+	messages := make(chan []byte, sizeSubscriptionBuffer)
+	go r.receive(topic, psc, messages)
+	return messages, nil
+}
+
+// subscribe opens a dedicated connection subscribed to topic. Subscribed connections can't run other commands,
+// so they don't come from the pool.
+func (r *Redis) subscribe(topic string) (redis.PubSubConn, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	select {
+	case <-r.closed:
+		return redis.PubSubConn{}, errClosed
+	default:
+	}
+
+	c, err := r.dial()
+	if err != nil {
+		return redis.PubSubConn{}, err
+	}
+	psc := redis.PubSubConn{Conn: c}
+	if err = psc.Subscribe(topic); err != nil {
+		c.Close()
+		return redis.PubSubConn{}, err
+	}
+	// Wait for the confirmation, so nothing published after Subscribe returns is missed
+	if err, ok := psc.ReceiveWithTimeout(redisConnectTimeout).(error); ok {
+		c.Close()
+		return redis.PubSubConn{}, err
+	}
+	r.subscriptions[c] = struct{}{}
+	return psc, nil
+}
+
+func (r *Redis) unsubscribe(psc redis.PubSubConn) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.subscriptions, psc.Conn)
+	psc.Close()
+}
+
+// receive forwards the messages of the subscribed connection until the backplane is closed, subscribing again
+// whenever the connection is lost.
+func (r *Redis) receive(topic string, psc redis.PubSubConn, messages chan<- []byte) {
+	defer close(messages)
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			select {
+			case messages <- v.Data:
+			default:
+				log.Println("REDIS BACKPLANE >>> Dropping a message on ", topic, ", subscriber queue full")
+			}
+
+		case error:
+			r.unsubscribe(psc)
+			wait := redisMinResubscribeWait
+			for {
+				select {
+				case <-r.closed:
+					return
+				case <-time.After(wait):
+				}
+				var err error
+				if psc, err = r.subscribe(topic); err == nil {
+					break
+				}
+				log.Println("REDIS BACKPLANE >>> Error subscribing again to ", topic, ": ", err)
+				if wait *= 2; wait > redisMaxResubscribeWait {
+					wait = redisMaxResubscribeWait
+				}
+			}
+			log.Println("REDIS BACKPLANE >>> Subscribed again to ", topic)
+		}
+	}
+}
+
+func (r *Redis) Close() error {
+	r.mutex.Lock()
+	select {
+	case <-r.closed:
+		r.mutex.Unlock()
+		return errClosed
+	default:
+	}
+	close(r.closed)
+	for c := range r.subscriptions {
+		c.Close()
+		delete(r.subscriptions, c)
+	}
+	r.mutex.Unlock()
+	return r.pool.Close()
+}
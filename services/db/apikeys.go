@@ -0,0 +1,81 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const apiKeysCName = "apikeys"
+
+var apiKeysIndexes = []mgo.Index{
+	{Key: []string{"keyid"}, Unique: true},
+	{Key: []string{"userid"}},
+	// The expired keys are dropped
+	{Key: []string{"expiresat"}, ExpireAfter: time.Second},
+}
+
+// DBApiKey is an API key of a user. Only the hash of its secret is kept.
+type DBApiKey struct {
+	KeyID        string
+	UserID       string
+	Name         string
+	HashedSecret string
+	Scopes       []string
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+	LastUsedAt   time.Time `bson:",omitempty"`
+}
+
+func (d *DB) InsertApiKey(key DBApiKey) error {
+	err := d.apiKeysC.Insert(&key)
+	if err != nil {
+		log.Println("Error inserting Api Key: ", err)
+	}
+	return err
+}
+
+func (d *DB) GetApiKey(keyID string, data *DBApiKey) error {
+	err := d.apiKeysC.Find(bson.M{"keyid": keyID}).One(data)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error Getting Api Key: ", err)
+	}
+	return err
+}
+
+// GetUserApiKeys returns the keys of a user, the newest first.
+func (d *DB) GetUserApiKeys(userID string, data *[]DBApiKey) error {
+	err := d.apiKeysC.Find(bson.M{"userid": userID}).Sort("-createdat").All(data)
+	if err != nil {
+		log.Println("Error Getting Api Keys: ", err)
+	}
+	return err
+}
+
+// TouchApiKey records that a key was used at now, unless it was less than precision ago, to spare a write on
+// every request.
+func (d *DB) TouchApiKey(keyID string, now time.Time, precision time.Duration) error {
+	err := d.apiKeysC.Update(bson.M{
+		"keyid": keyID,
+		"$or": []bson.M{
+			{"lastusedat": bson.M{"$exists": false}},
+			{"lastusedat": bson.M{"$lt": now.Add(-precision)}},
+		},
+	}, bson.M{"$set": bson.M{"lastusedat": now}})
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error touching Api Key: ", err)
+		return err
+	}
+	return nil
+}
+
+// DeleteApiKey deletes a key of a user, returning mgo.ErrNotFound if the user has no such key.
+func (d *DB) DeleteApiKey(keyID string, userID string) error {
+	err := d.apiKeysC.Remove(bson.M{"keyid": keyID, "userid": userID})
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error deleting Api Key: ", err)
+	}
+	return err
+}
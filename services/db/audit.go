@@ -0,0 +1,97 @@
+package db
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const auditCName = "audit"
+
+var auditIndexes = []mgo.Index{
+	{Key: []string{"-time"}},
+	{Key: []string{"actor", "-time"}},
+	{Key: []string{"action", "-time"}},
+}
+
+// DBAuditEvent records an action of Actor on Target, from the address IP. The events are only ever inserted.
+type DBAuditEvent struct {
+	Time    time.Time
+	Action  string
+	Actor   string
+	Target  string
+	IP      string
+	Details string `bson:",omitempty"`
+}
+
+// DBAuditFilter selects the audit events matching every field that's set. An Action ending with * matches the
+// actions starting with the rest, like "user.*".
+type DBAuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	IP     string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f DBAuditFilter) query() bson.M {
+	query := bson.M{}
+	if f.Actor != "" {
+		query["actor"] = f.Actor
+	}
+	if strings.HasSuffix(f.Action, "*") {
+		query["action"] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(strings.TrimSuffix(f.Action, "*"))}
+	} else if f.Action != "" {
+		query["action"] = f.Action
+	}
+	if f.Target != "" {
+		query["target"] = f.Target
+	}
+	if f.IP != "" {
+		query["ip"] = f.IP
+	}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		timeRange := bson.M{}
+		if !f.Since.IsZero() {
+			timeRange["$gte"] = f.Since
+		}
+		if !f.Until.IsZero() {
+			timeRange["$lt"] = f.Until
+		}
+		query["time"] = timeRange
+	}
+	return query
+}
+
+func (d *DB) InsertAuditEvent(event DBAuditEvent) error {
+	err := d.auditC.Insert(&event)
+	if err != nil {
+		log.Println("Error inserting Audit Event: ", err)
+	}
+	return err
+}
+
+// GetAuditEvents returns a page of the events matching filter, the newest first, with the number of matching ones.
+func (d *DB) GetAuditEvents(filter DBAuditFilter, skip int, limit int, data *[]DBAuditEvent) (int, error) {
+	query := d.auditC.Find(filter.query())
+	total, err := query.Count()
+	if err != nil {
+		log.Println("Error Counting Audit Events: ", err)
+		return 0, err
+	}
+	err = query.Sort("-time").Skip(skip).Limit(limit).All(data)
+	if err != nil {
+		log.Println("Error Getting Audit Events: ", err)
+	}
+	return total, err
+}
+
+// IterAuditEvents iterates over the events matching filter, the oldest first.
+func (d *DB) IterAuditEvents(filter DBAuditFilter) *mgo.Iter {
+	return d.auditC.Find(filter.query()).Sort("time").Iter()
+}
@@ -0,0 +1,30 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAuditFilterQuery(t *testing.T) {
+	if query := (DBAuditFilter{}).query(); len(query) != 0 {
+		t.Error("An empty filter must match everything: ", query)
+	}
+
+	since := time.Now().Add(-time.Hour)
+	query := DBAuditFilter{Actor: "admin", Action: "user.*", Since: since}.query()
+	if query["actor"] != "admin" {
+		t.Error("Wrong actor: ", query)
+	}
+	if regex, ok := query["action"].(bson.RegEx); !ok || regex.Pattern != `^user\.` {
+		t.Error("The action prefix isn't a regular expression: ", query["action"])
+	}
+	timeRange, ok := query["time"].(bson.M)
+	if !ok || timeRange["$gte"] != since || timeRange["$lt"] != nil {
+		t.Error("Wrong time range: ", query["time"])
+	}
+	if query := (DBAuditFilter{Action: "login.failure"}).query(); query["action"] != "login.failure" {
+		t.Error("Wrong action: ", query)
+	}
+}
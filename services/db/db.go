@@ -15,6 +15,8 @@ const (
 	samplesCName = "samples"
 	pidsCName    = "pids"
 	usersCName   = "users"
+
+	revocationsCName = "revocations"
 )
 
 var usersIndex = mgo.Index{
@@ -25,9 +27,52 @@ var usersIndex = mgo.Index{
 	Sparse:     true,
 }
 
+var identitiesIndex = mgo.Index{
+	Key:    []string{"identities.issuer", "identities.subject"},
+	Unique: true,
+	Sparse: true,
+}
+
+// The revocations are dropped by Mongo once the tokens they revoke can no longer be used
+var revocationsIndex = mgo.Index{
+	Key:         []string{"expiresat"},
+	ExpireAfter: time.Second,
+}
+
 type DBUser struct {
 	Username       string
 	HashedPassword string
+
+	// The names of the roles granted to the user, see the rbac package
+	Roles []string `bson:",omitempty"`
+
+	// Disabled users can't log in
+	Disabled bool `bson:",omitempty"`
+
+	// The accounts of the user on OpenID Connect providers
+	Identities []DBIdentity `bson:",omitempty"`
+
+	// The second factor of the user, asked for at login once confirmed
+	TOTP *DBTOTP `bson:",omitempty"`
+
+	CreatedAt         time.Time `bson:",omitempty"`
+	UpdatedAt         time.Time `bson:",omitempty"`
+	PasswordChangedAt time.Time `bson:",omitempty"`
+}
+
+// DBIdentity is an account on an OpenID Connect provider, told apart by the issuer and the subject.
+type DBIdentity struct {
+	Issuer  string
+	Subject string
+}
+
+// DBRevocation revokes the tokens of a session of a user or, without a session ID, the tokens of every session of
+// the user started up to Before.
+type DBRevocation struct {
+	UserID    string
+	SessionID string
+	Before    time.Time
+	ExpiresAt time.Time
 }
 
 type DBSample struct {
@@ -54,6 +99,14 @@ type DB struct {
 	pidsC    *mgo.Collection
 	usersC   *mgo.Collection
 	ok       bool
+
+	revocationsC   *mgo.Collection
+	loginFailuresC *mgo.Collection
+	auditC         *mgo.Collection
+	apiKeysC       *mgo.Collection
+	mfaChallengesC *mgo.Collection
+	settingsC      *mgo.Collection
+	wsTicketsC     *mgo.Collection
 }
 
 func (d *DB) Copy() (*DB, error) {
@@ -94,6 +147,14 @@ func (d *DB) setup(session *mgo.Session) (*DB, error) {
 		pidsC:    pidsC,
 		usersC:   usersC,
 		ok:       true,
+
+		revocationsC:   db.C(revocationsCName),
+		loginFailuresC: db.C(loginFailuresCName),
+		auditC:         db.C(auditCName),
+		apiKeysC:       db.C(apiKeysCName),
+		mfaChallengesC: db.C(mfaChallengesCName),
+		settingsC:      db.C(settingsCName),
+		wsTicketsC:     db.C(wsTicketsCName),
 	}, nil
 }
 
@@ -138,6 +199,88 @@ func (d *DB) GetUser(username string, data *DBUser) error {
 	return err
 }
 
+// GetUserByIdentity returns the user with an account on an OpenID Connect provider, or mgo.ErrNotFound.
+func (d *DB) GetUserByIdentity(issuer string, subject string, data *DBUser) error {
+	err := d.usersC.Find(bson.M{"identities": bson.M{"$elemMatch": bson.M{"issuer": issuer, "subject": subject}}}).One(data)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error Getting User by Identity: ", err)
+	}
+	return err
+}
+
+// GetUsers returns every user sorted by username, without the password hashes.
+func (d *DB) GetUsers(data *[]DBUser) error {
+	err := d.usersC.Find(nil).Select(bson.M{"hashedpassword": 0}).Sort("username").All(data)
+	if err != nil {
+		log.Println("Error Getting Users: ", err)
+	}
+	return err
+}
+
+// updateUser sets fields of a user, returning mgo.ErrNotFound if there's no such user.
+func (d *DB) updateUser(username string, fields bson.M) error {
+	err := d.usersC.Update(bson.M{"username": username}, bson.M{"$set": fields})
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error updating User: ", err)
+	}
+	return err
+}
+
+func (d *DB) SetUserDisabled(username string, disabled bool, now time.Time) error {
+	return d.updateUser(username, bson.M{"disabled": disabled, "updatedat": now})
+}
+
+func (d *DB) SetUserRoles(username string, roles []string, now time.Time) error {
+	return d.updateUser(username, bson.M{"roles": roles, "updatedat": now})
+}
+
+func (d *DB) SetUserPassword(username string, hashedPassword string, now time.Time) error {
+	return d.updateUser(username, bson.M{"hashedpassword": hashedPassword, "passwordchangedat": now, "updatedat": now})
+}
+
+// DeleteUser deletes a user with its API keys, its pending second factor challenges and its websocket tickets,
+// returning mgo.ErrNotFound if there's no such user.
+func (d *DB) DeleteUser(username string) error {
+	err := d.usersC.Remove(bson.M{"username": username})
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			log.Println("Error deleting User: ", err)
+		}
+		return err
+	}
+	for _, c := range []*mgo.Collection{d.apiKeysC, d.mfaChallengesC, d.wsTicketsC} {
+		if _, err = c.RemoveAll(bson.M{"userid": username}); err != nil {
+			log.Println("Error deleting what belongs to the User: ", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DB) InsertRevocation(revocation DBRevocation) error {
+	err := d.revocationsC.Insert(&revocation)
+	if err != nil {
+		log.Println("Error inserting Revocation: ", err)
+	}
+	return err
+}
+
+// IsRevoked tells whether the tokens of a session of a user, started at startedAt, were revoked. The sessions are
+// revoked with every session started before a time.
+func (d *DB) IsRevoked(userID string, sessionID string, startedAt time.Time) (bool, error) {
+	n, err := d.revocationsC.Find(bson.M{
+		"userid": userID,
+		"$or": []bson.M{
+			{"sessionid": sessionID},
+			{"sessionid": "", "before": bson.M{"$gt": startedAt}},
+		},
+	}).Count()
+	if err != nil {
+		log.Println("Error Counting Revocations: ", err)
+	}
+	return n > 0, err
+}
+
 func Dial() (*DB, error) {
 	session, err := mgo.Dial(mongoURL)
 	if err != nil {
@@ -153,6 +296,50 @@ func Dial() (*DB, error) {
 	if err != nil {
 		panic(err)
 	}
+	err = usersC.EnsureIndex(identitiesIndex)
+	if err != nil {
+		panic(err)
+	}
+	revocationsC := db.C(revocationsCName)
+	err = revocationsC.EnsureIndex(revocationsIndex)
+	if err != nil {
+		panic(err)
+	}
+	loginFailuresC := db.C(loginFailuresCName)
+	for _, index := range loginFailuresIndexes {
+		err = loginFailuresC.EnsureIndex(index)
+		if err != nil {
+			panic(err)
+		}
+	}
+	auditC := db.C(auditCName)
+	for _, index := range auditIndexes {
+		err = auditC.EnsureIndex(index)
+		if err != nil {
+			panic(err)
+		}
+	}
+	apiKeysC := db.C(apiKeysCName)
+	for _, index := range apiKeysIndexes {
+		err = apiKeysC.EnsureIndex(index)
+		if err != nil {
+			panic(err)
+		}
+	}
+	mfaChallengesC := db.C(mfaChallengesCName)
+	for _, index := range mfaChallengesIndexes {
+		err = mfaChallengesC.EnsureIndex(index)
+		if err != nil {
+			panic(err)
+		}
+	}
+	wsTicketsC := db.C(wsTicketsCName)
+	for _, index := range wsTicketsIndexes {
+		err = wsTicketsC.EnsureIndex(index)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	return &DB{
 		session:  session,
@@ -161,6 +348,14 @@ func Dial() (*DB, error) {
 		pidsC:    pidsC,
 		usersC:   usersC,
 		ok:       true,
+
+		revocationsC:   revocationsC,
+		loginFailuresC: loginFailuresC,
+		auditC:         auditC,
+		apiKeysC:       apiKeysC,
+		mfaChallengesC: mfaChallengesC,
+		settingsC:      db.C(settingsCName),
+		wsTicketsC:     wsTicketsC,
 	}, nil
 }
 
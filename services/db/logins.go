@@ -0,0 +1,90 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const loginFailuresCName = "loginfailures"
+
+var loginFailuresIndexes = []mgo.Index{
+	{Key: []string{"key"}, Unique: true},
+	// The failures are forgotten once they expire
+	{Key: []string{"expiresat"}, ExpireAfter: time.Second},
+}
+
+// DBLoginFailures counts the logins of a username or of a source address not known to have succeeded, told apart by
+// Key. Every attempt is counted before its credentials are checked, and taken back once they're right.
+type DBLoginFailures struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+	ExpiresAt   time.Time
+}
+
+// RecordLoginAttempt counts a login attempt of key at now, atomically so that every instance and every concurrent
+// attempt sees the others, and returns the failures as they were before it.
+func (d *DB) RecordLoginAttempt(key string, now time.Time, expiresAt time.Time) (DBLoginFailures, error) {
+	var previous DBLoginFailures
+	_, err := d.loginFailuresC.Find(bson.M{"key": key}).Apply(mgo.Change{
+		Update: bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{"lastfailure": now, "expiresat": expiresAt},
+		},
+		Upsert: true,
+	}, &previous)
+	if err != nil {
+		log.Println("Error recording Login Attempt: ", err)
+	}
+	return previous, err
+}
+
+// ForgiveLoginAttempt takes back an attempt of key whose credentials were right, returning mgo.ErrNotFound if
+// there are none left.
+func (d *DB) ForgiveLoginAttempt(key string) error {
+	err := d.loginFailuresC.Update(bson.M{"key": key, "failures": bson.M{"$gt": 0}}, bson.M{"$inc": bson.M{"failures": -1}})
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error forgiving Login Attempt: ", err)
+	}
+	return err
+}
+
+// LockLogin refuses the logins of key until until.
+func (d *DB) LockLogin(key string, until time.Time) error {
+	err := d.loginFailuresC.Update(bson.M{"key": key}, bson.M{"$set": bson.M{"lockeduntil": until, "expiresat": until}})
+	if err != nil {
+		log.Println("Error locking Login: ", err)
+	}
+	return err
+}
+
+// GetLoginFailures returns the failures of the keys that have any.
+func (d *DB) GetLoginFailures(keys []string, data *[]DBLoginFailures) error {
+	err := d.loginFailuresC.Find(bson.M{"key": bson.M{"$in": keys}}).All(data)
+	if err != nil {
+		log.Println("Error Getting Login Failures: ", err)
+	}
+	return err
+}
+
+// GetLockedLogins returns the keys locked out at now.
+func (d *DB) GetLockedLogins(now time.Time, data *[]DBLoginFailures) error {
+	err := d.loginFailuresC.Find(bson.M{"lockeduntil": bson.M{"$gt": now}}).Sort("lockeduntil").All(data)
+	if err != nil {
+		log.Println("Error Getting Locked Logins: ", err)
+	}
+	return err
+}
+
+// ClearLoginFailures forgets the failures of key, returning mgo.ErrNotFound if there were none.
+func (d *DB) ClearLoginFailures(key string) error {
+	err := d.loginFailuresC.Remove(bson.M{"key": key})
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error clearing Login Failures: ", err)
+	}
+	return err
+}
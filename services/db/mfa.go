@@ -0,0 +1,173 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	mfaChallengesCName = "mfachallenges"
+	settingsCName      = "settings"
+
+	mfaSettingsID = "mfa"
+)
+
+var mfaChallengesIndexes = []mgo.Index{
+	{Key: []string{"challengeid"}, Unique: true},
+	// The challenges left unanswered are dropped
+	{Key: []string{"expiresat"}, ExpireAfter: time.Second},
+}
+
+// DBTOTP is the TOTP second factor of a user, only asked for once it's confirmed with a first code. The last step a
+// code was accepted for is kept so that no code is accepted twice, and only the hashes of the recovery codes.
+type DBTOTP struct {
+	Secret        string
+	Confirmed     bool
+	LastStep      int64
+	RecoveryCodes []string `bson:",omitempty"`
+	EnrolledAt    time.Time
+}
+
+// DBMFAChallenge is a login that passed the password check and waits for the second factor.
+type DBMFAChallenge struct {
+	ChallengeID string
+	UserID      string
+	Attempts    int
+	ExpiresAt   time.Time
+}
+
+// DBMFASettings are the roles whose users must log in with a second factor.
+type DBMFASettings struct {
+	ID        string `bson:"_id"`
+	Roles     []string
+	UpdatedAt time.Time
+	UpdatedBy string
+}
+
+// EnrollTOTP starts the enrollment of a TOTP secret for a user, replacing one not confirmed yet. It returns
+// mgo.ErrNotFound if there's no such user or its second factor is already confirmed.
+func (d *DB) EnrollTOTP(username string, secret string, now time.Time) error {
+	err := d.usersC.Update(
+		bson.M{"username": username, "totp.confirmed": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"totp": DBTOTP{Secret: secret, EnrolledAt: now}, "updatedat": now}},
+	)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error enrolling TOTP: ", err)
+	}
+	return err
+}
+
+// ConfirmTOTP confirms the enrollment of secret with a code of step, keeping the hashes of the recovery codes. It
+// returns mgo.ErrNotFound if the user isn't enrolling that secret anymore.
+func (d *DB) ConfirmTOTP(username string, secret string, step int64, recoveryCodes []string, now time.Time) error {
+	err := d.usersC.Update(
+		bson.M{"username": username, "totp.secret": secret, "totp.confirmed": false},
+		bson.M{"$set": bson.M{
+			"totp.confirmed":     true,
+			"totp.laststep":      step,
+			"totp.recoverycodes": recoveryCodes,
+			"totp.enrolledat":    now,
+			"updatedat":          now,
+		}},
+	)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error confirming TOTP: ", err)
+	}
+	return err
+}
+
+// UseTOTPStep records that a code of step was accepted, atomically so that the same code can't log in twice even
+// through two instances. It returns mgo.ErrNotFound if a code of that step or a later one was already used.
+func (d *DB) UseTOTPStep(username string, step int64) error {
+	err := d.usersC.Update(
+		bson.M{"username": username, "totp.confirmed": true, "totp.laststep": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"totp.laststep": step}},
+	)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error using TOTP step: ", err)
+	}
+	return err
+}
+
+// UseRecoveryCode consumes the recovery code of a user with the given hash. It returns mgo.ErrNotFound if the user
+// has no such code left.
+func (d *DB) UseRecoveryCode(username string, hashedCode string) error {
+	err := d.usersC.Update(
+		bson.M{"username": username, "totp.confirmed": true, "totp.recoverycodes": hashedCode},
+		bson.M{"$pull": bson.M{"totp.recoverycodes": hashedCode}},
+	)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error using Recovery Code: ", err)
+	}
+	return err
+}
+
+// ClearTOTP removes the second factor of a user, returning mgo.ErrNotFound if there's no such user.
+func (d *DB) ClearTOTP(username string, now time.Time) error {
+	err := d.usersC.Update(bson.M{"username": username}, bson.M{
+		"$unset": bson.M{"totp": ""},
+		"$set":   bson.M{"updatedat": now},
+	})
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error clearing TOTP: ", err)
+	}
+	return err
+}
+
+func (d *DB) InsertMFAChallenge(challenge DBMFAChallenge) error {
+	err := d.mfaChallengesC.Insert(&challenge)
+	if err != nil {
+		log.Println("Error inserting MFA Challenge: ", err)
+	}
+	return err
+}
+
+// AttemptMFAChallenge counts an attempt to answer a challenge and returns it, or mgo.ErrNotFound if it expired or
+// was attempted maxAttempts times already.
+func (d *DB) AttemptMFAChallenge(challengeID string, maxAttempts int, now time.Time) (DBMFAChallenge, error) {
+	var challenge DBMFAChallenge
+	_, err := d.mfaChallengesC.Find(bson.M{
+		"challengeid": challengeID,
+		"attempts":    bson.M{"$lt": maxAttempts},
+		"expiresat":   bson.M{"$gt": now},
+	}).Apply(mgo.Change{Update: bson.M{"$inc": bson.M{"attempts": 1}}, ReturnNew: true}, &challenge)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error attempting MFA Challenge: ", err)
+	}
+	return challenge, err
+}
+
+// DeleteMFAChallenge ends a challenge. Only the first of concurrent calls succeeds, the others get
+// mgo.ErrNotFound, so a challenge logs in once.
+func (d *DB) DeleteMFAChallenge(challengeID string) error {
+	err := d.mfaChallengesC.Remove(bson.M{"challengeid": challengeID})
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error deleting MFA Challenge: ", err)
+	}
+	return err
+}
+
+// GetMFASettings returns the enforcement of the second factor, none if it was never set.
+func (d *DB) GetMFASettings(data *DBMFASettings) error {
+	err := d.settingsC.FindId(mfaSettingsID).One(data)
+	if err == mgo.ErrNotFound {
+		*data = DBMFASettings{ID: mfaSettingsID}
+		return nil
+	}
+	if err != nil {
+		log.Println("Error Getting MFA Settings: ", err)
+	}
+	return err
+}
+
+func (d *DB) SetMFASettings(settings DBMFASettings) error {
+	settings.ID = mfaSettingsID
+	_, err := d.settingsC.UpsertId(mfaSettingsID, &settings)
+	if err != nil {
+		log.Println("Error setting MFA Settings: ", err)
+	}
+	return err
+}
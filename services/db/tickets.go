@@ -0,0 +1,49 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const wsTicketsCName = "wstickets"
+
+var wsTicketsIndexes = []mgo.Index{
+	{Key: []string{"tickethash"}, Unique: true},
+	// The tickets never redeemed are dropped
+	{Key: []string{"expiresat"}, ExpireAfter: time.Second},
+}
+
+// DBWsTicket opens a single websocket connection for the session of the token it was issued to. Only the hash of
+// the ticket is kept.
+type DBWsTicket struct {
+	TicketHash       string
+	UserID           string
+	SessionID        string
+	Roles            []string
+	SessionStart     time.Time
+	SessionExpiresAt time.Time
+	ExpiresAt        time.Time
+}
+
+func (d *DB) InsertWsTicket(ticket DBWsTicket) error {
+	err := d.wsTicketsC.Insert(&ticket)
+	if err != nil {
+		log.Println("Error inserting WS Ticket: ", err)
+	}
+	return err
+}
+
+// RedeemWsTicket removes the ticket with the given hash and returns it, atomically so that it's redeemed once even
+// by concurrent requests to several instances. It returns mgo.ErrNotFound if there's no such ticket valid at now.
+func (d *DB) RedeemWsTicket(ticketHash string, now time.Time) (DBWsTicket, error) {
+	var ticket DBWsTicket
+	_, err := d.wsTicketsC.Find(bson.M{"tickethash": ticketHash, "expiresat": bson.M{"$gt": now}}).
+		Apply(mgo.Change{Remove: true}, &ticket)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Error redeeming WS Ticket: ", err)
+	}
+	return ticket, err
+}
@@ -2,6 +2,7 @@ package dbheap
 
 import (
 	"container/heap"
+	"context"
 	"errors"
 	"fmt"
 	"local/gintest/services/db"
@@ -60,34 +61,41 @@ type ClientHeapSession struct {
 	copiedSession *db.DB
 	ClientSession *db.DB
 	closeChannel  chan<- *ClientHeapSession
+	heapDone      <-chan struct{}
 }
 
 type DbHeap struct {
 	maxConcurrentSessions int
-	isRunning             bool
 	masterDbSession       *db.DB
 
 	newDBSession   chan chan *ClientHeapSession
 	closeDBSession chan *ClientHeapSession
+
+	shutdown chan struct{}
+	// Closed by the hub once it stopped, so that nobody waits for it anymore
+	done chan struct{}
 }
 
 func NewDbHeap(maxConcurrentSessions int, masterSession *db.DB) *DbHeap {
 	return &DbHeap{
 		maxConcurrentSessions: maxConcurrentSessions,
-		isRunning:             false,
 		masterDbSession:       masterSession,
 		newDBSession:          make(chan chan *ClientHeapSession),
 		closeDBSession:        make(chan *ClientHeapSession),
+		shutdown:              make(chan struct{}),
+		done:                  make(chan struct{}),
 	}
 }
 
+// GetSession returns a session cloned from the least used copy. It waits for the hub, which must be running.
 func (dbh *DbHeap) GetSession() (*ClientHeapSession, error) {
-	if !dbh.isRunning {
-		return nil, errors.New("The DB Heap is not running")
-	}
 	ch := make(chan *ClientHeapSession)
-	dbh.newDBSession <- ch
-	return <-ch, nil
+	select {
+	case dbh.newDBSession <- ch:
+		return <-ch, nil
+	case <-dbh.done:
+		return nil, errors.New("The DB Heap is shut down")
+	}
 }
 
 func GetSession() (*ClientHeapSession, error) {
@@ -98,7 +106,34 @@ func (i *ClientHeapSession) Close() {
 	if i.closeChannel == nil {
 		return
 	}
-	i.closeChannel <- i
+	select {
+	case i.closeChannel <- i:
+	case <-i.heapDone:
+		// The heap already closed every copied session, only the clone is left
+		i.ClientSession.Close()
+	}
+}
+
+// Shutdown closes every session of the heap, including the master one. Client sessions still open are closed
+// as they are returned.
+func (dbh *DbHeap) Shutdown(ctx context.Context) error {
+	select {
+	case dbh.shutdown <- struct{}{}:
+	case <-dbh.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-dbh.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func Shutdown(ctx context.Context) error {
+	return globalDBHeap.Shutdown(ctx)
 }
 
 func (dbh *DbHeap) runHub() {
@@ -132,6 +167,7 @@ func (dbh *DbHeap) runHub() {
 				copiedSession: item.copiedSession,
 				ClientSession: clonnedSession,
 				closeChannel:  dbh.closeDBSession,
+				heapDone:      dbh.done,
 			}
 		case clientClose := <-dbh.closeDBSession:
 
@@ -151,6 +187,14 @@ func (dbh *DbHeap) runHub() {
 			clientClose.ClientSession = nil
 			clientClose.copiedSession = nil
 			clientClose.closeChannel = nil
+
+		case <-dbh.shutdown:
+			for _, item := range queue {
+				item.copiedSession.Close()
+			}
+			dbh.masterDbSession.Close()
+			close(dbh.done)
+			return
 		}
 	}
 }
@@ -158,7 +202,6 @@ func (dbh *DbHeap) runHub() {
 func (dbh *DbHeap) Run() {
 
 	go dbh.runHub()
-	dbh.isRunning = true
 }
 
 func init() {
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"local/gintest/apicommands"
+	"local/gintest/services/db"
+	"local/gintest/services/stats"
 	"local/gintest/wslogic"
 	"log"
 	"math"
@@ -21,6 +23,9 @@ const (
 
 var (
 	pidIndexCounter int32
+
+	tickerUpdatesCounter = stats.NewCounter("pid.tickerUpdates")
+	updateListsCounter   = stats.NewCounter("pid.updateLists")
 )
 
 type ApiUpdate struct {
@@ -195,6 +200,7 @@ func (t *DummyPIDTicker) Launch() {
 				// Ticker signal, continue normal ticking
 			case now := <-ticker.C:
 				nTicks++
+				tickerUpdatesCounter.Inc()
 				//t.log("Got a tick for Dummy Ticker ", t.pidData.Name)
 				data.LastUpdated = now.UnixNano()
 				data.Value, data.State = t.getValueAndState()
@@ -216,16 +222,5 @@ func (t *DummyPIDTicker) Launch() {
 }
 
 func standardTickHandler(data PidData) {
-	/*
-		d, err := dbheap.GetSession()
-		if err != nil {
-			log.Println("Error getting session ", err)
-			return
-		}
-		defer d.Close()
-		err = d.ClientSession.InsertSamples(&db.DBSample{Pid: data.Index, Value: data.Value, Timestamp: data.LastUpdated})
-		if err != nil {
-			log.Println("Error inserting sample ", err)
-		}
-	*/
+	recorder.record(&db.DBSample{Pid: data.Index, Value: data.Value, Timestamp: data.LastUpdated})
 }
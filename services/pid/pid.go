@@ -1,6 +1,7 @@
 package pid
 
 import (
+	"context"
 	"fmt"
 	"local/gintest/apicommands"
 	"local/gintest/commons"
@@ -16,22 +17,19 @@ const (
 	debugWithTimeStamp = commons.DebugWithTimeStamp
 
 	pidListUpdateTimePeriod = time.Millisecond * 250
+
+	unavailablePidsHubStatus wslogic.ResponseStatusType = -1
 )
 
-type PidType int
+type PidType = apicommands.PidType
 
 const (
-	AnalogicalPidType PidType = iota
-	DiscretePidType
-	DigitalPidType
+	AnalogicalPidType = apicommands.AnalogicalPidType
+	DiscretePidType   = apicommands.DiscretePidType
+	DigitalPidType    = apicommands.DigitalPidType
 )
 
-type PidStaticData struct {
-	Name         string        `json:"name"`
-	Index        int           `json:"index"`
-	Type         PidType       `json:"type"`
-	SamplePeriod time.Duration `json:"period"`
-}
+type PidStaticData = apicommands.PidStaticData
 
 func NewPidStaticData(name string, index int, typ PidType, period time.Duration) PidStaticData {
 	return PidStaticData{
@@ -42,26 +40,17 @@ func NewPidStaticData(name string, index int, typ PidType, period time.Duration)
 	}
 }
 
-type PidState int
+type PidState = apicommands.PidState
 
-const InternalErrorPidState = -1
+const InternalErrorPidState = apicommands.InternalErrorPidState
 const (
-	NeverUpdatedPidState PidState = iota
-	OkPidState
-	BadPidState
+	NeverUpdatedPidState = apicommands.NeverUpdatedPidState
+	OkPidState           = apicommands.OkPidState
+	BadPidState          = apicommands.BadPidState
 )
 
-type PidDynamicData struct {
-	Value       float32  `json:"value"`
-	State       PidState `json:"state"`
-	Updates     int      `json:"-"`
-	LastUpdated int64    `json:"timestamp"`
-}
-
-type PidData struct {
-	PidStaticData
-	PidDynamicData
-}
+type PidDynamicData = apicommands.PidDynamicData
+type PidData = apicommands.PidData
 
 type PidsHub struct {
 	subscribe   chan *DummyPIDTicker
@@ -69,6 +58,12 @@ type PidsHub struct {
 
 	incomingPidListRequest       chan wslogic.CommandRequest
 	incomingPidListUpdateRequest chan wslogic.CommandRequest
+
+	// Shutdown requests
+	shutdown chan struct{}
+
+	// Closed when the hub stops running.
+	done chan struct{}
 }
 
 func (h *PidsHub) log(v ...interface{}) {
@@ -98,19 +93,51 @@ var pidsHub = PidsHub{
 
 	incomingPidListRequest:       make(chan wslogic.CommandRequest),
 	incomingPidListUpdateRequest: make(chan wslogic.CommandRequest),
+
+	shutdown: make(chan struct{}),
+	done:     make(chan struct{}),
 }
 
 func Subscribe(pid *DummyPIDTicker) {
-	pidsHub.subscribe <- pid
+	select {
+	case pidsHub.subscribe <- pid:
+	case <-pidsHub.done:
+	}
 }
 
 func Unsubscribe(pid *DummyPIDTicker) {
-	pidsHub.unsubscribe <- pid
+	select {
+	case pidsHub.unsubscribe <- pid:
+	case <-pidsHub.done:
+	}
 }
 
 func RequestPidList(request wslogic.CommandRequest) wslogic.RawResponseData {
-	pidsHub.incomingPidListRequest <- request
-	return request.ReceiveCommandResponse()
+	select {
+	case pidsHub.incomingPidListRequest <- request:
+		return request.ReceiveCommandResponse()
+	case <-pidsHub.done:
+		responseStruct := wslogic.NewApiResponseHeader(apicommands.ServerCompleteSignalList, unavailablePidsHubStatus, "The PIDs hub is shut down")
+		responseData, _ := responseStruct.Stringify()
+		return responseData
+	}
+}
+
+// stop stops every subscribed ticker and the hub itself, waiting until it's done or ctx expires.
+func (h *PidsHub) stop(ctx context.Context) error {
+	select {
+	case h.shutdown <- struct{}{}:
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (h *PidsHub) runPidsHub() {
@@ -119,6 +146,7 @@ func (h *PidsHub) runPidsHub() {
 
 	dummyTickersMap := make(map[int]*DummyPIDTicker)
 	ticker := time.NewTicker(pidListUpdateTimePeriod)
+	defer ticker.Stop()
 	for {
 
 		select {
@@ -130,6 +158,7 @@ func (h *PidsHub) runPidsHub() {
 				//h.log("Error processing PID List Update Command: ", err)
 				continue
 			}
+			updateListsCounter.Inc()
 			wslogic.Broadcast(responseData)
 
 		case pid := <-h.subscribe:
@@ -155,6 +184,15 @@ func (h *PidsHub) runPidsHub() {
 			request.SendCommandResponse([]byte{})
 			h.log(">>>>>>>>> DISPATCHED AN EMPTY COMMAND RESPONSE")
 			//request.Response <- []byte{}
+
+			// The server is shutting down: stop every ticker before quitting
+		case <-h.shutdown:
+			h.log("Stopping ", len(dummyTickersMap), " dummy tickers")
+			for _, pid := range dummyTickersMap {
+				pid.Stop()
+			}
+			close(h.done)
+			return
 		}
 	}
 }
@@ -165,7 +203,12 @@ func Init() {
 	wslogic.RegisterMessagesHandler(
 		wslogic.NewRequestMessageHandler(apicommands.ServerCompleteSignalList, RequestPidList))
 	log.Println("INIT PID.GO >>> Back from registering messages handler")
+	// The clients that can't resume their stream start over from the complete list
+	wslogic.SetSnapshotProvider(func() wslogic.RawResponseData {
+		return RequestPidList(wslogic.NewCommandRequest(apicommands.ServerCompleteSignalList, []byte{}))
+	})
 	go pidsHub.runPidsHub()
+	go recorder.runSamplesRecorder()
 
 	now := time.Now().UnixNano()
 
@@ -183,3 +226,12 @@ func Init() {
 	SavePidsToDb(now)
 
 }
+
+// Shutdown stops the dummy tickers and the PIDs hub, then flushes the samples still pending to be saved.
+func Shutdown(ctx context.Context) error {
+	log.Println("SHUTDOWN PID.GO")
+	if err := pidsHub.stop(ctx); err != nil {
+		return err
+	}
+	return recorder.stop(ctx)
+}
@@ -10,10 +10,7 @@ import (
 	"time"
 )
 
-type ApiPidListResponse struct {
-	wslogic.ApiResponseHeader
-	List []PidData `json:"pids"`
-}
+type ApiPidListResponse = apicommands.ApiPidListResponse
 
 func NewApiPidListResponse(list []PidData) ApiPidListResponse {
 	return ApiPidListResponse{
@@ -23,10 +20,6 @@ func NewApiPidListResponse(list []PidData) ApiPidListResponse {
 		List: list}
 }
 
-func (r ApiPidListResponse) Stringify() ([]byte, error) {
-	return json.Marshal(r)
-}
-
 func getPidDataList(dummyTickersMap map[int]*DummyPIDTicker) []PidData {
 	pids := make([]PidData, len(dummyTickersMap))
 	i := 0
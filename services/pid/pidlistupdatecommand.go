@@ -1,21 +1,13 @@
 package pid
 
 import (
-	"encoding/json"
 	"errors"
 	"local/gintest/apicommands"
 	"local/gintest/wslogic"
 )
 
-type PidIndexedDynamicData struct {
-	Index int `json:"index"`
-	PidDynamicData
-}
-
-type ApiPidListUpdateResponse struct {
-	wslogic.ApiResponseHeader
-	List []PidIndexedDynamicData `json:"pids"`
-}
+type PidIndexedDynamicData = apicommands.PidIndexedDynamicData
+type ApiPidListUpdateResponse = apicommands.ApiPidListUpdateResponse
 
 func NewApiPidListUpdateResponse(list []PidIndexedDynamicData) ApiPidListUpdateResponse {
 	return ApiPidListUpdateResponse{
@@ -25,10 +17,6 @@ func NewApiPidListUpdateResponse(list []PidIndexedDynamicData) ApiPidListUpdateR
 		List: list}
 }
 
-func (r ApiPidListUpdateResponse) Stringify() ([]byte, error) {
-	return json.Marshal(r)
-}
-
 func getPidIndexedDynamicDataList(dummyTickersMap map[int]*DummyPIDTicker) []PidIndexedDynamicData {
 	var pids []PidIndexedDynamicData
 	//:= make([]PidIndexedDynamicData, len(dummyTickersMap))
@@ -0,0 +1,121 @@
+package pid
+
+import (
+	"context"
+	"fmt"
+	"local/gintest/services/db"
+	"local/gintest/services/dbheap"
+	"log"
+	"time"
+)
+
+const (
+	// Pending samples are saved to the DB with this period...
+	samplesFlushPeriod = time.Second
+
+	// ... or as soon as this many are waiting
+	samplesFlushSize = 1000
+
+	sizeSamplesChanBuffer = 256
+)
+
+// SamplesRecorder batches the samples produced by the tickers and saves them to the DB.
+type SamplesRecorder struct {
+	samples chan *db.DBSample
+
+	// Shutdown requests
+	shutdown chan struct{}
+
+	// Closed when every pending sample has been flushed and the recorder stopped.
+	done chan struct{}
+}
+
+var recorder = SamplesRecorder{
+	samples:  make(chan *db.DBSample, sizeSamplesChanBuffer),
+	shutdown: make(chan struct{}),
+	done:     make(chan struct{}),
+}
+
+func (r *SamplesRecorder) log(v ...interface{}) {
+	if debugging {
+		text := fmt.Sprint(v...)
+		prefix := fmt.Sprint("<< SAMPLES RECORDER >> ~ ")
+		if debugWithTimeStamp {
+			prefix = time.Now().Format(time.StampMicro) + " " + prefix
+		}
+		log.Println(prefix, text)
+	}
+}
+
+func (r *SamplesRecorder) record(sample *db.DBSample) {
+	select {
+	case r.samples <- sample:
+	case <-r.done:
+	}
+}
+
+func (r *SamplesRecorder) flush(pending []*db.DBSample) {
+	if len(pending) == 0 {
+		return
+	}
+	d, err := dbheap.GetSession()
+	if err != nil {
+		r.log("Error getting session, ", len(pending), " samples were lost: ", err)
+		return
+	}
+	defer d.Close()
+	err = d.ClientSession.InsertSamples(pending...)
+	if err != nil {
+		r.log("Error inserting ", len(pending), " samples: ", err)
+	}
+}
+
+func (r *SamplesRecorder) runSamplesRecorder() {
+	r.log("Running Samples Recorder")
+	defer r.log("Exiting Samples Recorder")
+
+	pending := make([]*db.DBSample, 0, samplesFlushSize)
+	ticker := time.NewTicker(samplesFlushPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case sample := <-r.samples:
+			pending = append(pending, sample)
+			if len(pending) >= samplesFlushSize {
+				r.flush(pending)
+				pending = pending[:0]
+			}
+
+		case <-ticker.C:
+			r.flush(pending)
+			pending = pending[:0]
+
+			// Flush whatever is still queued up before quitting
+		case <-r.shutdown:
+			for n := len(r.samples); n > 0; n-- {
+				pending = append(pending, <-r.samples)
+			}
+			r.log("Flushing ", len(pending), " pending samples")
+			r.flush(pending)
+			close(r.done)
+			return
+		}
+	}
+}
+
+// stop flushes the pending samples and stops the recorder, waiting until it's done or ctx expires.
+func (r *SamplesRecorder) stop(ctx context.Context) error {
+	select {
+	case r.shutdown <- struct{}{}:
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
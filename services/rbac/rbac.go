@@ -0,0 +1,198 @@
+// Package rbac maps the roles of the users to the REST routes and the websocket commands they may use.
+package rbac
+
+import (
+	"fmt"
+	"local/gintest/apicommands"
+	"strings"
+)
+
+// Role grants access to a set of routes and commands. Every role grants whatever the lower ones do.
+type Role string
+
+const (
+	Viewer   Role = "viewer"
+	Operator Role = "operator"
+	Engineer Role = "engineer"
+	Admin    Role = "admin"
+)
+
+// DefaultRole is the role of the new users, and of the ones registered before roles existed.
+const DefaultRole = Viewer
+
+var levels = map[Role]int{
+	Viewer:   1,
+	Operator: 2,
+	Engineer: 3,
+	Admin:    4,
+}
+
+// Roles returns every role, from the lowest to the highest.
+func Roles() []Role {
+	return []Role{Viewer, Operator, Engineer, Admin}
+}
+
+func ParseRole(s string) (Role, error) {
+	role := Role(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := levels[role]; !ok {
+		return "", fmt.Errorf("Unknown role %q", s)
+	}
+	return role, nil
+}
+
+// level is the level of the highest known role, 0 if there's none.
+func level(roles []string) int {
+	max := 0
+	for _, role := range roles {
+		if l := levels[Role(role)]; l > max {
+			max = l
+		}
+	}
+	return max
+}
+
+// Has tells whether roles include role or a higher one.
+func Has(roles []string, role Role) bool {
+	return level(roles) >= levels[role]
+}
+
+// The lowest role allowed on every route, written "METHOD /path" with the path as registered in gin. Routes that
+// aren't listed are for admins only.
+var RouteRoles = map[string]Role{
+	"GET /ws":                             Viewer,
+	"GET /sse":                            Viewer,
+	"GET /auth/hello":                     Viewer,
+	"GET /auth/refresh_token":             Viewer,
+	"POST /auth/ws_ticket":                Viewer,
+	"POST /auth/logout":                   Viewer,
+	"POST /auth/logout_all":               Viewer,
+	"GET /auth/stats":                     Engineer,
+	"GET /auth/connections":               Admin,
+	"GET /auth/lockouts":                  Admin,
+	"DELETE /auth/lockouts/:kind/:value":  Admin,
+	"GET /auth/audit":                     Admin,
+	"GET /auth/audit/export":              Admin,
+	"POST /auth/password":                 Viewer,
+	"GET /auth/apikeys":                   Viewer,
+	"POST /auth/apikeys":                  Viewer,
+	"DELETE /auth/apikeys/:id":            Viewer,
+	"GET /auth/users":                     Admin,
+	"GET /auth/users/:username":           Admin,
+	"DELETE /auth/users/:username":        Admin,
+	"POST /auth/users/:username/disable":  Admin,
+	"POST /auth/users/:username/enable":   Admin,
+	"POST /auth/users/:username/password": Admin,
+	"PUT /auth/users/:username/roles":     Admin,
+	"DELETE /auth/users/:username/mfa":    Admin,
+	"GET /auth/mfa":                       Viewer,
+	"POST /auth/mfa/enroll":               Viewer,
+	"POST /auth/mfa/confirm":              Viewer,
+	"DELETE /auth/mfa":                    Viewer,
+	"GET /auth/mfa/roles":                 Admin,
+	"PUT /auth/mfa/roles":                 Admin,
+}
+
+// The lowest role allowed to run every command. Commands that aren't listed are for admins only.
+var CommandRoles = map[apicommands.CommandType]Role{
+	apicommands.ClientHello:              Viewer,
+	apicommands.ClientRefreshToken:       Viewer,
+	apicommands.ClientPong:               Viewer,
+	apicommands.ServerCompleteSignalList: Viewer,
+	apicommands.ServerNConnectionsPush:   Viewer,
+	apicommands.ClientJoinTopics:         Viewer,
+	apicommands.ClientLeaveTopics:        Viewer,
+	apicommands.ClientStats:              Engineer,
+	apicommands.ClientConnections:        Admin,
+}
+
+// The lowest role allowed to join the topics starting with every prefix. Other topics are open to every role.
+var TopicRoles = map[string]Role{
+	"admin.": Admin,
+}
+
+func required(role Role, ok bool) Role {
+	if !ok {
+		return Admin
+	}
+	return role
+}
+
+// AuthorizeRoute returns an error explaining why roles can't use the route, or nil if they can.
+func AuthorizeRoute(roles []string, method, path string) error {
+	route := method + " " + path
+	role := required(RouteRoles[route], RouteRoles[route] != "")
+	if !Has(roles, role) {
+		return fmt.Errorf("%s requires the %s role", route, role)
+	}
+	return nil
+}
+
+// CommandRole returns the lowest role allowed to run a command.
+func CommandRole(command apicommands.CommandType) Role {
+	role, ok := CommandRoles[command]
+	return required(role, ok)
+}
+
+// AuthorizeCommand returns an error explaining why roles can't run the command, or nil if they can.
+func AuthorizeCommand(roles []string, command apicommands.CommandType) error {
+	role := CommandRole(command)
+	if !Has(roles, role) {
+		name := command.Name()
+		if name == "" {
+			name = fmt.Sprint(int(command))
+		}
+		return fmt.Errorf("The command %s requires the %s role", name, role)
+	}
+	return nil
+}
+
+// TopicRole returns the lowest role allowed to join a topic, the one of the longest prefix it starts with.
+func TopicRole(topic string) Role {
+	role, longest := DefaultRole, -1
+	for prefix, r := range TopicRoles {
+		if strings.HasPrefix(topic, prefix) && len(prefix) > longest {
+			role, longest = r, len(prefix)
+		}
+	}
+	return role
+}
+
+// AuthorizeTopic returns an error explaining why roles can't join the topic, or nil if they can.
+func AuthorizeTopic(roles []string, topic string) error {
+	role := TopicRole(topic)
+	if !Has(roles, role) {
+		return fmt.Errorf("The topic %s requires the %s role", topic, role)
+	}
+	return nil
+}
+
+// UserRoles returns the roles of a user given the ones stored with it, which may be none for the users registered
+// before roles existed.
+func UserRoles(stored []string) []string {
+	roles := make([]string, 0, len(stored)+1)
+	for _, role := range stored {
+		if _, ok := levels[Role(role)]; ok {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 {
+		roles = append(roles, string(DefaultRole))
+	}
+	return roles
+}
+
+// Capped returns the roles granted by roles that ceiling grants too, like the roles of a user limited by the
+// scopes of one of its API keys.
+func Capped(roles []string, ceiling []string) []string {
+	max := level(roles)
+	if l := level(ceiling); l < max {
+		max = l
+	}
+	var capped []string
+	for _, role := range Roles() {
+		if levels[role] <= max {
+			capped = append(capped, string(role))
+		}
+	}
+	return capped
+}
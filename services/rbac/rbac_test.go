@@ -0,0 +1,67 @@
+package rbac
+
+import (
+	"local/gintest/apicommands"
+	"testing"
+)
+
+func TestHas(t *testing.T) {
+	if !Has([]string{"engineer"}, Operator) || !Has([]string{"viewer", "admin"}, Admin) {
+		t.Error("Higher roles must grant the lower ones")
+	}
+	if Has([]string{"operator"}, Engineer) || Has(nil, Viewer) || Has([]string{"root"}, Viewer) {
+		t.Error("Granted a role that wasn't held")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	viewer := []string{string(Viewer)}
+	if err := AuthorizeRoute(viewer, "GET", "/ws"); err != nil {
+		t.Error(err)
+	}
+	if err := AuthorizeRoute(viewer, "GET", "/auth/stats"); err == nil {
+		t.Error("A viewer got the stats")
+	}
+	if err := AuthorizeRoute([]string{string(Engineer)}, "DELETE", "/auth/unknown"); err == nil {
+		t.Error("Unlisted routes must be for admins only")
+	}
+	if err := AuthorizeCommand(viewer, apicommands.ServerCompleteSignalList); err != nil {
+		t.Error(err)
+	}
+	if err := AuthorizeCommand(viewer, apicommands.ClientConnections); err == nil {
+		t.Error("A viewer listed the connections")
+	}
+	if err := AuthorizeCommand([]string{string(Admin)}, apicommands.CommandType(12345)); err != nil {
+		t.Error(err)
+	}
+	if err := AuthorizeTopic(viewer, "alarms"); err != nil {
+		t.Error(err)
+	}
+	if err := AuthorizeTopic([]string{string(Engineer)}, "admin.users"); err == nil {
+		t.Error("An engineer joined an admin topic")
+	}
+	if err := AuthorizeTopic([]string{string(Admin)}, "admin.users"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	if role, err := ParseRole(" Engineer "); err != nil || role != Engineer {
+		t.Error("Wrong role: ", role, err)
+	}
+	if _, err := ParseRole("root"); err == nil {
+		t.Error("Parsed an unknown role")
+	}
+}
+
+func TestCapped(t *testing.T) {
+	if capped := Capped([]string{"admin"}, []string{"operator"}); !Has(capped, Operator) || Has(capped, Engineer) {
+		t.Error("The scopes didn't cap the roles: ", capped)
+	}
+	if capped := Capped([]string{"viewer"}, []string{"admin"}); Has(capped, Operator) {
+		t.Error("The scopes granted more than the roles: ", capped)
+	}
+	if capped := Capped([]string{"admin"}, nil); len(capped) != 0 {
+		t.Error("No scopes must grant nothing: ", capped)
+	}
+}
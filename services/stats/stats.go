@@ -0,0 +1,191 @@
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The rates are computed over this period
+const ratePeriod = 10 * time.Second
+
+// Counter counts events, like messages or bytes sent, and their rate per second.
+type Counter struct {
+	value int64
+
+	// Guarded by the registry mutex
+	last int64
+	rate float64
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// Gauge holds a current value, like the number of connections.
+type Gauge struct {
+	value int64
+}
+
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.value, v)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// Latency keeps track of how long an operation takes.
+type Latency struct {
+	mutex sync.Mutex
+	count int64
+	total time.Duration
+	max   time.Duration
+}
+
+func (l *Latency) Observe(d time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.count++
+	l.total += d
+	if d > l.max {
+		l.max = d
+	}
+}
+
+type registry struct {
+	mutex      sync.Mutex
+	counters   map[string]*Counter
+	gauges     map[string]*Gauge
+	latencies  map[string]*Latency
+	lastSample time.Time
+}
+
+var stats = registry{
+	counters:   make(map[string]*Counter),
+	gauges:     make(map[string]*Gauge),
+	latencies:  make(map[string]*Latency),
+	lastSample: time.Now(),
+}
+
+// NewCounter returns the counter with the given name, registering it the first time.
+func NewCounter(name string) *Counter {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	c, ok := stats.counters[name]
+	if !ok {
+		c = &Counter{}
+		stats.counters[name] = c
+	}
+	return c
+}
+
+// NewGauge returns the gauge with the given name, registering it the first time.
+func NewGauge(name string) *Gauge {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	g, ok := stats.gauges[name]
+	if !ok {
+		g = &Gauge{}
+		stats.gauges[name] = g
+	}
+	return g
+}
+
+// GetLatency returns the latency with the given name, registering it the first time.
+func GetLatency(name string) *Latency {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	l, ok := stats.latencies[name]
+	if !ok {
+		l = &Latency{}
+		stats.latencies[name] = l
+	}
+	return l
+}
+
+type CounterSnapshot struct {
+	Total int64   `json:"total"`
+	Rate  float64 `json:"rate"`
+}
+
+type LatencySnapshot struct {
+	Count  int64   `json:"count"`
+	MeanMs float64 `json:"meanMs"`
+	MaxMs  float64 `json:"maxMs"`
+}
+
+// Snapshot holds the values of every statistic at a given time. Rates are per second, over the last period.
+type Snapshot struct {
+	Timestamp int64                      `json:"timestamp"`
+	Counters  map[string]CounterSnapshot `json:"counters"`
+	Gauges    map[string]int64           `json:"gauges"`
+	Latencies map[string]LatencySnapshot `json:"latencies"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func TakeSnapshot() Snapshot {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	snapshot := Snapshot{
+		Timestamp: time.Now().UnixNano(),
+		Counters:  make(map[string]CounterSnapshot, len(stats.counters)),
+		Gauges:    make(map[string]int64, len(stats.gauges)),
+		Latencies: make(map[string]LatencySnapshot, len(stats.latencies)),
+	}
+	for name, c := range stats.counters {
+		snapshot.Counters[name] = CounterSnapshot{Total: c.Value(), Rate: c.rate}
+	}
+	for name, g := range stats.gauges {
+		snapshot.Gauges[name] = g.Value()
+	}
+	for name, l := range stats.latencies {
+		l.mutex.Lock()
+		latency := LatencySnapshot{Count: l.count, MaxMs: milliseconds(l.max)}
+		if l.count > 0 {
+			latency.MeanMs = milliseconds(l.total) / float64(l.count)
+		}
+		l.mutex.Unlock()
+		snapshot.Latencies[name] = latency
+	}
+	return snapshot
+}
+
+// sampleRates updates the rate of every counter with what was counted since the last sample.
+func (r *registry) sampleRates(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	elapsed := now.Sub(r.lastSample).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	for _, c := range r.counters {
+		value := c.Value()
+		c.rate = float64(value-c.last) / elapsed
+		c.last = value
+	}
+	r.lastSample = now
+}
+
+func (r *registry) runSampler() {
+	ticker := time.NewTicker(ratePeriod)
+	for now := range ticker.C {
+		r.sampleRates(now)
+	}
+}
+
+func init() {
+	go stats.runSampler()
+}
@@ -0,0 +1,51 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	if NewCounter("test.counter") != NewCounter("test.counter") || NewGauge("test.gauge") != NewGauge("test.gauge") || GetLatency("test.latency") != GetLatency("test.latency") {
+		t.Fatal("A name registered twice")
+	}
+	NewCounter("test.counter").Add(3)
+	NewGauge("test.gauge").Set(-2)
+	GetLatency("test.latency").Observe(10 * time.Millisecond)
+	GetLatency("test.latency").Observe(30 * time.Millisecond)
+	GetLatency("test.idle")
+
+	snapshot := TakeSnapshot()
+	if snapshot.Counters["test.counter"].Total != 3 || snapshot.Gauges["test.gauge"] != -2 {
+		t.Error("Wrong counter or gauge: ", snapshot.Counters["test.counter"], snapshot.Gauges["test.gauge"])
+	}
+	if latency := snapshot.Latencies["test.latency"]; latency != (LatencySnapshot{Count: 2, MeanMs: 20, MaxMs: 30}) {
+		t.Error("Wrong latency: ", latency)
+	}
+	if latency := snapshot.Latencies["test.idle"]; latency != (LatencySnapshot{}) {
+		t.Error("Wrong latency without observations: ", latency)
+	}
+}
+
+func TestSampleRates(t *testing.T) {
+	start := time.Now()
+	r := registry{counters: map[string]*Counter{"sent": {}}, lastSample: start}
+	sent := r.counters["sent"]
+
+	sent.Add(50)
+	r.sampleRates(start.Add(10 * time.Second))
+	if sent.rate != 5 {
+		t.Error("Wrong rate: ", sent.rate)
+	}
+	// Only what was counted since the last sample counts
+	sent.Add(10)
+	r.sampleRates(start.Add(20 * time.Second))
+	if sent.rate != 1 {
+		t.Error("Wrong rate of the second period: ", sent.rate)
+	}
+	// No time elapsed, the rate is kept
+	r.sampleRates(start.Add(20 * time.Second))
+	if sent.rate != 1 {
+		t.Error("The rate changed without time elapsing: ", sent.rate)
+	}
+}
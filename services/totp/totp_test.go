@@ -0,0 +1,84 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors of RFC 6238, truncated to 6 digits
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, expected := range vectors {
+		code, err := Code(secret, Step(time.Unix(unix, 0)))
+		if err != nil || code != expected {
+			t.Error("Wrong code at ", unix, ": ", code, err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	current := Step(now)
+	previous, _ := Code(secret, current-1)
+	next, _ := Code(secret, current+1)
+	old, _ := Code(secret, current-2)
+
+	if step, ok := Verify(secret, previous, now, 0); !ok || step != current-1 {
+		t.Error("The code of the previous step was refused")
+	}
+	if step, ok := Verify(secret, next, now, 0); !ok || step != current+1 {
+		t.Error("The code of the next step was refused")
+	}
+	if _, ok := Verify(secret, old, now, 0); ok {
+		t.Error("A code of two steps ago was accepted")
+	}
+	if _, ok := Verify(secret, previous, now, current-1); ok {
+		t.Error("A code was accepted twice")
+	}
+	if _, ok := Verify(secret, "12345", now, 0); ok {
+		t.Error("A short code was accepted")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	u, err := url.Parse(ProvisioningURI("gintest", "alice smith", "ABCDEF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/gintest:alice smith" ||
+		u.Query().Get("secret") != "ABCDEF" || u.Query().Get("issuer") != "gintest" {
+		t.Error("Wrong provisioning URI: ", u)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := NewRecoveryCodes(10)
+	if err != nil || len(codes) != 10 {
+		t.Fatal("Wrong recovery codes: ", codes, err)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' || seen[code] {
+			t.Error("Wrong recovery code: ", code)
+		}
+		seen[code] = true
+	}
+	if HashRecoveryCode(codes[0]) != HashRecoveryCode(" "+strings.ToUpper(strings.Replace(codes[0], "-", "", 1))) {
+		t.Error("The recovery codes depend on their case or separators")
+	}
+}
@@ -0,0 +1,277 @@
+package wslogic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"local/gintest/services/backplane"
+	"log"
+	"time"
+)
+
+const (
+	broadcastTopic = "gintest.broadcast"
+	presenceTopic  = "gintest.presence"
+
+	revocationsTopic = "gintest.revocations"
+
+	// Every instance publishes its number of clients with this period...
+	presencePeriod = 10 * time.Second
+
+	// ... and is forgotten by the others when nothing is heard from it for this long
+	presenceTimeout = 3 * presencePeriod
+
+	sizePublicationsChanBuffer = 256
+)
+
+var (
+	clusterBackplane backplane.Backplane = backplane.NewMemory()
+
+	instanceID = backplane.NewInstanceID()
+)
+
+// SetBackplane makes the hubs share broadcasts and client counts with the other instances connected to bp.
+// It must be called before Init.
+func SetBackplane(bp backplane.Backplane) {
+	clusterBackplane = bp
+}
+
+// backplaneBroadcast wraps a broadcasted message with the instance it comes from, and the topic it was published on
+// unless it's for every client.
+type backplaneBroadcast struct {
+	Instance string          `json:"instance"`
+	Topic    string          `json:"topic,omitempty"`
+	Message  json.RawMessage `json:"message"`
+}
+
+// instancePresence reports the number of clients connected to an instance.
+type instancePresence struct {
+	Instance string `json:"instance"`
+	ApiNClients
+
+	// Set by an instance shutting down
+	Leaving bool `json:"leaving,omitempty"`
+}
+
+// backplaneRevocation tells the other instances to close the connections of a revoked session.
+type backplaneRevocation struct {
+	Instance string `json:"instance"`
+	SessionRevocation
+}
+
+type remoteInstance struct {
+	nClients int
+	lastSeen time.Time
+}
+
+type publication struct {
+	topic   string
+	message []byte
+}
+
+// BackplaneRelay publishes the messages of the hubs on the backplane and hands the ones coming from other instances
+// to the connections hub.
+type BackplaneRelay struct {
+	publications chan publication
+
+	// Shutdown requests
+	shutdown chan struct{}
+
+	// Closed when every queued publication has been sent.
+	done chan struct{}
+}
+
+var relay = BackplaneRelay{
+	publications: make(chan publication, sizePublicationsChanBuffer),
+	shutdown:     make(chan struct{}),
+	done:         make(chan struct{}),
+}
+
+func (r *BackplaneRelay) log(v ...interface{}) {
+	if debugging {
+		text := fmt.Sprint(v...)
+		prefix := fmt.Sprint("< BACKPLANE > ~ ")
+		if debugWithTimeStamp {
+			prefix = time.Now().Format(time.StampMicro) + " " + prefix
+		}
+		log.Println(prefix, text)
+	}
+}
+
+// publish queues up a message to be published, dropping it if the queue is full so the hubs never wait on the
+// backplane.
+func (r *BackplaneRelay) publish(topic string, message []byte) {
+	select {
+	case r.publications <- publication{topic: topic, message: message}:
+	default:
+		r.log("Dropping a publication on ", topic, ", queue full")
+	}
+}
+
+func (r *BackplaneRelay) publishBroadcast(message []byte) {
+	data, err := json.Marshal(backplaneBroadcast{Instance: instanceID, Message: message})
+	if err != nil {
+		r.log("Error marshalling a broadcast: ", err)
+		return
+	}
+	r.publish(broadcastTopic, data)
+}
+
+func (r *BackplaneRelay) publishTopic(topic string, message []byte) {
+	data, err := json.Marshal(backplaneBroadcast{Instance: instanceID, Topic: topic, Message: message})
+	if err != nil {
+		r.log("Error marshalling a publication on ", topic, ": ", err)
+		return
+	}
+	r.publish(broadcastTopic, data)
+}
+
+func (r *BackplaneRelay) publishPresence(nClients int, leaving bool) {
+	data, err := json.Marshal(instancePresence{Instance: instanceID, ApiNClients: ApiNClients{Number: nClients}, Leaving: leaving})
+	if err != nil {
+		r.log("Error marshalling the presence: ", err)
+		return
+	}
+	r.publish(presenceTopic, data)
+}
+
+func (r *BackplaneRelay) publishRevocation(revocation SessionRevocation) {
+	data, err := json.Marshal(backplaneRevocation{Instance: instanceID, SessionRevocation: revocation})
+	if err != nil {
+		r.log("Error marshalling a revocation: ", err)
+		return
+	}
+	r.publish(revocationsTopic, data)
+}
+
+func (r *BackplaneRelay) runPublisher() {
+	for {
+		select {
+		case p := <-r.publications:
+			if err := clusterBackplane.Publish(p.topic, p.message); err != nil {
+				r.log("Error publishing on ", p.topic, ": ", err)
+			}
+
+			// Send whatever is still queued up before quitting
+		case <-r.shutdown:
+			for n := len(r.publications); n > 0; n-- {
+				p := <-r.publications
+				if err := clusterBackplane.Publish(p.topic, p.message); err != nil {
+					r.log("Error publishing on ", p.topic, ": ", err)
+				}
+			}
+			close(r.done)
+			return
+		}
+	}
+}
+
+// runSubscriber hands the broadcasts, presences and revocations of the other instances to the connections hub,
+// until the backplane is closed.
+func (r *BackplaneRelay) runSubscriber(broadcasts, presences, revocations <-chan []byte) {
+	defer r.log("Exiting the backplane subscriber")
+	for broadcasts != nil || presences != nil || revocations != nil {
+		select {
+		case data, ok := <-broadcasts:
+			if !ok {
+				broadcasts = nil
+				continue
+			}
+			var b backplaneBroadcast
+			if err := json.Unmarshal(data, &b); err != nil {
+				r.log("Error unmarshalling a broadcast: ", err)
+				continue
+			}
+			if b.Instance == instanceID {
+				continue
+			}
+			if b.Topic != "" {
+				select {
+				case connectionsHub.remotePublish <- topicPublication{topic: b.Topic, message: b.Message}:
+				case <-connectionsHub.done:
+					return
+				}
+				continue
+			}
+			select {
+			case connectionsHub.remoteBroadcast <- b.Message:
+			case <-connectionsHub.done:
+				return
+			}
+
+		case data, ok := <-presences:
+			if !ok {
+				presences = nil
+				continue
+			}
+			var p instancePresence
+			if err := json.Unmarshal(data, &p); err != nil {
+				r.log("Error unmarshalling a presence: ", err)
+				continue
+			}
+			if p.Instance == instanceID {
+				continue
+			}
+			select {
+			case connectionsHub.remotePresence <- p:
+			case <-connectionsHub.done:
+				return
+			}
+
+		case data, ok := <-revocations:
+			if !ok {
+				revocations = nil
+				continue
+			}
+			var revocation backplaneRevocation
+			if err := json.Unmarshal(data, &revocation); err != nil {
+				r.log("Error unmarshalling a revocation: ", err)
+				continue
+			}
+			if revocation.Instance == instanceID {
+				continue
+			}
+			select {
+			case connectionsHub.revoke <- revocation.SessionRevocation:
+			case <-connectionsHub.done:
+				return
+			}
+		}
+	}
+}
+
+func (r *BackplaneRelay) start() error {
+	go r.runPublisher()
+
+	broadcasts, err := clusterBackplane.Subscribe(broadcastTopic)
+	if err != nil {
+		return err
+	}
+	presences, err := clusterBackplane.Subscribe(presenceTopic)
+	if err != nil {
+		return err
+	}
+	revocations, err := clusterBackplane.Subscribe(revocationsTopic)
+	if err != nil {
+		return err
+	}
+	go r.runSubscriber(broadcasts, presences, revocations)
+	return nil
+}
+
+// stop sends the queued publications and closes the backplane.
+func (r *BackplaneRelay) stop(ctx context.Context) error {
+	select {
+	case r.shutdown <- struct{}{}:
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return clusterBackplane.Close()
+}
@@ -0,0 +1,42 @@
+package wslogic
+
+import (
+	"bytes"
+	"encoding/json"
+	"local/gintest/apicommands"
+)
+
+const batchFeature = "batch"
+
+// batchCommands returns the commands carried by a batch frame, a JSON array of command requests, or false if the
+// message isn't one.
+func batchCommands(message []byte) ([]json.RawMessage, bool) {
+	trimmed := bytes.TrimSpace(message)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		return nil, false
+	}
+	var commands []json.RawMessage
+	if err := json.Unmarshal(trimmed, &commands); err != nil {
+		return nil, false
+	}
+	return commands, true
+}
+
+// handleBatch runs the commands of a batch in order, and returns their responses in a single JSON array.
+// Commands answering on their own get a null response.
+func (h *MessagesHub) handleBatch(requestHandlersMap map[apicommands.CommandType]messageHandler, from clientMessage, commands []json.RawMessage) RawResponseData {
+	h.log("Processing a batch of ", len(commands), " commands")
+	responses := make([]json.RawMessage, len(commands))
+	for i, command := range commands {
+		if response := h.handleCommand(requestHandlersMap, from, command); len(response) > 0 {
+			responses[i] = json.RawMessage(response)
+		}
+	}
+	data, err := json.Marshal(responses)
+	if err != nil {
+		h.log("Error marshalling the responses of a batch: ", err)
+		badRequestResponse := newBadRequestApiResponse()
+		data, _ = badRequestResponse.Stringify()
+	}
+	return data
+}
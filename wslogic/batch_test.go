@@ -0,0 +1,87 @@
+package wslogic
+
+import (
+	"encoding/json"
+	"fmt"
+	"local/gintest/apicommands"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchCommands(t *testing.T) {
+	tests := []struct {
+		message  string
+		commands int
+		ok       bool
+	}{
+		{``, 0, false},
+		{`   `, 0, false},
+		{`{"command":7}`, 0, false},
+		{`[`, 0, false},
+		{`[]`, 0, true},
+		{` [{"command":7}, {"command":3}] `, 2, true},
+		// A nested batch is a single command, refused when it's run
+		{`[[{"command":7}], {"command":3}]`, 2, true},
+	}
+	for _, test := range tests {
+		commands, ok := batchCommands([]byte(test.message))
+		if ok != test.ok || len(commands) != test.commands {
+			t.Errorf("batchCommands(%q) = %d commands, %v", test.message, len(commands), ok)
+		}
+	}
+}
+
+func TestHandleBatch(t *testing.T) {
+	h := &MessagesHub{}
+	handlers := map[apicommands.CommandType]messageHandler{
+		apicommands.ClientStats: func(request CommandRequest) RawResponseData {
+			return RawResponseData(fmt.Sprintf(`{"command":%d,"user":%q}`, request.Command(), request.UserID()))
+		},
+		// Answers on its own
+		apicommands.ClientPong: func(CommandRequest) RawResponseData { return nil },
+	}
+	from := clientMessage{userID: "alice"}
+
+	if got := string(h.handleBatch(handlers, from, []json.RawMessage{})); got != "[]" {
+		t.Error("Wrong answer to an empty batch: ", got)
+	}
+
+	commands, _ := batchCommands([]byte(`[{"command":7}, {"command":13}, [{"command":7}], {"command":999}, "stats"]`))
+	var responses []*ApiResponseHeader
+	if err := json.Unmarshal(h.handleBatch(handlers, from, commands), &responses); err != nil || len(responses) != len(commands) {
+		t.Fatal("Wrong responses: ", responses, err)
+	}
+	if responses[0] == nil || responses[0].Command != apicommands.ClientStats || responses[0].Status != 0 {
+		t.Error("Wrong response of the first command: ", responses[0])
+	}
+	if responses[1] != nil {
+		t.Error("A command answering on its own got a response: ", responses[1])
+	}
+	for i, status := range map[int]ResponseStatusType{2: badRequestStatus, 3: requestNotSupportedStatus, 4: badRequestStatus} {
+		if responses[i] == nil || responses[i].Status != status {
+			t.Error("Wrong response of the command ", i, ": ", responses[i])
+		}
+	}
+}
+
+func TestCheckBatchFrame(t *testing.T) {
+	now := time.Now()
+	limiter := newConnectionLimiter("batcher", now)
+	defer limiter.release()
+
+	commands := make([]string, rateLimits.MaxBatchCommands+1)
+	for i := range commands {
+		commands[i] = `{"command":3}`
+	}
+	if _, status, _ := limiter.checkFrame([]byte("["+strings.Join(commands, ",")+"]"), now); status != messageTooBigStatus {
+		t.Error("A batch with too many commands got status ", status)
+	}
+	big := `[{"command":3,"padding":"` + strings.Repeat("x", int(rateLimits.MaxBatchMessageSize)) + `"}]`
+	if _, status, _ := limiter.checkFrame([]byte(big), now); status != messageTooBigStatus {
+		t.Error("A batch beyond the maximum size got status ", status)
+	}
+	if _, status, description := limiter.checkFrame([]byte(`[{"command":3},{"command":7}]`), now); status != 0 {
+		t.Error("A small batch was rejected: ", description)
+	}
+}
@@ -25,8 +25,8 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Time before the session token expires when the client is warned to refresh it.
+	tokenExpiryWarning = 5 * time.Minute
 
 	debugging          = commons.Debugging
 	debugWithTimeStamp = commons.DebugWithTimeStamp
@@ -38,19 +38,69 @@ var (
 
 type connectionID int32
 
+type connectionKind int
+
+const (
+	webSocketConnection connectionKind = iota
+	eventStreamConnection
+)
+
 // Conn is an middleman between the websocket connection and the hub.
 type Conn struct {
-	// The websocket connection.
+	kind connectionKind
+
+	// The websocket connection, nil for event streams.
 	ws *websocket.Conn
 
 	// Buffered channel of outbound messages.
 	send chan []byte
 
+	// Payload of the close frame sent once the hub closes the send channel.
+	closeMessage []byte
+
+	// Closed when the write pump exits.
+	closed chan struct{}
+
+	// The user authenticated by the session token, and when that token expires.
+	userID    string
+	expiresAt time.Time
+
+	// The session of the token and when it started, to close the connection if it's revoked. Only used by the
+	// connections hub.
+	sessionID    string
+	sessionStart time.Time
+
+	// The roles of the user, a []string replaced when the token is refreshed and read by the read pump.
+	roles atomic.Value
+
+	// Expiration of the refreshed session tokens.
+	refreshed chan time.Time
+
+	// The pids an event stream is interested in, every one if empty.
+	pids pidsFilter
+
+	// The topics the connection is in, only used by the connections hub.
+	topics map[string]struct{}
+
+	// Where to resume the stream of broadcasts from, if the client asked to.
+	resume *ResumePoint
+
+	connectedAt time.Time
+
+	// The address of the client, for the audit log.
+	clientIP string
+
+	// The latency measured by the heartbeat, only used by the connections hub.
+	latency connectionLatency
+
 	connID connectionID
 }
 
 type clientMessage struct {
 	connID      connectionID
+	userID      string
+	roles       []string
+	clientIP    string
 	fromMessage []byte
 	toMessage   []byte
 }
@@ -60,12 +110,69 @@ func (cm *clientMessage) setResponseMessage(message []byte) {
 }
 
 func newClientMessage(conn *Conn, fromMessage []byte) clientMessage {
-	return clientMessage{connID: conn.connID, fromMessage: fromMessage}
+	return clientMessage{connID: conn.connID, userID: conn.userID, roles: conn.Roles(), clientIP: conn.clientIP, fromMessage: fromMessage}
+}
+
+// Roles returns the roles of the user of the connection.
+func (c *Conn) Roles() []string {
+	roles, _ := c.roles.Load().([]string)
+	return roles
+}
+
+func (c *Conn) setRoles(roles []string) {
+	c.roles.Store(append([]string{}, roles...))
 }
 
-// NewConn returns a new Connection to work with a session
-func NewConn(ws *websocket.Conn) *Conn {
-	return &Conn{ws: ws, send: make(chan []byte, sizeMsgChanBuffer), connID: connectionID(atomic.AddInt32(&sessionCounter, 1) - 1)}
+// NewConn returns a new Connection to work with session, which is closed when the session expires unless the
+// client refreshes its token, or when it's revoked. The commands it may run depend on the roles of the session.
+func NewConn(ws *websocket.Conn, session Session) *Conn {
+	conn := &Conn{
+		kind:         webSocketConnection,
+		ws:           ws,
+		send:         make(chan []byte, sizeMsgChanBuffer),
+		closed:       make(chan struct{}),
+		userID:       session.UserID,
+		expiresAt:    session.ExpiresAt,
+		sessionID:    session.ID,
+		sessionStart: session.StartedAt,
+		refreshed:    make(chan time.Time, 1),
+		topics:       make(map[string]struct{}),
+		connectedAt:  time.Now(),
+		connID:       connectionID(atomic.AddInt32(&sessionCounter, 1) - 1),
+	}
+	conn.setRoles(session.Roles)
+	return conn
+}
+
+// refreshSession moves the session expiration to expiresAt. Only the connections hub calls it, so draining a
+// refresh not yet seen by the write pump can't race with another refresh.
+func (c *Conn) refreshSession(expiresAt time.Time) {
+	select {
+	case <-c.refreshed:
+	default:
+	}
+	c.refreshed <- expiresAt
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// SetClientIP records the address of the client, before the connection is registered.
+func (c *Conn) SetClientIP(ip string) {
+	c.clientIP = ip
+}
+
+// ResumeFrom makes the connection get the broadcasts it missed since point, or a snapshot if they're no longer
+// kept, when it's registered.
+func (c *Conn) ResumeFrom(point ResumePoint) {
+	c.resume = &point
 }
 
 func (c *Conn) log(v ...interface{}) {
@@ -97,7 +204,11 @@ func (c *Conn) ReadPump() {
 		c.ws.Close()
 	}()
 
-	c.ws.SetReadLimit(maxMessageSize)
+	limiter := newConnectionLimiter(c.userID, time.Now())
+	defer limiter.release()
+
+	// Each command has its own limit, bigger messages aren't allowed for any
+	c.ws.SetReadLimit(rateLimits.maxMessageSize())
 	c.ws.SetReadDeadline(time.Now().Add(pongWait))
 	c.ws.SetPongHandler(
 		func(string) error {
@@ -115,6 +226,22 @@ func (c *Conn) ReadPump() {
 			break
 		}
 
+		now := time.Now()
+		if command, status, description := limiter.checkFrame(message, now); status != 0 {
+			c.log("Rejecting a message: ", description)
+			response := NewApiResponseHeader(command, status, description)
+			responseData, _ := response.Stringify()
+			if limiter.violate(now) {
+				c.log("Too many messages exceeded the limits, closing the connection")
+				disconnect(c.connID, responseData, websocket.ClosePolicyViolation, "Too many messages exceeding the limits")
+				continue
+			}
+			rejection := newClientMessage(c, message)
+			rejection.setResponseMessage(responseData)
+			Send(rejection)
+			continue
+		}
+
 		c.log("Sending the incoming message to be handled")
 		processClientMessage(newClientMessage(c, message))
 	}
@@ -123,16 +250,30 @@ func (c *Conn) ReadPump() {
 // write writes a message with the given message type and payload.
 func (c *Conn) write(mt int, payload []byte) error {
 	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
-	return c.ws.WriteMessage(mt, payload)
+	err := c.ws.WriteMessage(mt, payload)
+	if err == nil && mt == websocket.TextMessage {
+		messagesSentCounter.Inc()
+		bytesSentCounter.Add(int64(len(payload)))
+	}
+	return err
 }
 
-// WritePump pumps messages from the hub to the websocket connection.
+// WritePump pumps messages from the hub to the websocket connection. It also closes the connection with a policy
+// violation once the session token expires, warning the client shortly before.
 func (c *Conn) WritePump() {
 	ticker := time.NewTicker(pingPeriod)
+	heartbeatTicker := time.NewTicker(heartbeatPeriod)
+	expiresAt := c.expiresAt
+	warningTimer := time.NewTimer(time.Until(expiresAt.Add(-tokenExpiryWarning)))
+	expirationTimer := time.NewTimer(time.Until(expiresAt))
 	defer func() {
 		c.log("exiting writePump()")
 		ticker.Stop()
+		heartbeatTicker.Stop()
+		warningTimer.Stop()
+		expirationTimer.Stop()
 		c.ws.Close()
+		close(c.closed)
 	}()
 	for {
 		select {
@@ -141,7 +282,7 @@ func (c *Conn) WritePump() {
 			if !ok {
 				// The hub closed the channel.
 				c.log("The hub closed this connection")
-				c.write(websocket.CloseMessage, []byte{})
+				c.write(websocket.CloseMessage, c.closeMessage)
 				return
 			}
 
@@ -175,6 +316,34 @@ func (c *Conn) WritePump() {
 				return
 			}
 			c.log("Ping Ok!")
+
+		case now := <-heartbeatTicker.C:
+			// Unlike the protocol pings, the client answers these with a pong command the server can time
+			ping := NewPingPush(now)
+			message, _ := ping.Stringify()
+			if err := c.write(websocket.TextMessage, message); err != nil {
+				c.log("Error writing the heartbeat ping: ", err.Error())
+				return
+			}
+
+		case expiresAt = <-c.refreshed:
+			c.log("The session token was refreshed, it expires on ", expiresAt)
+			resetTimer(warningTimer, time.Until(expiresAt.Add(-tokenExpiryWarning)))
+			resetTimer(expirationTimer, time.Until(expiresAt))
+
+		case <-warningTimer.C:
+			c.log("The session token expires on ", expiresAt, ", warning the client")
+			push := NewTokenExpiringPush(expiresAt)
+			message, _ := push.Stringify()
+			if err := c.write(websocket.TextMessage, message); err != nil {
+				c.log("Error writing the token expiring warning: ", err.Error())
+				return
+			}
+
+		case <-expirationTimer.C:
+			c.log("The session token expired, closing the connection")
+			c.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "The session token expired"))
+			return
 		}
 	}
 }
@@ -2,12 +2,16 @@ package wslogic
 
 import (
 	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"local/gintest/apicommands"
 	"local/gintest/commons"
+	"local/gintest/services/audit"
 	"log"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 // An implementation Idea to create different responses in a generic way providing a handle function operating on the hub shared resources
@@ -35,6 +39,43 @@ type ConnectionsHub struct {
 
 	// Attend Number of current Clients Command requests.
 	incomingNCurrentClientsCommand chan CommandRequest
+
+	// Attend Refresh Token Command requests.
+	incomingRefreshTokenCommand chan refreshTokenRequest
+
+	// Messages published on a topic, by this instance and by the other ones
+	publish       chan topicPublication
+	remotePublish chan topicPublication
+
+	// Requests to join or leave topics
+	membership chan topicMembership
+
+	// Latencies measured by the heartbeat
+	incomingLatency chan latencySample
+
+	// Requests to list the connections
+	listConnections chan chan []ApiConnection
+
+	// Messages broadcasted by other instances
+	remoteBroadcast chan []byte
+
+	// Number of clients reported by other instances
+	remotePresence chan instancePresence
+
+	// Requests to close a specific connection
+	disconnect chan disconnection
+
+	// Sessions revoked here or on other instances, whose connections are closed
+	revoke chan SessionRevocation
+
+	// Requests to close every event stream, so the HTTP server can shut down.
+	closeEventStreams chan struct{}
+
+	// Shutdown requests, answered with the connections that were closed.
+	shutdown chan chan []*Conn
+
+	// Closed when the hub stops running.
+	done chan struct{}
 }
 
 var connectionsHub = ConnectionsHub{
@@ -43,6 +84,19 @@ var connectionsHub = ConnectionsHub{
 	register:                       make(chan *Conn),
 	unregister:                     make(chan *Conn),
 	incomingNCurrentClientsCommand: make(chan CommandRequest),
+	incomingRefreshTokenCommand:    make(chan refreshTokenRequest),
+	publish:                        make(chan topicPublication),
+	remotePublish:                  make(chan topicPublication),
+	membership:                     make(chan topicMembership),
+	incomingLatency:                make(chan latencySample),
+	listConnections:                make(chan chan []ApiConnection),
+	remoteBroadcast:                make(chan []byte),
+	remotePresence:                 make(chan instancePresence),
+	disconnect:                     make(chan disconnection),
+	revoke:                         make(chan SessionRevocation),
+	closeEventStreams:              make(chan struct{}),
+	shutdown:                       make(chan chan []*Conn),
+	done:                           make(chan struct{}),
 }
 
 func (h *ConnectionsHub) log(v ...interface{}) {
@@ -75,6 +129,8 @@ func (h *ConnectionsHub) removeConnection(conn *Conn, connectionsList *list.List
 			h.log("Found  the connection to be unregistered (id ", conn.connID, ")")
 			connectionsList.Remove(e)
 			close(conn.send)
+			auditConnection(audit.WsDisconnect, conn, "")
+			connectionsGauge.Set(int64(connectionsList.Len()))
 			h.log("There are now ", connectionsList.Len(), " (", len(connectionsMap), " in map) active connections")
 			return
 		}
@@ -86,36 +142,113 @@ func (h *ConnectionsHub) removeConnection(conn *Conn, connectionsList *list.List
 func (h *ConnectionsHub) registerConnection(conn *Conn, connectionsList *list.List, connectionsMap map[connectionID]*Conn) {
 	connectionsMap[conn.connID] = conn
 	connectionsList.PushBack(conn)
+	connectionsGauge.Set(int64(connectionsList.Len()))
 	h.log("There are now ", connectionsList.Len(), " (", len(connectionsMap), " in map) active connections")
 }
 
+// closeAllConnections closes every registered connection, sending closeMessage as the payload of its close frame,
+// and returns the closed connections.
+func (h *ConnectionsHub) closeAllConnections(closeMessage []byte, connectionsList *list.List, connectionsMap map[connectionID]*Conn) []*Conn {
+	closed := make([]*Conn, 0, connectionsList.Len())
+	for e := connectionsList.Front(); e != nil; e = e.Next() {
+		conn := e.Value.(*Conn)
+		conn.closeMessage = closeMessage
+		close(conn.send)
+		auditConnection(audit.WsDisconnect, conn, "server shutdown")
+		closed = append(closed, conn)
+		delete(connectionsMap, conn.connID)
+	}
+	connectionsList.Init()
+	return closed
+}
+
+// auditConnection records an action on a connection in the audit log.
+func auditConnection(action string, conn *Conn, details string) {
+	text := fmt.Sprint(connectionKindNames[conn.kind], " connection")
+	if action == audit.WsDisconnect {
+		text += fmt.Sprint(" closed after ", time.Since(conn.connectedAt).Round(time.Second))
+	}
+	if details != "" {
+		text += ", " + details
+	}
+	audit.Record(audit.Event{
+		Action:  action,
+		Actor:   conn.userID,
+		Target:  fmt.Sprint("connection ", conn.connID),
+		IP:      conn.clientIP,
+		Details: text,
+	})
+}
+
+type disconnection struct {
+	connID connectionID
+
+	// The last message sent before closing, if any
+	lastMessage []byte
+
+	closeMessage []byte
+}
+
+// disconnect closes the connection with a close frame of the given code and text, sending lastMessage first
+// unless it's nil.
+func disconnect(connID connectionID, lastMessage []byte, code int, text string) {
+	d := disconnection{
+		connID:       connID,
+		lastMessage:  lastMessage,
+		closeMessage: websocket.FormatCloseMessage(code, text),
+	}
+	select {
+	case connectionsHub.disconnect <- d:
+	case <-connectionsHub.done:
+	}
+}
+
 func Register(conn *Conn) {
-	connectionsHub.register <- conn
+	select {
+	case connectionsHub.register <- conn:
+	case <-connectionsHub.done:
+	}
 }
 
 func Unregister(conn *Conn) {
-	connectionsHub.unregister <- conn
+	select {
+	case connectionsHub.unregister <- conn:
+	case <-connectionsHub.done:
+	}
 }
 
+// Broadcast sends message to every client of this instance and, through the backplane, of the other ones.
 func Broadcast(message []byte) {
-	connectionsHub.broadcast <- message
+	select {
+	case connectionsHub.broadcast <- message:
+		relay.publishBroadcast(message)
+	case <-connectionsHub.done:
+	}
 }
 
 func Send(cmessage clientMessage) {
-	connectionsHub.send <- cmessage
+	select {
+	case connectionsHub.send <- cmessage:
+	case <-connectionsHub.done:
+	}
 }
 
-func (h *ConnectionsHub) broadcastMessage(message []byte, connectionsList *list.List, connectionsMap map[connectionID]*Conn) {
-	for e := connectionsList.Front(); e != nil; e = e.Next() {
+// broadcastMessage numbers a message and sends it to every connection.
+func (h *ConnectionsHub) broadcastMessage(message []byte, s *sequencer, connectionsList *list.List, connectionsMap map[connectionID]*Conn) {
+	message = s.next(message)
+	for e := connectionsList.Front(); e != nil; {
+		conn := e.Value.(*Conn)
+		// Move on before the connection may be removed from the list
+		e = e.Next()
 		select {
 		// If the channel can not proceed inmediately its because its buffer is full,
 		// so we presume that the connection with the client was lost
-		case e.Value.(*Conn).send <- message:
+		case conn.send <- message:
 
 		default:
-			h.log("Removing connection ", e.Value.(Conn).connID, ", unable to broadcast (client message queue full)")
-			close(e.Value.(*Conn).send)
-			h.removeConnection(e.Value.(*Conn), connectionsList, connectionsMap)
+			dropsCounter.Inc()
+			h.log("Removing connection ", conn.connID, ", unable to broadcast (client message queue full)")
+			h.removeConnection(conn, connectionsList, connectionsMap)
 		}
 	}
 }
@@ -130,9 +263,9 @@ func (h *ConnectionsHub) sendMessage(cMessage clientMessage, connectionsList *li
 				h.log("A message focused towards the connection ", cMessage.connID, " was queued up")
 				return nil
 			default:
-				h.log("Removing connection ", e.Value.(Conn).connID, ", unable to send message (client message queue full)")
-				close(e.Value.(*Conn).send)
-				h.removeConnection(e.Value.(*Conn), connectionsList, connectionsMap)
+				dropsCounter.Inc()
+				h.log("Removing connection ", conn.connID, ", unable to send message (client message queue full)")
+				h.removeConnection(conn, connectionsList, connectionsMap)
 				return errors.New("The client connection was found, but it's message queue was full")
 			}
 		}
@@ -141,14 +274,63 @@ func (h *ConnectionsHub) sendMessage(cMessage clientMessage, connectionsList *li
 	return errors.New(fmt.Sprint("The client with connection id ", cMessage.connID, " was not found in the connections list"))
 }
 
+// publishMessage sends a message published on a topic to the connections in it, within a TopicPush.
+func (h *ConnectionsHub) publishMessage(p topicPublication, topics topicsMap, connectionsList *list.List, connectionsMap map[connectionID]*Conn) {
+	members := topics[p.topic]
+	if len(members) == 0 {
+		return
+	}
+	push := NewTopicPush(p.topic, p.message)
+	message, err := push.Stringify()
+	if err != nil {
+		log.Println("ERROR publishMessage >>>> Couldn't stringify the push of the topic ", p.topic, ": ", err)
+		return
+	}
+	for id, conn := range members {
+		if connectionsMap[id] != conn {
+			// Removed because its queue was full, the topics weren't told
+			delete(members, id)
+			continue
+		}
+		select {
+		case conn.send <- message:
+		default:
+			dropsCounter.Inc()
+			h.log("Removing connection ", conn.connID, ", unable to publish on ", p.topic, " (client message queue full)")
+			topics.removeConnection(conn)
+			h.removeConnection(conn, connectionsList, connectionsMap)
+		}
+	}
+	publicationsCounter.Inc()
+}
+
+// clusterClients counts the clients of this instance and of every other instance heard from.
+func clusterClients(connectionsList *list.List, remoteInstances map[string]remoteInstance) int {
+	n := connectionsList.Len()
+	for _, instance := range remoteInstances {
+		n += instance.nClients
+	}
+	clusterClientsGauge.Set(int64(n))
+	return n
+}
+
 func (h *ConnectionsHub) runConnectionsHub() {
 
 	// The shared variables are declared in the beginning
 	connectionsList := list.New()
 	connectionsMap := make(map[connectionID]*Conn)
+	remoteInstances := make(map[string]remoteInstance)
+	topics := make(topicsMap)
+	seqr := &sequencer{}
 
 	staticsTicker := time.NewTicker(time.Minute)
 	defer staticsTicker.Stop()
+	presenceTicker := time.NewTicker(presencePeriod)
+	defer presenceTicker.Stop()
+
+	// Let the other instances know about this one, they answer with their own presence
+	relay.publishPresence(0, false)
+
 	var nRegistered, nUnregistered, nBroadcasts int
 	for {
 		select {
@@ -156,32 +338,89 @@ func (h *ConnectionsHub) runConnectionsHub() {
 		// A new connection arrived to be registered
 		case conn := <-h.register:
 			nRegistered++
+			registeredCounter.Inc()
 			h.log("Registering a connection")
 			h.registerConnection(conn, connectionsList, connectionsMap)
+			auditConnection(audit.WsConnect, conn, "")
+			if conn.resume != nil {
+				h.resumeConnection(conn, seqr)
+			}
+			relay.publishPresence(connectionsList.Len(), false)
 
-			responseData := processNCurrentClientsCommand(connectionsList)
-			h.broadcastMessage(responseData, connectionsList, connectionsMap)
+			responseData := processNCurrentClientsCommand(clusterClients(connectionsList, remoteInstances))
+			h.broadcastMessage(responseData, seqr, connectionsList, connectionsMap)
 
 			// A connection needs to be deleted
 		case conn := <-h.unregister:
 			nUnregistered++
+			unregisteredCounter.Inc()
 			h.log("Unregistering a connection")
 
+			topics.removeConnection(conn)
 			h.removeConnection(conn, connectionsList, connectionsMap)
-			responseData := processNCurrentClientsCommand(connectionsList)
+			relay.publishPresence(connectionsList.Len(), false)
+			responseData := processNCurrentClientsCommand(clusterClients(connectionsList, remoteInstances))
 			// Broadcast the updated Client connections count
-			h.broadcastMessage(responseData, connectionsList, connectionsMap)
+			h.broadcastMessage(responseData, seqr, connectionsList, connectionsMap)
 
 			// A message needs to be broadcasted
 		case message := <-h.broadcast:
 			nBroadcasts++
-			nconn := connectionsList.Len()
-			if nconn > 0 {
-				//h.log("Broadcasting to ", nconn, " connections")
-				h.broadcastMessage(message, connectionsList, connectionsMap)
+			broadcastsCounter.Inc()
+			// Numbered even without clients, the ones coming back resume from it
+			h.broadcastMessage(message, seqr, connectionsList, connectionsMap)
+			// Another instance broadcasted a message
+		case message := <-h.remoteBroadcast:
+			nBroadcasts++
+			remoteBroadcastsCounter.Inc()
+			h.broadcastMessage(message, seqr, connectionsList, connectionsMap)
+
+			// A message was published on a topic, here or by another instance
+		case p := <-h.publish:
+			h.publishMessage(p, topics, connectionsList, connectionsMap)
+		case p := <-h.remotePublish:
+			h.publishMessage(p, topics, connectionsList, connectionsMap)
+
+		case membership := <-h.membership:
+			membership.response <- processTopicMembership(membership, topics, connectionsMap)
+
+		case sample := <-h.incomingLatency:
+			processLatencySample(sample, connectionsMap)
+
+		case response := <-h.listConnections:
+			response <- listConnections(connectionsList)
+
+			// Another instance reported its number of clients
+		case presence := <-h.remotePresence:
+			before := clusterClients(connectionsList, remoteInstances)
+			if _, known := remoteInstances[presence.Instance]; !known && !presence.Leaving {
+				h.log("Instance ", presence.Instance, " joined the cluster")
+				relay.publishPresence(connectionsList.Len(), false)
+			}
+			if presence.Leaving {
+				h.log("Instance ", presence.Instance, " left the cluster")
+				delete(remoteInstances, presence.Instance)
 			} else {
-				//h.log("No clients to broadcast")
+				remoteInstances[presence.Instance] = remoteInstance{nClients: presence.Number, lastSeen: time.Now()}
+			}
+			if n := clusterClients(connectionsList, remoteInstances); n != before {
+				h.broadcastMessage(processNCurrentClientsCommand(n), seqr, connectionsList, connectionsMap)
+			}
+
+			// Time to tell the other instances this one is alive, and forget the silent ones
+		case now := <-presenceTicker.C:
+			relay.publishPresence(connectionsList.Len(), false)
+			before := clusterClients(connectionsList, remoteInstances)
+			for id, instance := range remoteInstances {
+				if now.Sub(instance.lastSeen) > presenceTimeout {
+					h.log("Instance ", id, " timed out")
+					delete(remoteInstances, id)
+				}
+			}
+			if n := clusterClients(connectionsList, remoteInstances); n != before {
+				h.broadcastMessage(processNCurrentClientsCommand(n), seqr, connectionsList, connectionsMap)
 			}
+
 		case cMessage := <-h.send:
 			err := h.sendMessage(cMessage, connectionsList, connectionsMap)
 			if err != nil {
@@ -192,19 +431,92 @@ func (h *ConnectionsHub) runConnectionsHub() {
 			h.log("Dispatching NCurrentClients Command")
 			// The generic way would be something like
 			// request.Response <- request.ConnectionsHubResponseFunction(connectionsList)
-			responseData := processNCurrentClientsCommand(connectionsList)
+			responseData := processNCurrentClientsCommand(clusterClients(connectionsList, remoteInstances))
 			request.SendCommandResponse(responseData)
 			//request.Response <- responseData
 
+		case d := <-h.disconnect:
+			conn, ok := connectionsMap[d.connID]
+			if !ok {
+				h.log("The connection ", d.connID, " to close was not found")
+				continue
+			}
+			h.log("Closing the connection ", d.connID)
+			if d.lastMessage != nil {
+				select {
+				case conn.send <- d.lastMessage:
+				default:
+				}
+			}
+			// The write pump sends the queued messages before the close frame
+			conn.closeMessage = d.closeMessage
+			topics.removeConnection(conn)
+			h.removeConnection(conn, connectionsList, connectionsMap)
+
+		case revocation := <-h.revoke:
+			h.closeRevokedConnections(revocation, topics, connectionsList, connectionsMap)
+
+		case <-h.closeEventStreams:
+			for e := connectionsList.Front(); e != nil; {
+				conn := e.Value.(*Conn)
+				e = e.Next()
+				if conn.kind == eventStreamConnection {
+					h.removeConnection(conn, connectionsList, connectionsMap)
+				}
+			}
+
+		case request := <-h.incomingRefreshTokenCommand:
+			h.log("Dispatching RefreshToken Command")
+			request.SendCommandResponse(processRefreshTokenCommand(request, connectionsMap))
+
 		case <-staticsTicker.C:
 			h.log("Connections Hub Statics of the last munute: ", nBroadcasts, " broadcasts handled\t\t\t\t", nRegistered, " connections registered\t\t\t\t", nUnregistered, " connections unregistered")
 			nBroadcasts = 0
 			nRegistered = 0
 			nUnregistered = 0
+			topics.sweep(connectionsMap)
+
+			// The server is shutting down: close every connection and stop the hub
+		case closedConnections := <-h.shutdown:
+			h.log("Shutting down, closing ", connectionsList.Len(), " connections")
+			closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "The server is shutting down")
+			closedConnections <- h.closeAllConnections(closeMessage, connectionsList, connectionsMap)
+			relay.publishPresence(0, true)
+			close(h.done)
+			return
 		}
 	}
 }
 
+// stop closes every connection with a going away close frame, stops the hub and waits until the write pumps
+// of the closed connections are done or ctx expires.
+func (h *ConnectionsHub) stop(ctx context.Context) error {
+	// Buffered, the hub mustn't block on it if the wait below gives up
+	closedConnections := make(chan []*Conn, 1)
+	select {
+	case h.shutdown <- closedConnections:
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var closed []*Conn
+	select {
+	case closed = <-closedConnections:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for _, conn := range closed {
+		select {
+		case <-conn.closed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
 func Init() {
 
 	log.Println("INIT MessagesHUB.GO >>> ", commons.GetInitCounter())
@@ -213,9 +525,45 @@ func Init() {
 	log.Println("INIT ConnectionsHUB.GO >>> ", commons.GetInitCounter())
 
 	RegisterMessagesHandler(RequestMessagesHandler{requestType: apicommands.ServerNConnectionsPush, handler: connectionsHub.requestNCurrentClientsCommand})
+	RegisterMessagesHandler(NewRequestMessageHandler(apicommands.ClientRefreshToken, connectionsHub.requestRefreshTokenCommand,
+		AuthenticatedMiddleware, ValidatePayload(func() interface{} { return &ApiRefreshTokenRequest{} }), Timeout(refreshTokenTimeout)))
+	RegisterMessagesHandler(RequestMessagesHandler{requestType: apicommands.ClientHello, handler: requestHelloCommand})
+	RegisterMessagesHandler(RequestMessagesHandler{requestType: apicommands.ClientStats, handler: requestStatsCommand})
+	validateTopics := ValidatePayload(func() interface{} { return &ApiTopicsRequest{} })
+	RegisterMessagesHandler(NewRequestMessageHandler(apicommands.ClientJoinTopics, requestTopicsCommand, AuthenticatedMiddleware, validateTopics))
+	RegisterMessagesHandler(NewRequestMessageHandler(apicommands.ClientLeaveTopics, requestTopicsCommand, AuthenticatedMiddleware, validateTopics))
+	RegisterMessagesHandler(NewRequestMessageHandler(apicommands.ClientPong, connectionsHub.requestPongCommand,
+		ValidatePayload(func() interface{} { return &ApiPongRequest{} })))
+	RegisterMessagesHandler(NewRequestMessageHandler(apicommands.ClientConnections, requestConnectionsCommand, AuthenticatedMiddleware))
 	log.Println("INIT ConnectionsHUB.GO >>> Back from registering messages handler")
+	if err := relay.start(); err != nil {
+		log.Println("INIT ConnectionsHUB.GO >>> Error subscribing to the backplane: ", err)
+	}
 	go connectionsHub.runConnectionsHub()
 
 	//pid.SetBroadcastHandle(Broadcast)
 
 }
+
+// CloseEventStreams ends every event stream. Unlike websockets, they're still HTTP requests, so the HTTP server
+// waits for them when shutting down.
+func CloseEventStreams() {
+	select {
+	case connectionsHub.closeEventStreams <- struct{}{}:
+	case <-connectionsHub.done:
+	}
+}
+
+// Shutdown stops the messages and connections hubs. Every client is sent a going away close frame, and Shutdown
+// waits until they are written or ctx expires.
+func Shutdown(ctx context.Context) error {
+	log.Println("SHUTDOWN MessagesHUB.GO")
+	if err := messagesHub.stop(ctx); err != nil {
+		return err
+	}
+	log.Println("SHUTDOWN ConnectionsHUB.GO")
+	if err := connectionsHub.stop(ctx); err != nil {
+		return err
+	}
+	return relay.stop(ctx)
+}
@@ -0,0 +1,88 @@
+package wslogic
+
+import (
+	"container/list"
+	"encoding/json"
+	"local/gintest/apicommands"
+	"log"
+	"time"
+)
+
+var connectionKindNames = map[connectionKind]string{
+	webSocketConnection:   "websocket",
+	eventStreamConnection: "eventstream",
+}
+
+// ApiConnection describes a connection of this instance.
+type ApiConnection struct {
+	ID          int       `json:"id"`
+	Kind        string    `json:"kind"`
+	UserID      string    `json:"user"`
+	Roles       []string  `json:"roles"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	Topics      []string  `json:"topics"`
+	ApiLatency
+	LastPong *time.Time `json:"lastPong,omitempty"`
+}
+
+type ConnectionsResponse struct {
+	ApiResponseHeader
+	Connections []ApiConnection `json:"connections"`
+}
+
+func NewConnectionsResponse(connections []ApiConnection) ConnectionsResponse {
+	return ConnectionsResponse{
+		ApiResponseHeader: ApiResponseHeader{
+			Command: apicommands.ClientConnections,
+		},
+		Connections: connections,
+	}
+}
+
+func (r *ConnectionsResponse) Stringify() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func listConnections(connectionsList *list.List) []ApiConnection {
+	connections := make([]ApiConnection, 0, connectionsList.Len())
+	for e := connectionsList.Front(); e != nil; e = e.Next() {
+		conn := e.Value.(*Conn)
+		connection := ApiConnection{
+			ID:          int(conn.connID),
+			Kind:        connectionKindNames[conn.kind],
+			UserID:      conn.userID,
+			Roles:       conn.Roles(),
+			ConnectedAt: conn.connectedAt,
+			ExpiresAt:   conn.expiresAt,
+			Topics:      connectionTopics(conn),
+			ApiLatency:  newApiLatency(conn.latency),
+		}
+		if conn.latency.samples > 0 {
+			lastPong := conn.latency.lastPong
+			connection.LastPong = &lastPong
+		}
+		connections = append(connections, connection)
+	}
+	return connections
+}
+
+// Connections lists the connections of this instance, with the latency measured on each one.
+func Connections() []ApiConnection {
+	response := make(chan []ApiConnection, 1)
+	select {
+	case connectionsHub.listConnections <- response:
+		return <-response
+	case <-connectionsHub.done:
+		return []ApiConnection{}
+	}
+}
+
+func requestConnectionsCommand(request CommandRequest) RawResponseData {
+	responseStruct := NewConnectionsResponse(Connections())
+	bytes, err := responseStruct.Stringify()
+	if err != nil {
+		log.Println("ERROR requestConnectionsCommand >>>> Couldn't stringify the response structure!")
+	}
+	return bytes
+}
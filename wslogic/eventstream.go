@@ -0,0 +1,181 @@
+package wslogic
+
+import (
+	"encoding/json"
+	"fmt"
+	"local/gintest/apicommands"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// The pushes relayed to event streams, the only messages they get.
+var eventStreamCommands = map[apicommands.CommandType]bool{
+	apicommands.ServerSignalUpdateListPush: true,
+	apicommands.ServerNConnectionsPush:     true,
+	apicommands.ServerResumePush:           true,
+	apicommands.ServerCompleteSignalList:   true,
+}
+
+// pidsFilter holds the indexes of the pids to keep from the signal update lists.
+type pidsFilter map[int]bool
+
+func newPidsFilter(indexes []int) pidsFilter {
+	filter := make(pidsFilter, len(indexes))
+	for _, index := range indexes {
+		filter[index] = true
+	}
+	return filter
+}
+
+type apiPidsList struct {
+	ApiResponseHeader
+	List []json.RawMessage `json:"pids"`
+}
+
+type apiPidIndex struct {
+	Index int `json:"index"`
+}
+
+// apply returns the message with only the filtered pids, or false if none of them is in it.
+func (f pidsFilter) apply(message []byte) ([]byte, bool) {
+	if len(f) == 0 {
+		return message, true
+	}
+	var list apiPidsList
+	if err := json.Unmarshal(message, &list); err != nil {
+		return nil, false
+	}
+	kept := list.List[:0]
+	for _, pid := range list.List {
+		var index apiPidIndex
+		if json.Unmarshal(pid, &index) == nil && f[index.Index] {
+			kept = append(kept, pid)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, false
+	}
+	list.List = kept
+	filtered, err := json.Marshal(list)
+	return filtered, err == nil
+}
+
+// NewEventStreamConn returns a new Connection to stream the server pushes of session as Server-Sent Events, until
+// it expires or is revoked. Only the pids with the given indexes are streamed, or every one if there are none.
+func NewEventStreamConn(session Session, pids []int) *Conn {
+	conn := &Conn{
+		kind:         eventStreamConnection,
+		send:         make(chan []byte, sizeMsgChanBuffer),
+		closed:       make(chan struct{}),
+		userID:       session.UserID,
+		expiresAt:    session.ExpiresAt,
+		sessionID:    session.ID,
+		sessionStart: session.StartedAt,
+		refreshed:    make(chan time.Time, 1),
+		pids:         newPidsFilter(pids),
+		topics:       make(map[string]struct{}),
+		connectedAt:  time.Now(),
+		connID:       connectionID(atomic.AddInt32(&sessionCounter, 1) - 1),
+	}
+	conn.setRoles(session.Roles)
+	return conn
+}
+
+// writeEvent writes a message as an event named after its command.
+func (c *Conn) writeEvent(w http.ResponseWriter, message []byte) error {
+	var header ApiResponseHeader
+	if err := json.Unmarshal(message, &header); err != nil {
+		return nil
+	}
+	if !eventStreamCommands[header.Command] {
+		return nil
+	}
+	if header.Command == apicommands.ServerSignalUpdateListPush || header.Command == apicommands.ServerCompleteSignalList {
+		var ok bool
+		if message, ok = c.pids.apply(message); !ok {
+			return nil
+		}
+	}
+	// Numbered broadcasts carry an ID, for the clients to resume the stream from once reconnected
+	id := ""
+	if header.Seq > 0 {
+		id = fmt.Sprint("id: ", ResumePoint{Stream: streamID, Seq: header.Seq}, "\n")
+	}
+	n, err := fmt.Fprintf(w, "%sevent: %s\ndata: %s\n\n", id, header.Command.Name(), message)
+	if err == nil {
+		messagesSentCounter.Inc()
+		bytesSentCounter.Add(int64(n))
+	}
+	return err
+}
+
+// EventStreamPump pumps the messages from the hub to the client as Server-Sent Events, until the client goes
+// away, the hub closes the connection or the session token expires. The connection must have been registered.
+func (c *Conn) EventStreamPump(w http.ResponseWriter, r *http.Request) {
+	ticker := time.NewTicker(pingPeriod)
+	expirationTimer := time.NewTimer(time.Until(c.expiresAt))
+	defer func() {
+		c.log("exiting eventStreamPump()")
+		ticker.Stop()
+		expirationTimer.Stop()
+		Unregister(c)
+		close(c.closed)
+	}()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		c.log("The response writer can't be flushed, unable to stream events")
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	// Keep reverse proxies from buffering the stream
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				c.log("The hub closed this connection")
+				return
+			}
+			if err := c.writeEvent(w, message); err != nil {
+				c.log("Error writing an event: ", err.Error())
+				return
+			}
+			// Send queued messages to the client before flushing.
+			for n := len(c.send); n > 0; n-- {
+				if err := c.writeEvent(w, <-c.send); err != nil {
+					c.log("Error writing a queued event: ", err.Error())
+					return
+				}
+			}
+			flusher.Flush()
+
+		case <-ticker.C:
+			// A comment keeps proxies from timing out the stream and detects gone clients
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				c.log("Error on ping: ", err.Error())
+				return
+			}
+			flusher.Flush()
+
+		case <-c.refreshed:
+			// Event streams can't take commands, so there's nothing to refresh
+
+		case <-expirationTimer.C:
+			c.log("The session token expired, closing the event stream")
+			return
+
+		case <-r.Context().Done():
+			c.log("The client closed the event stream")
+			return
+		}
+	}
+}
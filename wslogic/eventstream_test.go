@@ -0,0 +1,75 @@
+package wslogic
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPidsFilter(t *testing.T) {
+	list := `{"command":2,"status":0,"pids":[{"index":1,"value":10},{"index":2},{"index":3}]}`
+	tests := []struct {
+		filter  []int
+		message string
+		kept    []int
+		ok      bool
+	}{
+		// No filter keeps the message as it is, even one that isn't a list
+		{nil, list, []int{1, 2, 3}, true},
+		{nil, `not json`, nil, true},
+		{[]int{1, 3}, list, []int{1, 3}, true},
+		{[]int{3, 7}, list, []int{3}, true},
+		{[]int{7}, list, nil, false},
+		{[]int{1}, `{"command":2,"pids":[]}`, nil, false},
+		{[]int{1}, `{"command":2,"pids":[{"name":"no index"}]}`, nil, false},
+		{[]int{1}, `not json`, nil, false},
+	}
+	for _, test := range tests {
+		filtered, ok := newPidsFilter(test.filter).apply([]byte(test.message))
+		if ok != test.ok {
+			t.Errorf("Filtering %s by %v kept %v, expected %v", test.message, test.filter, ok, test.ok)
+			continue
+		}
+		if !ok || len(test.filter) == 0 {
+			continue
+		}
+		var got struct {
+			Command int
+			Pids    []struct{ Index int }
+		}
+		if err := json.Unmarshal(filtered, &got); err != nil || got.Command != 2 {
+			t.Errorf("Filtering %s by %v gave %s", test.message, test.filter, filtered)
+			continue
+		}
+		indexes := make([]int, len(got.Pids))
+		for i, pid := range got.Pids {
+			indexes[i] = pid.Index
+		}
+		if fmt.Sprint(indexes) != fmt.Sprint(test.kept) {
+			t.Errorf("Filtering %s by %v kept %v, expected %v", test.message, test.filter, indexes, test.kept)
+		}
+	}
+}
+
+func TestWriteEvent(t *testing.T) {
+	conn := NewEventStreamConn(Session{UserID: "a"}, []int{1})
+	for message, want := range map[string]string{
+		// Only the pushes relayed to event streams are written
+		`{"command":5}`:       "",
+		`not json`:            "",
+		`{"command":3,"n":1}`: "event: NConnectionsPush\ndata: {\"command\":3,\"n\":1}\n\n",
+		`{"command":2,"seq":4,"pids":[{"index":1}]}`: fmt.Sprint("id: ", ResumePoint{Stream: streamID, Seq: 4}, "\nevent: SignalUpdateListPush\n"),
+		// Nothing is left once filtered
+		`{"command":2,"seq":5,"pids":[{"index":2}]}`: "",
+	} {
+		recorder := httptest.NewRecorder()
+		if err := conn.writeEvent(recorder, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		if got := recorder.Body.String(); !strings.HasPrefix(got, want) || (want == "") != (got == "") {
+			t.Errorf("Wrong event for %s: %q", message, got)
+		}
+	}
+}
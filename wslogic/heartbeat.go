@@ -0,0 +1,139 @@
+package wslogic
+
+import (
+	"encoding/json"
+	"local/gintest/apicommands"
+	"log"
+	"time"
+)
+
+const (
+	// Period of the application level pings, measuring the latency of the websocket clients
+	heartbeatPeriod = 15 * time.Second
+
+	// Weight of a new round trip time in the smoothed one, like TCP does
+	rttSmoothing = 0.125
+)
+
+const (
+	errorPongStatus ResponseStatusType = -1
+)
+
+type ApiPing = apicommands.ApiPing
+type PingPush = apicommands.PingPush
+
+func NewPingPush(sent time.Time) PingPush {
+	return PingPush{
+		ApiResponseHeader: ApiResponseHeader{
+			Command: apicommands.ServerPingPush,
+		},
+		ApiPing: ApiPing{Sent: sent.UnixNano()},
+	}
+}
+
+type ApiPongRequest = apicommands.ApiPongRequest
+
+// latencySample measures the link to a client NTP style: t0 and t3 are read on the server, t1 and t2 on the client.
+type latencySample struct {
+	connID connectionID
+	rtt    time.Duration
+	offset time.Duration
+	at     time.Time
+}
+
+func newLatencySample(connID connectionID, pong ApiPongRequest, now time.Time) latencySample {
+	t0, t1, t2, t3 := pong.Sent, pong.Received, pong.Replied, now.UnixNano()
+	if t2 == 0 {
+		t2 = t1
+	}
+	rtt := time.Duration((t3 - t0) - (t2 - t1))
+	if rtt < 0 {
+		rtt = 0
+	}
+	return latencySample{
+		connID: connID,
+		rtt:    rtt,
+		offset: time.Duration(((t1 - t0) + (t2 - t3)) / 2),
+		at:     now,
+	}
+}
+
+// connectionLatency is what's known about the link to a client.
+type connectionLatency struct {
+	rtt         time.Duration
+	smoothedRTT time.Duration
+	offset      time.Duration
+	samples     int
+	lastPong    time.Time
+}
+
+func (l *connectionLatency) add(sample latencySample) {
+	l.rtt = sample.rtt
+	l.offset = sample.offset
+	if l.samples == 0 {
+		l.smoothedRTT = sample.rtt
+	} else {
+		l.smoothedRTT += time.Duration(rttSmoothing * float64(sample.rtt-l.smoothedRTT))
+	}
+	l.samples++
+	l.lastPong = sample.at
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type ApiLatency = apicommands.ApiLatency
+
+func newApiLatency(l connectionLatency) ApiLatency {
+	return ApiLatency{
+		RTT:         milliseconds(l.rtt),
+		SmoothedRTT: milliseconds(l.smoothedRTT),
+		ClockOffset: milliseconds(l.offset),
+		Samples:     l.samples,
+	}
+}
+
+type LatencyPush = apicommands.LatencyPush
+
+func NewLatencyPush(latency ApiLatency) LatencyPush {
+	return LatencyPush{
+		ApiResponseHeader: ApiResponseHeader{
+			Command: apicommands.ServerLatencyPush,
+		},
+		ApiLatency: latency,
+	}
+}
+
+func (h *ConnectionsHub) requestPongCommand(request CommandRequest) RawResponseData {
+	var pong ApiPongRequest
+	if err := json.Unmarshal(request.data, &pong); err != nil {
+		return NewErrorResponse(request.command, errorPongStatus, "The Pong request is unrecognizable")
+	}
+	sample := newLatencySample(request.connID, pong, time.Now())
+	select {
+	case h.incomingLatency <- sample:
+	case <-h.done:
+	}
+	// The hub answers with the latency push
+	return nil
+}
+
+// processLatencySample records a sample of the latency of a connection and tells the client.
+func processLatencySample(sample latencySample, connectionsMap map[connectionID]*Conn) {
+	conn, ok := connectionsMap[sample.connID]
+	if !ok {
+		return
+	}
+	conn.latency.add(sample)
+	push := NewLatencyPush(newApiLatency(conn.latency))
+	data, err := push.Stringify()
+	if err != nil {
+		log.Println("ERROR processLatencySample >>>> Couldn't stringify the latency push!")
+		return
+	}
+	select {
+	case conn.send <- data:
+	default:
+	}
+}
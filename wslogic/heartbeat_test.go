@@ -0,0 +1,31 @@
+package wslogic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencySample(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	// The client clock is 2s ahead, each way takes 30ms and the client takes 5ms to answer
+	pong := ApiPongRequest{
+		Sent:     t0.UnixNano(),
+		Received: t0.Add(2*time.Second + 30*time.Millisecond).UnixNano(),
+		Replied:  t0.Add(2*time.Second + 35*time.Millisecond).UnixNano(),
+	}
+	sample := newLatencySample(0, pong, t0.Add(65*time.Millisecond))
+	if sample.rtt != 60*time.Millisecond {
+		t.Error("Wrong round trip time: ", sample.rtt)
+	}
+	if sample.offset != 2*time.Second {
+		t.Error("Wrong clock offset: ", sample.offset)
+	}
+
+	var latency connectionLatency
+	latency.add(sample)
+	sample.rtt = 140 * time.Millisecond
+	latency.add(sample)
+	if latency.samples != 2 || latency.smoothedRTT != 70*time.Millisecond {
+		t.Error("Wrong smoothed round trip time: ", latency.smoothedRTT)
+	}
+}
@@ -0,0 +1,125 @@
+package wslogic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"local/gintest/apicommands"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// The protocol version spoken by this server, and the oldest one still supported.
+	protocolVersion    = 1
+	minProtocolVersion = 1
+
+	jsonEncoding = "json"
+
+	tokenRefreshFeature = "tokenRefresh"
+)
+
+const (
+	errorHelloStatus ResponseStatusType = -1
+)
+
+// The optional features clients may ask for.
+var supportedFeatures = []string{tokenRefreshFeature, batchFeature}
+
+// The message encodings, by order of preference.
+var supportedEncodings = []string{jsonEncoding}
+
+type ApiHelloRequest = apicommands.ApiHelloRequest
+type ApiCommandDescription = apicommands.ApiCommandDescription
+type ApiHello = apicommands.ApiHello
+type HelloResponse = apicommands.HelloResponse
+
+func NewHelloResponse(hello ApiHello) HelloResponse {
+	return HelloResponse{
+		ApiResponseHeader: ApiResponseHeader{
+			Command: apicommands.ClientHello,
+		},
+		ApiHello: hello,
+	}
+}
+
+func commandDescriptions() []ApiCommandDescription {
+	commands := apicommands.Commands()
+	descriptions := make([]ApiCommandDescription, len(commands))
+	for i, command := range commands {
+		descriptions[i] = ApiCommandDescription{ID: command, Name: command.Name()}
+	}
+	return descriptions
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate settles the protocol version, features and encoding to use with a client.
+func negotiate(request ApiHelloRequest) (ApiHello, error) {
+	version := request.Version
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+	if version < minProtocolVersion {
+		return ApiHello{}, fmt.Errorf("Unsupported protocol version %d, the server speaks %d to %d", request.Version, minProtocolVersion, protocolVersion)
+	}
+
+	features := []string{}
+	for _, feature := range request.Features {
+		if contains(supportedFeatures, feature) {
+			features = append(features, feature)
+		}
+	}
+
+	encoding := jsonEncoding
+	if len(request.Encodings) > 0 {
+		encoding = ""
+		for _, supported := range supportedEncodings {
+			if contains(request.Encodings, supported) {
+				encoding = supported
+				break
+			}
+		}
+		if encoding == "" {
+			return ApiHello{}, errors.New("None of the requested encodings is supported")
+		}
+	}
+
+	return ApiHello{
+		Version:  version,
+		Features: features,
+		Encoding: encoding,
+		Stream:   streamID,
+		Commands: commandDescriptions(),
+	}, nil
+}
+
+// requestHelloCommand answers the client with the negotiated protocol, or closes the connection if there's no
+// protocol both sides speak.
+func requestHelloCommand(request CommandRequest) RawResponseData {
+	var hello ApiHelloRequest
+	if err := json.Unmarshal(request.data, &hello); err != nil {
+		responseStruct := NewApiResponseHeader(apicommands.ClientHello, errorHelloStatus, "The Hello request is unrecognizable")
+		bytes, _ := responseStruct.Stringify()
+		return bytes
+	}
+
+	negotiated, err := negotiate(hello)
+	if err != nil {
+		responseStruct := NewApiResponseHeader(apicommands.ClientHello, errorHelloStatus, err.Error())
+		bytes, _ := responseStruct.Stringify()
+		disconnect(request.connID, bytes, websocket.CloseProtocolError, "Unsupported protocol")
+		return nil
+	}
+
+	responseStruct := NewHelloResponse(negotiated)
+	bytes, _ := responseStruct.Stringify()
+	return bytes
+}
@@ -0,0 +1,54 @@
+package wslogic
+
+import (
+	"local/gintest/apicommands"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		request  ApiHelloRequest
+		version  int
+		features string
+		encoding string
+		fails    bool
+	}{
+		// The clients not stating a version predate the handshake
+		{request: ApiHelloRequest{}, fails: true},
+		{request: ApiHelloRequest{Version: -1}, fails: true},
+		{request: ApiHelloRequest{Version: 1}, version: 1, encoding: jsonEncoding},
+		// A newer client speaks the version of the server
+		{request: ApiHelloRequest{Version: protocolVersion + 5}, version: protocolVersion, encoding: jsonEncoding},
+		{request: ApiHelloRequest{Version: 1, Features: []string{"compression", batchFeature, tokenRefreshFeature}}, version: 1, features: "batch,tokenRefresh", encoding: jsonEncoding},
+		{request: ApiHelloRequest{Version: 1, Encodings: []string{"msgpack", jsonEncoding}}, version: 1, encoding: jsonEncoding},
+		{request: ApiHelloRequest{Version: 1, Encodings: []string{"msgpack"}}, fails: true},
+	}
+	for _, test := range tests {
+		hello, err := negotiate(test.request)
+		if (err != nil) != test.fails {
+			t.Errorf("Negotiating %+v failed: %v", test.request, err)
+			continue
+		}
+		if test.fails {
+			continue
+		}
+		if hello.Version != test.version || strings.Join(hello.Features, ",") != test.features || hello.Encoding != test.encoding {
+			t.Errorf("Negotiating %+v gave %+v", test.request, hello)
+		}
+		if len(hello.Commands) != len(apicommands.Commands()) || hello.Stream != streamID {
+			t.Errorf("Negotiating %+v gave the wrong commands or stream", test.request)
+		}
+	}
+}
+
+func TestCommandDescriptions(t *testing.T) {
+	for _, description := range commandDescriptions() {
+		if description.Name == "" {
+			t.Error("The command ", description.ID, " has no name")
+		}
+		if description.ID == apicommands.ClientHello && description.Name != "Hello" {
+			t.Error("Wrong name of the hello command: ", description.Name)
+		}
+	}
+}
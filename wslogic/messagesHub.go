@@ -1,6 +1,7 @@
 package wslogic
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"local/gintest/apicommands"
@@ -8,7 +9,7 @@ import (
 	"time"
 )
 
-type ResponseStatusType int
+type ResponseStatusType = apicommands.ResponseStatusType
 
 const notSupportedCommandResponse = -1
 const requestNotSupportedStatus ResponseStatusType = -1
@@ -30,6 +31,15 @@ type CommandRequest struct {
 	command  apicommands.CommandType
 	data     RawRequestData
 	response chan RawResponseData
+
+	// The connection the request came from, its user, the roles of the user and its address, if any
+	connID   connectionID
+	userID   string
+	roles    []string
+	clientIP string
+
+	// Set by the Timeout middleware, so that the handler doesn't apply what the client was told failed
+	deadline *commandDeadline
 }
 
 func NewCommandRequest(command apicommands.CommandType, data []byte) CommandRequest {
@@ -40,6 +50,31 @@ func NewCommandRequest(command apicommands.CommandType, data []byte) CommandRequ
 	}
 }
 
+func (cr *CommandRequest) Command() apicommands.CommandType {
+	return cr.command
+}
+
+func (cr *CommandRequest) Data() RawRequestData {
+	return cr.data
+}
+
+// UserID returns the user of the connection the request came from, or "" for the requests of the server.
+func (cr *CommandRequest) UserID() string {
+	return cr.userID
+}
+
+// Roles returns the roles of the user the request came from.
+func (cr *CommandRequest) Roles() []string {
+	return cr.roles
+}
+
+// Commit tells whether the handler may still apply the effects of the command, which it must call right before
+// doing so when the command has a Timeout. Once it returned true, the client gets the response of the handler
+// rather than a timeout error.
+func (cr *CommandRequest) Commit() bool {
+	return cr.deadline.commit()
+}
+
 func (cr *CommandRequest) SendCommandResponse(response RawResponseData) {
 	if cr.response == nil {
 		log.Println(">> COMMAND REQUEST ERROR: Response channel is Nil")
@@ -57,33 +92,28 @@ type messageHandler func(CommandRequest) RawResponseData
 type RequestMessagesHandler struct {
 	requestType apicommands.CommandType //commons.CommandRequestType
 	handler     messageHandler
+
+	// Wrapping the handler inside the middlewares every handler gets
+	middlewares []MessageMiddleware
 }
 
-func NewRequestMessageHandler(requestType apicommands.CommandType, handler messageHandler) RequestMessagesHandler {
+func NewRequestMessageHandler(requestType apicommands.CommandType, handler messageHandler, middlewares ...MessageMiddleware) RequestMessagesHandler {
 	return RequestMessagesHandler{
 		requestType: requestType,
 		handler:     handler,
+		middlewares: middlewares,
 	}
 }
 
-type ApiRequestHeader struct {
-	Command apicommands.CommandType `json:"command"`
-}
+type ApiRequestHeader = apicommands.ApiRequestHeader
 
-type ApiResponseHeader struct {
-	Command apicommands.CommandType `json:"command"`
-	Status  ResponseStatusType      `json:"status"`
-	Error   string                  `json:"error,omitempty"`
-}
+// ApiResponseHeader heads every response and push. Its Seq numbers the broadcasts, see sequence.go
+type ApiResponseHeader = apicommands.ApiResponseHeader
 
 func NewApiResponseHeader(responseType apicommands.CommandType, status ResponseStatusType, err string) ApiResponseHeader {
 	return ApiResponseHeader{Command: responseType, Status: status, Error: err}
 }
 
-func (r *ApiResponseHeader) Stringify() ([]byte, error) {
-	return json.Marshal(r)
-}
-
 type MessagesHub struct {
 
 	// Incoming messages from the connections
@@ -91,12 +121,20 @@ type MessagesHub struct {
 
 	registerHandler   chan RequestMessagesHandler
 	unregisterHandler chan RequestMessagesHandler
+
+	// Shutdown requests
+	shutdown chan struct{}
+
+	// Closed when the hub stops running.
+	done chan struct{}
 }
 
 var messagesHub = MessagesHub{
 	incomingMessage:   make(chan clientMessage),
 	registerHandler:   make(chan RequestMessagesHandler),
 	unregisterHandler: make(chan RequestMessagesHandler),
+	shutdown:          make(chan struct{}),
+	done:              make(chan struct{}),
 }
 
 func (h *MessagesHub) log(v ...interface{}) {
@@ -121,15 +159,41 @@ func (h *MessagesHub) logf(format string, v ...interface{}) {
 }
 
 func processClientMessage(cm clientMessage) {
-	messagesHub.incomingMessage <- cm
+	select {
+	case messagesHub.incomingMessage <- cm:
+	case <-messagesHub.done:
+	}
 }
 
 func RegisterMessagesHandler(handler RequestMessagesHandler) {
-	messagesHub.registerHandler <- handler
+	select {
+	case messagesHub.registerHandler <- handler:
+	case <-messagesHub.done:
+	}
 }
 
 func UnregisterMessagesHandler(handler RequestMessagesHandler) {
-	messagesHub.unregisterHandler <- handler
+	select {
+	case messagesHub.unregisterHandler <- handler:
+	case <-messagesHub.done:
+	}
+}
+
+// stop makes the hub quit handling messages and waits until it does or ctx expires.
+func (h *MessagesHub) stop(ctx context.Context) error {
+	select {
+	case h.shutdown <- struct{}{}:
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func safeSend(send chan []byte, msg []byte) error {
@@ -143,6 +207,35 @@ func safeSend(send chan []byte, msg []byte) error {
 	return err
 }
 
+// handleCommand runs the handler of a command request and returns its response.
+func (h *MessagesHub) handleCommand(requestHandlersMap map[apicommands.CommandType]messageHandler, from clientMessage, message []byte) RawResponseData {
+	var cmm ApiRequestHeader
+	err := json.Unmarshal(message, &cmm)
+	if err != nil {
+		h.log("Error unmarshalling the event command ", string(message), ": ", err)
+		badRequestResponse := newBadRequestApiResponse()
+		response, _ := badRequestResponse.Stringify()
+		return response
+	}
+
+	handler, ok := requestHandlersMap[cmm.Command]
+	if !ok {
+		// No handler with the command id has been registered
+		h.log("The request command ", cmm.Command, " is not supported.")
+		notSupportedResponse := newNotSupportedStatusAPIResponse(cmm.Command)
+		response, _ := notSupportedResponse.Stringify()
+		return response
+	}
+
+	h.log("The request command ", cmm.Command, " will be processed.")
+	rc := NewCommandRequest(cmm.Command, message)
+	rc.connID = from.connID
+	rc.userID = from.userID
+	rc.roles = from.roles
+	rc.clientIP = from.clientIP
+	return handler(rc)
+}
+
 func (h *MessagesHub) runMessagesHub() {
 
 	requestHandlersMap := make(map[apicommands.CommandType]messageHandler)
@@ -155,7 +248,8 @@ func (h *MessagesHub) runMessagesHub() {
 			if ok { // The is already a handler with the same command request type!
 				h.log("REGISTER MESSAGE HANDLER ERROR! >>>> the request handler ", messageHandler.requestType, " is already registered!")
 			} else {
-				requestHandlersMap[messageHandler.requestType] = messageHandler.handler
+				middlewares := append(append([]MessageMiddleware{}, messagesMiddlewares...), messageHandler.middlewares...)
+				requestHandlersMap[messageHandler.requestType] = chain(messageHandler.handler, middlewares...)
 				h.log("New message handler with id ", messageHandler.requestType, " has been registered. Now there are ", len(requestHandlersMap))
 			}
 			// Unregister a handler
@@ -169,32 +263,22 @@ func (h *MessagesHub) runMessagesHub() {
 			}
 			// handle an incoming message depending on it's request type
 		case clientMessage := <-h.incomingMessage:
-			var cmm ApiRequestHeader
-			err := json.Unmarshal(clientMessage.fromMessage, &cmm)
-			if err != nil {
-				h.log("Error unmarshalling the event command ", string(clientMessage.fromMessage), ": ", err)
-				badRequestResponse := newBadRequestApiResponse()
-				response, _ := badRequestResponse.Stringify()
+			var response RawResponseData
+			if commands, ok := batchCommands(clientMessage.fromMessage); ok {
+				response = h.handleBatch(requestHandlersMap, clientMessage, commands)
+			} else {
+				response = h.handleCommand(requestHandlersMap, clientMessage, clientMessage.fromMessage)
+			}
+			// Some handlers take care of answering on their own
+			if response != nil {
 				clientMessage.setResponseMessage(response)
 				Send(clientMessage)
-			} else {
-
-				handler, ok := requestHandlersMap[cmm.Command]
-				if ok {
-					h.log("The request command ", cmm.Command, " will be processed.")
-					rc := NewCommandRequest(cmm.Command, clientMessage.fromMessage)
-					response := handler(rc)
-					clientMessage.setResponseMessage(response)
-					Send(clientMessage)
-				} else {
-					// No handler with the command id has been registered
-					h.log("The request command ", cmm.Command, " is not supported.")
-					notSupportedResponse := newNotSupportedStatusAPIResponse(cmm.Command)
-					response, _ := notSupportedResponse.Stringify()
-					clientMessage.setResponseMessage(response)
-					Send(clientMessage)
-				}
 			}
+			// The server is shutting down
+		case <-h.shutdown:
+			h.log("Shutting down, ", len(requestHandlersMap), " message handlers registered")
+			close(h.done)
+			return
 		}
 	}
 }
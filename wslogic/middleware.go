@@ -0,0 +1,236 @@
+package wslogic
+
+import (
+	"encoding/json"
+	"fmt"
+	"local/gintest/apicommands"
+	"local/gintest/services/audit"
+	"local/gintest/services/stats"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	internalErrorStatus  ResponseStatusType = -4
+	timeoutStatus        ResponseStatusType = -5
+	unauthorizedStatus   ResponseStatusType = -6
+	forbiddenStatus      ResponseStatusType = -7
+	invalidPayloadStatus ResponseStatusType = -8
+
+	maxErrorResponseSize = 1024
+)
+
+// MessageMiddleware wraps the handler of a command, like a gin middleware wraps a route. It may run code before
+// and after calling next, change the response, or answer on its own without calling next at all.
+type MessageMiddleware func(request CommandRequest, next func(CommandRequest) RawResponseData) RawResponseData
+
+// The middlewares wrapping every handler, the first one being the outermost.
+var messagesMiddlewares = []MessageMiddleware{RecoveryMiddleware, LoggingMiddleware, MetricsMiddleware}
+
+// UseMessagesMiddleware appends middlewares to the ones wrapping every handler. It must be called before Init.
+func UseMessagesMiddleware(middlewares ...MessageMiddleware) {
+	messagesMiddlewares = append(messagesMiddlewares, middlewares...)
+}
+
+// chain wraps handler with middlewares, so that the first middleware runs first.
+func chain(handler messageHandler, middlewares ...MessageMiddleware) messageHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		middleware, next := middlewares[i], handler
+		handler = func(request CommandRequest) RawResponseData {
+			return middleware(request, next)
+		}
+	}
+	return handler
+}
+
+// NewErrorResponse returns the response of a command that failed with status.
+func NewErrorResponse(command apicommands.CommandType, status ResponseStatusType, text string) RawResponseData {
+	header := NewApiResponseHeader(command, status, text)
+	response, _ := header.Stringify()
+	return response
+}
+
+// RecoveryMiddleware turns the panics of the handlers into internal error responses, so a bad command can't bring
+// the messages hub down.
+func RecoveryMiddleware(request CommandRequest, next func(CommandRequest) RawResponseData) (response RawResponseData) {
+	defer func() {
+		if x := recover(); x != nil {
+			log.Println("PANIC handling the command ", request.command, ": ", x, "\n", string(debug.Stack()))
+			response = NewErrorResponse(request.command, internalErrorStatus, "Internal error handling the command")
+		}
+	}()
+	return next(request)
+}
+
+// LoggingMiddleware logs every command with its connection and how long it took, when debugging.
+func LoggingMiddleware(request CommandRequest, next func(CommandRequest) RawResponseData) RawResponseData {
+	start := time.Now()
+	response := next(request)
+	messagesHub.logf("Command %v (%s) from connection %v of %q handled in %v", request.command,
+		request.command.Name(), request.connID, request.userID, time.Since(start))
+	return response
+}
+
+// commandErrors returns the counter of the failed requests of a command.
+func commandErrors(command apicommands.CommandType) *stats.Counter {
+	name := command.Name()
+	if name == "" {
+		name = fmt.Sprint(int(command))
+	}
+	return stats.NewCounter("command." + name + ".errors")
+}
+
+// MetricsMiddleware measures the latency of every command and counts the failed ones.
+func MetricsMiddleware(request CommandRequest, next func(CommandRequest) RawResponseData) RawResponseData {
+	start := time.Now()
+	response := next(request)
+	commandLatency(request.command).Observe(time.Since(start))
+
+	if statusOf(response) < 0 {
+		commandErrors(request.command).Inc()
+	}
+	return response
+}
+
+// statusOf returns the status of a response, 0 for the big ones which can't be errors.
+func statusOf(response RawResponseData) ResponseStatusType {
+	// Error responses are short, don't parse the big ones
+	var header ApiResponseHeader
+	if len(response) > 0 && len(response) < maxErrorResponseSize && json.Unmarshal(response, &header) == nil {
+		return header.Status
+	}
+	return 0
+}
+
+// AuthenticatedMiddleware rejects the commands that don't come from the connection of a user, like the ones the
+// server makes on its own.
+func AuthenticatedMiddleware(request CommandRequest, next func(CommandRequest) RawResponseData) RawResponseData {
+	if request.userID == "" {
+		return NewErrorResponse(request.command, unauthorizedStatus, "The command requires an authenticated user")
+	}
+	return next(request)
+}
+
+// Authorize returns a middleware running the command only if allowed says so for the user sending it.
+func Authorize(allowed func(userID string, command apicommands.CommandType) bool) MessageMiddleware {
+	return func(request CommandRequest, next func(CommandRequest) RawResponseData) RawResponseData {
+		if !allowed(request.userID, request.command) {
+			return NewErrorResponse(request.command, forbiddenStatus,
+				fmt.Sprint("The user ", request.userID, " is not allowed to run the command ", request.command.Name()))
+		}
+		return next(request)
+	}
+}
+
+// AuthorizeRoles returns a middleware running the command only if authorize allows it to the roles of the user
+// sending it, answering with its error otherwise. The commands the server makes on its own are always run.
+func AuthorizeRoles(authorize func(roles []string, command apicommands.CommandType) error) MessageMiddleware {
+	return func(request CommandRequest, next func(CommandRequest) RawResponseData) RawResponseData {
+		if request.userID == "" {
+			return next(request)
+		}
+		if err := authorize(request.roles, request.command); err != nil {
+			return NewErrorResponse(request.command, forbiddenStatus, err.Error())
+		}
+		return next(request)
+	}
+}
+
+// AuditCommands returns a middleware recording in the audit log the commands the users send for which audited
+// is true, whether they're allowed or not.
+func AuditCommands(audited func(command apicommands.CommandType) bool) MessageMiddleware {
+	return func(request CommandRequest, next func(CommandRequest) RawResponseData) RawResponseData {
+		response := next(request)
+		if request.userID != "" && audited(request.command) {
+			audit.Record(audit.Event{
+				Action:  audit.CommandExecuted,
+				Actor:   request.userID,
+				Target:  request.command.Name(),
+				IP:      request.clientIP,
+				Details: fmt.Sprint("connection ", request.connID, ", status ", statusOf(response)),
+			})
+		}
+		return response
+	}
+}
+
+// The states of a command deadline.
+const (
+	deadlinePending int32 = iota
+	deadlineCommitted
+	deadlineExpired
+)
+
+// commandDeadline settles whether a command took effect before its timeout: whichever of the handler committing
+// and the timeout comes first wins.
+type commandDeadline struct {
+	state int32
+}
+
+func (d *commandDeadline) commit() bool {
+	if d == nil {
+		return true
+	}
+	return atomic.CompareAndSwapInt32(&d.state, deadlinePending, deadlineCommitted) || atomic.LoadInt32(&d.state) == deadlineCommitted
+}
+
+func (d *commandDeadline) expire() bool {
+	return atomic.CompareAndSwapInt32(&d.state, deadlinePending, deadlineExpired)
+}
+
+// Timeout returns a middleware answering with a timeout error when the handler takes longer than d. The handler
+// keeps running in the background and its response is discarded, so the handlers with effects must check
+// CommandRequest.Commit before applying them. A handler that committed in time is waited for.
+func Timeout(d time.Duration) MessageMiddleware {
+	return func(request CommandRequest, next func(CommandRequest) RawResponseData) RawResponseData {
+		request.deadline = &commandDeadline{}
+		responses := make(chan RawResponseData, 1)
+		go func() {
+			// The recovery middleware runs in another goroutine
+			defer func() {
+				if x := recover(); x != nil {
+					log.Println("PANIC handling the command ", request.command, ": ", x, "\n", string(debug.Stack()))
+					responses <- NewErrorResponse(request.command, internalErrorStatus, "Internal error handling the command")
+				}
+			}()
+			responses <- next(request)
+		}()
+
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case response := <-responses:
+			return response
+		case <-timer.C:
+			if !request.deadline.expire() {
+				return <-responses
+			}
+			return NewErrorResponse(request.command, timeoutStatus, fmt.Sprint("The command took longer than ", d))
+		}
+	}
+}
+
+// Validator is implemented by the requests checking their own content.
+type Validator interface {
+	Validate() error
+}
+
+// ValidatePayload returns a middleware decoding the request into the structure newPayload returns, and rejecting
+// it if it doesn't decode or, for Validators, if it isn't valid.
+func ValidatePayload(newPayload func() interface{}) MessageMiddleware {
+	return func(request CommandRequest, next func(CommandRequest) RawResponseData) RawResponseData {
+		payload := newPayload()
+		err := json.Unmarshal(request.data, payload)
+		if err == nil {
+			if validator, ok := payload.(Validator); ok {
+				err = validator.Validate()
+			}
+		}
+		if err != nil {
+			return NewErrorResponse(request.command, invalidPayloadStatus, fmt.Sprint("Invalid request: ", err))
+		}
+		return next(request)
+	}
+}
@@ -0,0 +1,120 @@
+package wslogic
+
+import (
+	"encoding/json"
+	"errors"
+	"local/gintest/apicommands"
+	"testing"
+	"time"
+)
+
+func responseStatus(t *testing.T, response RawResponseData) ResponseStatusType {
+	var header ApiResponseHeader
+	if err := json.Unmarshal(response, &header); err != nil {
+		t.Fatalf("Bad response %q: %v", response, err)
+	}
+	return header.Status
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	trace := func(name string) MessageMiddleware {
+		return func(request CommandRequest, next func(CommandRequest) RawResponseData) RawResponseData {
+			calls = append(calls, name)
+			return next(request)
+		}
+	}
+	handler := chain(func(CommandRequest) RawResponseData {
+		calls = append(calls, "handler")
+		return RawResponseData("{}")
+	}, trace("first"), trace("second"))
+
+	handler(NewCommandRequest(apicommands.ClientStats, nil))
+	if len(calls) != 3 || calls[0] != "first" || calls[1] != "second" || calls[2] != "handler" {
+		t.Fatal("Wrong calls order: ", calls)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	handler := chain(func(CommandRequest) RawResponseData { panic("boom") }, RecoveryMiddleware)
+	if status := responseStatus(t, handler(NewCommandRequest(apicommands.ClientStats, nil))); status != internalErrorStatus {
+		t.Fatal("Expected an internal error, got status ", status)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	slow := func(CommandRequest) RawResponseData {
+		time.Sleep(100 * time.Millisecond)
+		return RawResponseData(`{"command":7,"status":0}`)
+	}
+	request := NewCommandRequest(apicommands.ClientStats, nil)
+	if status := responseStatus(t, chain(slow, Timeout(10*time.Millisecond))(request)); status != timeoutStatus {
+		t.Fatal("Expected a timeout, got status ", status)
+	}
+	if status := responseStatus(t, chain(slow, Timeout(time.Second))(request)); status != 0 {
+		t.Fatal("Expected a success, got status ", status)
+	}
+
+	// A handler applying its effects too late is told not to, and one that applied them in time is waited for
+	committed := make(chan bool, 1)
+	late := func(request CommandRequest) RawResponseData {
+		time.Sleep(50 * time.Millisecond)
+		committed <- request.Commit()
+		return RawResponseData(`{"command":7,"status":0}`)
+	}
+	if status := responseStatus(t, chain(late, Timeout(10*time.Millisecond))(request)); status != timeoutStatus || <-committed {
+		t.Fatal("A late handler applied its effects, the client got status ", status)
+	}
+	early := func(request CommandRequest) RawResponseData {
+		committed <- request.Commit()
+		time.Sleep(50 * time.Millisecond)
+		return RawResponseData(`{"command":7,"status":0}`)
+	}
+	if status := responseStatus(t, chain(early, Timeout(10*time.Millisecond))(request)); status != 0 || !<-committed {
+		t.Fatal("The client wasn't told the handler applied its effects, got status ", status)
+	}
+	if !request.Commit() {
+		t.Fatal("A command without a timeout can't commit")
+	}
+}
+
+func TestAuthenticatedAndValidate(t *testing.T) {
+	ok := func(CommandRequest) RawResponseData { return RawResponseData(`{"command":5,"status":0}`) }
+	handler := chain(ok, AuthenticatedMiddleware, ValidatePayload(func() interface{} { return &ApiRefreshTokenRequest{} }))
+
+	request := NewCommandRequest(apicommands.ClientRefreshToken, []byte(`{"command":5,"token":"t"}`))
+	if status := responseStatus(t, handler(request)); status != unauthorizedStatus {
+		t.Fatal("Expected an unauthorized error, got status ", status)
+	}
+	request.userID = "user"
+	if status := responseStatus(t, handler(request)); status != 0 {
+		t.Fatal("Expected a success, got status ", status)
+	}
+	request.data = []byte(`{"command":5,"token":""}`)
+	if status := responseStatus(t, handler(request)); status != invalidPayloadStatus {
+		t.Fatal("Expected an invalid payload error, got status ", status)
+	}
+}
+
+func TestAuthorizeRoles(t *testing.T) {
+	ok := func(CommandRequest) RawResponseData { return RawResponseData(`{"command":7,"status":0}`) }
+	handler := chain(ok, AuthorizeRoles(func(roles []string, command apicommands.CommandType) error {
+		if len(roles) == 0 || roles[0] != "admin" {
+			return errors.New("Admins only")
+		}
+		return nil
+	}))
+
+	request := NewCommandRequest(apicommands.ClientStats, nil)
+	if status := responseStatus(t, handler(request)); status != 0 {
+		t.Fatal("The commands of the server must run, got status ", status)
+	}
+	request.userID, request.roles = "user", []string{"viewer"}
+	if status := responseStatus(t, handler(request)); status != forbiddenStatus {
+		t.Fatal("Expected a forbidden error, got status ", status)
+	}
+	request.roles = []string{"admin"}
+	if status := responseStatus(t, handler(request)); status != 0 {
+		t.Fatal("Expected a success, got status ", status)
+	}
+}
@@ -1,20 +1,12 @@
 package wslogic
 
 import (
-	"container/list"
-	"encoding/json"
 	"local/gintest/apicommands"
 	"log"
 )
 
-type ApiNClients struct {
-	Number int `json:"number"`
-}
-
-type NCurrentClientsResponse struct {
-	ApiResponseHeader
-	ApiNClients
-}
+type ApiNClients = apicommands.ApiNClients
+type NCurrentClientsResponse = apicommands.NCurrentClientsResponse
 
 const (
 	errorNCurrentClientsStatus ResponseStatusType = -1
@@ -29,17 +21,19 @@ func NewNCurrentClientsResponse(nClients int) NCurrentClientsResponse {
 	}
 }
 
-func (r *NCurrentClientsResponse) Stringify() ([]byte, error) {
-	return json.Marshal(r)
-}
-
 func (h *ConnectionsHub) requestNCurrentClientsCommand(request CommandRequest) RawResponseData {
-	h.incomingNCurrentClientsCommand <- request
-	return <-request.response
+	select {
+	case h.incomingNCurrentClientsCommand <- request:
+		return <-request.response
+	case <-h.done:
+		responseStruct := NewApiResponseHeader(apicommands.ServerNConnectionsPush, errorNCurrentClientsStatus, "The connections hub is shut down")
+		bytes, _ := responseStruct.Stringify()
+		return bytes
+	}
 }
 
-func processNCurrentClientsCommand(connectionsList *list.List) RawResponseData {
-	responseStruct := NewNCurrentClientsResponse(connectionsList.Len())
+func processNCurrentClientsCommand(nClients int) RawResponseData {
+	responseStruct := NewNCurrentClientsResponse(nClients)
 	bytes, err := responseStruct.Stringify()
 	if err != nil {
 		log.Println("ERROR processNCurrentClientsCommand >>>> Couldn't stringify the response structure!")
@@ -0,0 +1,343 @@
+package wslogic
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"local/gintest/apicommands"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitedStatus     ResponseStatusType = -2
+	messageTooBigStatus   ResponseStatusType = -3
+	defaultMaxMessageSize                    = 512
+)
+
+// RateLimit allows Rate messages per second on average, in bursts of up to Burst messages.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// CommandLimit restricts the requests of a command coming from a single connection.
+type CommandLimit struct {
+	RateLimit
+	MaxMessageSize int64
+}
+
+// RateLimits is the policy applied to the messages coming from the clients.
+type RateLimits struct {
+	// Every message of a connection, and of all the connections of a user.
+	Connection RateLimit
+	User       RateLimit
+
+	// The requests of each command, DefaultCommand applies to the ones not in Commands.
+	DefaultCommand CommandLimit
+	Commands       map[apicommands.CommandType]CommandLimit
+
+	// Batch frames carry up to MaxBatchCommands commands, each within its own limits, in up to
+	// MaxBatchMessageSize bytes.
+	MaxBatchCommands    int
+	MaxBatchMessageSize int64
+
+	// A connection exceeding the limits more than MaxViolations times within ViolationsWindow is closed.
+	MaxViolations    int
+	ViolationsWindow time.Duration
+}
+
+// DefaultRateLimits returns the limits applied unless SetRateLimits is called.
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		Connection: RateLimit{Rate: 20, Burst: 40},
+		User:       RateLimit{Rate: 50, Burst: 100},
+		DefaultCommand: CommandLimit{
+			RateLimit:      RateLimit{Rate: 10, Burst: 20},
+			MaxMessageSize: defaultMaxMessageSize,
+		},
+		Commands: map[apicommands.CommandType]CommandLimit{
+			// The complete list is heavy to build, it's only needed to start over
+			apicommands.ServerCompleteSignalList: {RateLimit: RateLimit{Rate: 1, Burst: 3}, MaxMessageSize: defaultMaxMessageSize},
+			apicommands.ClientRefreshToken:       {RateLimit: RateLimit{Rate: 1, Burst: 2}, MaxMessageSize: 4096},
+			apicommands.ClientHello:              {RateLimit: RateLimit{Rate: 1, Burst: 2}, MaxMessageSize: 2048},
+		},
+		MaxBatchCommands:    16,
+		MaxBatchMessageSize: 8192,
+		MaxViolations:       10,
+		ViolationsWindow:    time.Minute,
+	}
+}
+
+var rateLimits = DefaultRateLimits()
+
+// SetRateLimits replaces the limits applied to the messages of the clients. It must be called before Init.
+func SetRateLimits(limits RateLimits) {
+	rateLimits = limits
+}
+
+// rateLimitsFile is how the limits are written in a file: the commands by name and the window as a duration.
+type rateLimitsFile struct {
+	*RateLimits
+	Commands         map[string]CommandLimit
+	ViolationsWindow string
+}
+
+// ParseRateLimits reads limits written in JSON, like
+//
+//	{"Connection": {"Rate": 20, "Burst": 40}, "Commands": {"Stats": {"Rate": 1, "Burst": 2, "MaxMessageSize": 512}}}
+//
+// The limits left out keep their default, and so do the commands that aren't named.
+func ParseRateLimits(data []byte) (RateLimits, error) {
+	limits := DefaultRateLimits()
+	file := rateLimitsFile{RateLimits: &limits}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return limits, err
+	}
+	if file.ViolationsWindow != "" {
+		window, err := time.ParseDuration(file.ViolationsWindow)
+		if err != nil {
+			return limits, err
+		}
+		limits.ViolationsWindow = window
+	}
+	for name, limit := range file.Commands {
+		command, ok := commandByName(name)
+		if !ok {
+			return limits, fmt.Errorf("Unknown command %q", name)
+		}
+		limits.Commands[command] = limit
+	}
+	return limits, limits.validate()
+}
+
+// LoadRateLimits reads the limits of a file written like ParseRateLimits expects.
+func LoadRateLimits(path string) (RateLimits, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return RateLimits{}, err
+	}
+	return ParseRateLimits(data)
+}
+
+func commandByName(name string) (apicommands.CommandType, bool) {
+	for _, command := range apicommands.Commands() {
+		if strings.EqualFold(command.Name(), name) {
+			return command, true
+		}
+	}
+	return 0, false
+}
+
+func (l RateLimit) validate(what string) error {
+	if l.Rate <= 0 || l.Burst < 1 {
+		return fmt.Errorf("The %s limit needs a positive rate and burst", what)
+	}
+	return nil
+}
+
+func (l *RateLimits) validate() error {
+	if err := l.Connection.validate("connection"); err != nil {
+		return err
+	}
+	if err := l.User.validate("user"); err != nil {
+		return err
+	}
+	if err := l.DefaultCommand.validate("default command"); err != nil {
+		return err
+	}
+	for command, limit := range l.Commands {
+		if err := limit.validate(command.Name() + " command"); err != nil {
+			return err
+		}
+		if limit.MaxMessageSize <= 0 {
+			return fmt.Errorf("The %s command needs a positive message size", command.Name())
+		}
+	}
+	if l.DefaultCommand.MaxMessageSize <= 0 || l.MaxBatchCommands < 1 || l.MaxBatchMessageSize <= 0 {
+		return fmt.Errorf("The message sizes and the commands of a batch must be positive")
+	}
+	if l.MaxViolations < 1 || l.ViolationsWindow <= 0 {
+		return fmt.Errorf("The violations and their window must be positive")
+	}
+	return nil
+}
+
+func (l *RateLimits) commandLimit(command apicommands.CommandType) CommandLimit {
+	if limit, ok := l.Commands[command]; ok {
+		return limit
+	}
+	return l.DefaultCommand
+}
+
+// maxMessageSize is the largest message any command or batch accepts, frames beyond it aren't even read.
+func (l *RateLimits) maxMessageSize() int64 {
+	max := l.DefaultCommand.MaxMessageSize
+	if l.MaxBatchMessageSize > max {
+		max = l.MaxBatchMessageSize
+	}
+	for _, limit := range l.Commands {
+		if limit.MaxMessageSize > max {
+			max = limit.MaxMessageSize
+		}
+	}
+	return max
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) tokenBucket {
+	return tokenBucket{
+		rate:   limit.Rate,
+		burst:  float64(limit.Burst),
+		tokens: float64(limit.Burst),
+		last:   now,
+	}
+}
+
+// allow takes a token from the bucket if there's any left.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// userBuckets holds the bucket shared by every connection of each user.
+type userBuckets struct {
+	mutex   sync.Mutex
+	buckets map[string]*userBucket
+}
+
+type userBucket struct {
+	tokenBucket
+	nConnections int
+}
+
+var usersBuckets = userBuckets{buckets: make(map[string]*userBucket)}
+
+func (u *userBuckets) acquire(userID string, now time.Time) *userBucket {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	bucket, ok := u.buckets[userID]
+	if !ok {
+		bucket = &userBucket{tokenBucket: newTokenBucket(rateLimits.User, now)}
+		u.buckets[userID] = bucket
+	}
+	bucket.nConnections++
+	return bucket
+}
+
+func (u *userBuckets) release(userID string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if bucket, ok := u.buckets[userID]; ok {
+		if bucket.nConnections--; bucket.nConnections <= 0 {
+			delete(u.buckets, userID)
+		}
+	}
+}
+
+func (u *userBuckets) allow(bucket *userBucket, now time.Time) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return bucket.allow(now)
+}
+
+// connectionLimiter applies the rate limits to the messages read from a connection. It's only used by the read
+// pump of the connection.
+type connectionLimiter struct {
+	userID     string
+	connection tokenBucket
+	user       *userBucket
+	commands   map[apicommands.CommandType]*tokenBucket
+	violations []time.Time
+}
+
+func newConnectionLimiter(userID string, now time.Time) *connectionLimiter {
+	return &connectionLimiter{
+		userID:     userID,
+		connection: newTokenBucket(rateLimits.Connection, now),
+		user:       usersBuckets.acquire(userID, now),
+		commands:   make(map[apicommands.CommandType]*tokenBucket),
+	}
+}
+
+func (l *connectionLimiter) release() {
+	usersBuckets.release(l.userID)
+}
+
+// check returns an error status and description if a message of the given command and size exceeds the limits.
+func (l *connectionLimiter) check(command apicommands.CommandType, size int, now time.Time) (ResponseStatusType, string) {
+	limit := rateLimits.commandLimit(command)
+	if int64(size) > limit.MaxMessageSize {
+		return messageTooBigStatus, "The message exceeds the maximum size of the command"
+	}
+	if !l.connection.allow(now) {
+		return rateLimitedStatus, "Too many messages on this connection"
+	}
+	if !usersBuckets.allow(l.user, now) {
+		return rateLimitedStatus, "Too many messages from this user"
+	}
+	bucket, ok := l.commands[command]
+	if !ok {
+		b := newTokenBucket(limit.RateLimit, now)
+		bucket = &b
+		l.commands[command] = bucket
+	}
+	if !bucket.allow(now) {
+		return rateLimitedStatus, "Too many requests of this command"
+	}
+	return 0, ""
+}
+
+// checkFrame returns an error status and description if a frame read from the connection, carrying a single
+// command or a batch, exceeds the limits, along with the offending command.
+func (l *connectionLimiter) checkFrame(message []byte, now time.Time) (apicommands.CommandType, ResponseStatusType, string) {
+	commands, isBatch := batchCommands(message)
+	if !isBatch {
+		var header ApiRequestHeader
+		json.Unmarshal(message, &header)
+		status, description := l.check(header.Command, len(message), now)
+		return header.Command, status, description
+	}
+
+	if int64(len(message)) > rateLimits.MaxBatchMessageSize {
+		return apicommands.APIMessagesList, messageTooBigStatus, "The batch exceeds the maximum size"
+	}
+	if len(commands) > rateLimits.MaxBatchCommands {
+		return apicommands.APIMessagesList, messageTooBigStatus, "The batch has too many commands"
+	}
+	for _, command := range commands {
+		var header ApiRequestHeader
+		json.Unmarshal(command, &header)
+		if status, description := l.check(header.Command, len(command), now); status != 0 {
+			return header.Command, status, description
+		}
+	}
+	return apicommands.APIMessagesList, 0, ""
+}
+
+// violate records a message exceeding the limits, returning whether the connection is abusing them.
+func (l *connectionLimiter) violate(now time.Time) bool {
+	recent := l.violations[:0]
+	for _, t := range l.violations {
+		if now.Sub(t) < rateLimits.ViolationsWindow {
+			recent = append(recent, t)
+		}
+	}
+	l.violations = append(recent, now)
+	return len(l.violations) > rateLimits.MaxViolations
+}
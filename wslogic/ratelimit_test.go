@@ -0,0 +1,108 @@
+package wslogic
+
+import (
+	"local/gintest/apicommands"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(RateLimit{Rate: 2, Burst: 3}, now)
+
+	for i := 0; i < 3; i++ {
+		if !bucket.allow(now) {
+			t.Fatal("The burst message ", i, " was not allowed")
+		}
+	}
+	if bucket.allow(now) {
+		t.Error("A message beyond the burst was allowed")
+	}
+
+	// Two tokens per second are refilled
+	now = now.Add(500 * time.Millisecond)
+	if !bucket.allow(now) {
+		t.Error("The refilled token was not allowed")
+	}
+	if bucket.allow(now) {
+		t.Error("More tokens than refilled were allowed")
+	}
+
+	// But never beyond the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		bucket.allow(now)
+	}
+	if bucket.allow(now) {
+		t.Error("The bucket was refilled beyond its burst")
+	}
+}
+
+func TestConnectionLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newConnectionLimiter("tester", now)
+	defer limiter.release()
+
+	if status, _ := limiter.check(apicommands.ServerNConnectionsPush, defaultMaxMessageSize+1, now); status != messageTooBigStatus {
+		t.Error("A message beyond the size limit got status ", status)
+	}
+
+	limit := rateLimits.commandLimit(apicommands.ServerCompleteSignalList)
+	for i := 0; i < limit.Burst; i++ {
+		if status, description := limiter.check(apicommands.ServerCompleteSignalList, 20, now); status != 0 {
+			t.Fatal("The burst request ", i, " was rejected: ", description)
+		}
+	}
+	if status, _ := limiter.check(apicommands.ServerCompleteSignalList, 20, now); status != rateLimitedStatus {
+		t.Error("A request beyond the command burst got status ", status)
+	}
+	// Other commands have their own bucket
+	if status, description := limiter.check(apicommands.ServerNConnectionsPush, 20, now); status != 0 {
+		t.Error("A request of another command was rejected: ", description)
+	}
+
+	for i := 0; i < rateLimits.MaxViolations; i++ {
+		if limiter.violate(now) {
+			t.Fatal("The connection was deemed abusive after ", i+1, " violations")
+		}
+	}
+	if !limiter.violate(now) {
+		t.Error("The connection was not deemed abusive after too many violations")
+	}
+	if limiter.violate(now.Add(rateLimits.ViolationsWindow)) {
+		t.Error("Violations older than the window were not forgotten")
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits([]byte(`{
+		"Connection": {"Rate": 5, "Burst": 10},
+		"Commands": {"stats": {"Rate": 0.5, "Burst": 1, "MaxMessageSize": 256}},
+		"ViolationsWindow": "30s"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := DefaultRateLimits()
+	if limits.Connection != (RateLimit{Rate: 5, Burst: 10}) || limits.User != defaults.User {
+		t.Error("Wrong connection or user limits: ", limits.Connection, limits.User)
+	}
+	if limits.Commands[apicommands.ClientStats].MaxMessageSize != 256 ||
+		limits.Commands[apicommands.ClientHello] != defaults.Commands[apicommands.ClientHello] {
+		t.Error("Wrong command limits: ", limits.Commands)
+	}
+	if limits.ViolationsWindow != 30*time.Second || limits.MaxViolations != defaults.MaxViolations {
+		t.Error("Wrong violations: ", limits.MaxViolations, limits.ViolationsWindow)
+	}
+
+	for _, bad := range []string{
+		`{"Commands": {"Unknown": {"Rate": 1, "Burst": 1, "MaxMessageSize": 1}}}`,
+		`{"User": {"Rate": 0, "Burst": 1}}`,
+		`{"Commands": {"Stats": {"Rate": 1, "Burst": 1}}}`,
+		`{"ViolationsWindow": "soon"}`,
+	} {
+		if _, err := ParseRateLimits([]byte(bad)); err == nil {
+			t.Error("Accepted the limits ", bad)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package wslogic
+
+import (
+	"encoding/json"
+	"local/gintest/apicommands"
+	"local/gintest/services/audit"
+	"log"
+	"time"
+)
+
+// Session is what a token tells about the session of a user.
+type Session struct {
+	UserID    string
+	ID        string
+	Roles     []string
+	StartedAt time.Time
+	ExpiresAt time.Time
+}
+
+// TokenValidator checks a session token, returning the session it belongs to.
+type TokenValidator func(token string) (Session, error)
+
+var tokenValidator TokenValidator
+
+// SetTokenValidator sets how the tokens sent by the clients to refresh their sessions are checked.
+// It must be called before Init.
+func SetTokenValidator(validator TokenValidator) {
+	tokenValidator = validator
+}
+
+type ApiRefreshTokenRequest = apicommands.ApiRefreshTokenRequest
+type ApiTokenExpiration = apicommands.ApiTokenExpiration
+type TokenExpirationResponse = apicommands.TokenExpirationResponse
+
+const (
+	errorRefreshTokenStatus ResponseStatusType = -1
+)
+
+// How long checking a token may hold up the messages hub, it reads the revocations from the database
+const refreshTokenTimeout = 5 * time.Second
+
+// NewTokenExpirationResponse answers a refresh token command with the new expiration of the session.
+func NewTokenExpirationResponse(expire time.Time) TokenExpirationResponse {
+	return TokenExpirationResponse{
+		ApiResponseHeader: ApiResponseHeader{
+			Command: apicommands.ClientRefreshToken,
+		},
+		ApiTokenExpiration: ApiTokenExpiration{Expire: expire},
+	}
+}
+
+// NewTokenExpiringPush warns a client its session expires on expire unless it refreshes its token.
+func NewTokenExpiringPush(expire time.Time) TokenExpirationResponse {
+	return TokenExpirationResponse{
+		ApiResponseHeader: ApiResponseHeader{
+			Command: apicommands.ServerTokenExpiringPush,
+		},
+		ApiTokenExpiration: ApiTokenExpiration{Expire: expire},
+	}
+}
+
+type refreshTokenRequest struct {
+	CommandRequest
+	session Session
+}
+
+func newRefreshTokenErrorResponse(err string) RawResponseData {
+	responseStruct := NewApiResponseHeader(apicommands.ClientRefreshToken, errorRefreshTokenStatus, err)
+	bytes, _ := responseStruct.Stringify()
+	return bytes
+}
+
+func (h *ConnectionsHub) requestRefreshTokenCommand(request CommandRequest) RawResponseData {
+	var refresh ApiRefreshTokenRequest
+	if err := json.Unmarshal(request.data, &refresh); err != nil {
+		return newRefreshTokenErrorResponse("The Refresh Token request is unrecognizable")
+	}
+	if tokenValidator == nil {
+		return newRefreshTokenErrorResponse("Session tokens can't be refreshed")
+	}
+	session, err := tokenValidator(refresh.Token)
+	if err != nil {
+		return newRefreshTokenErrorResponse("The token is not valid: " + err.Error())
+	}
+
+	select {
+	case h.incomingRefreshTokenCommand <- refreshTokenRequest{CommandRequest: request, session: session}:
+		return <-request.response
+	case <-h.done:
+		return newRefreshTokenErrorResponse("The connections hub is shut down")
+	}
+}
+
+func processRefreshTokenCommand(request refreshTokenRequest, connectionsMap map[connectionID]*Conn) RawResponseData {
+	conn, ok := connectionsMap[request.connID]
+	if !ok {
+		return newRefreshTokenErrorResponse("The connection is not registered")
+	}
+	if conn.userID != request.session.UserID {
+		return newRefreshTokenErrorResponse("The token belongs to another user")
+	}
+	// The client was already told the refresh timed out
+	if !request.Commit() {
+		return newRefreshTokenErrorResponse("The refresh took too long")
+	}
+	conn.refreshSession(request.session.ExpiresAt)
+	// The roles may have changed since the last token, which may even belong to another session
+	conn.setRoles(request.session.Roles)
+	conn.sessionID, conn.sessionStart = request.session.ID, request.session.StartedAt
+	auditConnection(audit.TokenRefresh, conn, "")
+
+	responseStruct := NewTokenExpirationResponse(request.session.ExpiresAt)
+	bytes, err := responseStruct.Stringify()
+	if err != nil {
+		log.Println("ERROR processRefreshTokenCommand >>>> Couldn't stringify the response structure!")
+	}
+	return bytes
+}
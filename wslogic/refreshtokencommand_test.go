@@ -0,0 +1,55 @@
+package wslogic
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessRefreshTokenCommand(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	conn := NewEventStreamConn(Session{UserID: "alice", ID: "a", Roles: []string{"viewer"}, StartedAt: start, ExpiresAt: start.Add(time.Minute)}, nil)
+	connections := map[connectionID]*Conn{conn.connID: conn}
+	request := func(session Session) refreshTokenRequest {
+		return refreshTokenRequest{CommandRequest: CommandRequest{connID: conn.connID}, session: session}
+	}
+
+	if status := responseStatus(t, processRefreshTokenCommand(request(Session{UserID: "alice"}), map[connectionID]*Conn{})); status != errorRefreshTokenStatus {
+		t.Error("Refreshed an unregistered connection: ", status)
+	}
+	if status := responseStatus(t, processRefreshTokenCommand(request(Session{UserID: "bob"}), connections)); status != errorRefreshTokenStatus {
+		t.Error("Refreshed a connection with the token of another user: ", status)
+	}
+
+	expire := start.Add(time.Hour)
+	response := processRefreshTokenCommand(request(Session{UserID: "alice", ID: "b", Roles: []string{"operator"}, StartedAt: start, ExpiresAt: expire}), connections)
+	var refreshed TokenExpirationResponse
+	if err := json.Unmarshal(response, &refreshed); err != nil || refreshed.Status != 0 || !refreshed.Expire.Equal(expire) {
+		t.Fatal("Wrong refresh response: ", string(response), err)
+	}
+	if conn.sessionID != "b" || strings.Join(conn.Roles(), ",") != "operator" {
+		t.Error("The session of the connection wasn't replaced: ", conn.sessionID, conn.Roles())
+	}
+	if got := <-conn.refreshed; !got.Equal(expire) {
+		t.Error("The pumps were told the wrong expiration: ", got)
+	}
+}
+
+func TestRequestRefreshTokenCommand(t *testing.T) {
+	defer SetTokenValidator(tokenValidator)
+	h := &ConnectionsHub{}
+
+	if status := responseStatus(t, h.requestRefreshTokenCommand(CommandRequest{data: []byte("{")})); status != errorRefreshTokenStatus {
+		t.Error("An unrecognizable request was accepted: ", status)
+	}
+	SetTokenValidator(nil)
+	if status := responseStatus(t, h.requestRefreshTokenCommand(CommandRequest{data: []byte(`{"token":"t"}`)})); status != errorRefreshTokenStatus {
+		t.Error("A token was refreshed without a validator: ", status)
+	}
+	SetTokenValidator(func(string) (Session, error) { return Session{}, errors.New("The token is expired") })
+	if status := responseStatus(t, h.requestRefreshTokenCommand(CommandRequest{data: []byte(`{"token":"t"}`)})); status != errorRefreshTokenStatus {
+		t.Error("An invalid token was accepted: ", status)
+	}
+}
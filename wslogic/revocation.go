@@ -0,0 +1,52 @@
+package wslogic
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SessionRevocation revokes a session of a user or, without a session ID, every session of the user started before
+// Before.
+type SessionRevocation struct {
+	UserID    string    `json:"user"`
+	SessionID string    `json:"session,omitempty"`
+	Before    time.Time `json:"before"`
+}
+
+func (r SessionRevocation) matches(conn *Conn) bool {
+	if conn.userID != r.UserID {
+		return false
+	}
+	if r.SessionID != "" {
+		return conn.sessionID == r.SessionID
+	}
+	return conn.sessionStart.Before(r.Before)
+}
+
+// RevokeSessions closes the connections of the revoked sessions, on this instance and, through the backplane, on
+// the other ones.
+func RevokeSessions(revocation SessionRevocation) {
+	select {
+	case connectionsHub.revoke <- revocation:
+		relay.publishRevocation(revocation)
+	case <-connectionsHub.done:
+	}
+}
+
+// closeRevokedConnections closes the connections of a revoked session with a policy violation close frame.
+func (h *ConnectionsHub) closeRevokedConnections(revocation SessionRevocation, topics topicsMap, connectionsList *list.List, connectionsMap map[connectionID]*Conn) {
+	closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "The session was revoked")
+	for e := connectionsList.Front(); e != nil; {
+		conn := e.Value.(*Conn)
+		e = e.Next()
+		if !revocation.matches(conn) {
+			continue
+		}
+		h.log("Closing the connection ", conn.connID, " of a revoked session of ", conn.userID)
+		conn.closeMessage = closeMessage
+		topics.removeConnection(conn)
+		h.removeConnection(conn, connectionsList, connectionsMap)
+	}
+}
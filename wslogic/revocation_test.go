@@ -0,0 +1,24 @@
+package wslogic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionRevocationMatches(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	conn := NewEventStreamConn(Session{UserID: "user", ID: "a", StartedAt: start, ExpiresAt: start.Add(time.Hour)}, nil)
+
+	if !(SessionRevocation{UserID: "user", SessionID: "a"}).matches(conn) {
+		t.Error("The connection of the revoked session wasn't matched")
+	}
+	if (SessionRevocation{UserID: "user", SessionID: "b"}).matches(conn) || (SessionRevocation{UserID: "other", SessionID: "a"}).matches(conn) {
+		t.Error("The connection of another session was matched")
+	}
+	if !(SessionRevocation{UserID: "user", Before: start.Add(time.Second)}).matches(conn) {
+		t.Error("The connection of a session started before the revocation wasn't matched")
+	}
+	if (SessionRevocation{UserID: "user", Before: start}).matches(conn) {
+		t.Error("The connection of a session started after the revocation was matched")
+	}
+}
@@ -0,0 +1,146 @@
+package wslogic
+
+import (
+	"bytes"
+	"encoding/json"
+	"local/gintest/apicommands"
+	"log"
+	"strconv"
+	"sync/atomic"
+)
+
+// The broadcasts kept to replay to the clients resuming their stream, about two minutes of signal updates.
+const replayBufferSize = 512
+
+// The sequence numbers are only meaningful within the stream of an instance, a client landing on another one
+// gets a snapshot.
+var streamID = instanceID
+
+type ResumePoint = apicommands.ResumePoint
+
+func ParseResumePoint(s string) (ResumePoint, error) {
+	return apicommands.ParseResumePoint(s)
+}
+
+// sequencer numbers the broadcasts and keeps the last ones. It belongs to the connections hub goroutine.
+type sequencer struct {
+	seq    uint64
+	replay [replayBufferSize][]byte
+}
+
+// withSeq returns the JSON object message with a "seq" member added.
+func withSeq(message []byte, seq uint64) []byte {
+	trimmed := bytes.TrimLeft(message, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return message
+	}
+	rest := bytes.TrimLeft(trimmed[1:], " \t\r\n")
+	sequenced := make([]byte, 0, len(trimmed)+24)
+	sequenced = append(sequenced, `{"seq":`...)
+	sequenced = strconv.AppendUint(sequenced, seq, 10)
+	if len(rest) > 0 && rest[0] != '}' {
+		sequenced = append(sequenced, ',')
+	}
+	return append(sequenced, rest...)
+}
+
+// next numbers a broadcast and keeps it for replay.
+func (s *sequencer) next(message []byte) []byte {
+	s.seq++
+	sequenced := withSeq(message, s.seq)
+	s.replay[s.seq%replayBufferSize] = sequenced
+	return sequenced
+}
+
+// since returns the broadcasts that came after seq, or false if some of them are no longer kept.
+func (s *sequencer) since(seq uint64) ([][]byte, bool) {
+	if seq > s.seq {
+		return nil, false
+	}
+	if s.seq-seq > replayBufferSize {
+		return nil, false
+	}
+	missed := make([][]byte, 0, s.seq-seq)
+	for n := seq + 1; n <= s.seq; n++ {
+		missed = append(missed, s.replay[n%replayBufferSize])
+	}
+	return missed, true
+}
+
+type ApiResume = apicommands.ApiResume
+type ResumePush = apicommands.ResumePush
+
+func NewResumePush(seq uint64, resume ApiResume) ResumePush {
+	return ResumePush{
+		ApiResponseHeader: ApiResponseHeader{
+			Command: apicommands.ServerResumePush,
+			Seq:     seq,
+		},
+		ApiResume: resume,
+	}
+}
+
+// SnapshotProvider returns the complete state a client falls back to when its stream can't be resumed.
+type SnapshotProvider func() RawResponseData
+
+var snapshotProvider atomic.Value
+
+// SetSnapshotProvider sets the snapshot sent to the clients whose stream can't be resumed.
+func SetSnapshotProvider(provider SnapshotProvider) {
+	snapshotProvider.Store(provider)
+}
+
+// sendSnapshot sends the snapshot to a connection. It runs on its own goroutine, as the provider may wait on
+// hubs that wait on the connections hub.
+func sendSnapshot(connID connectionID) {
+	provider, ok := snapshotProvider.Load().(SnapshotProvider)
+	if !ok {
+		return
+	}
+	Send(clientMessage{connID: connID, toMessage: provider()})
+}
+
+// resumeConnection replays the broadcasts a resuming connection missed, or sends it a snapshot if they're no
+// longer kept. It must run before anything else is sent to the connection.
+func (h *ConnectionsHub) resumeConnection(conn *Conn, s *sequencer) {
+	point := conn.resume
+	var missed [][]byte
+	ok := point.Stream == streamID
+	if ok {
+		missed, ok = s.since(point.Seq)
+	}
+	// An event stream gets the messages one by one, they must fit in its queue
+	if ok && conn.kind == eventStreamConnection && len(missed) > cap(conn.send)-1 {
+		ok = false
+	}
+
+	resume := NewResumePush(s.seq, ApiResume{Stream: streamID, Resumed: ok, Replayed: len(missed)})
+	resumeData, _ := resume.Stringify()
+	conn.send <- resumeData
+	if !ok {
+		h.log("Unable to resume the stream of connection ", conn.connID, " from ", point, ", sending a snapshot")
+		go sendSnapshot(conn.connID)
+		return
+	}
+
+	h.log("Replaying ", len(missed), " broadcasts to connection ", conn.connID)
+	if len(missed) == 0 {
+		return
+	}
+	if conn.kind == eventStreamConnection {
+		for _, message := range missed {
+			conn.send <- message
+		}
+		return
+	}
+	frame := make([]json.RawMessage, len(missed))
+	for i, message := range missed {
+		frame[i] = message
+	}
+	data, err := json.Marshal(frame)
+	if err != nil {
+		log.Println("ERROR resumeConnection >>>> Couldn't marshal the replayed broadcasts: ", err)
+		return
+	}
+	conn.send <- data
+}
@@ -0,0 +1,58 @@
+package wslogic
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestWithSeq(t *testing.T) {
+	for message, want := range map[string]string{
+		`{"command":2,"pids":[]}`: `{"seq":7,"command":2,"pids":[]}`,
+		` { }`:                    `{"seq":7}`,
+		`[1,2]`:                   `[1,2]`,
+	} {
+		if got := string(withSeq([]byte(message), 7)); got != want {
+			t.Errorf("withSeq(%s) = %s, want %s", message, got, want)
+		}
+	}
+}
+
+func TestSequencer(t *testing.T) {
+	s := &sequencer{}
+	for i := 0; i < replayBufferSize+10; i++ {
+		s.next([]byte(`{"command":2}`))
+	}
+
+	missed, ok := s.since(s.seq - 3)
+	if !ok || len(missed) != 3 {
+		t.Fatal("Expected the last 3 broadcasts, got ", len(missed), ok)
+	}
+	var header ApiResponseHeader
+	if err := json.Unmarshal(missed[0], &header); err != nil || header.Seq != s.seq-2 {
+		t.Fatal("Wrong first replayed broadcast: ", string(missed[0]))
+	}
+	if missed, ok = s.since(s.seq); !ok || len(missed) != 0 {
+		t.Fatal("Expected nothing to replay, got ", len(missed), ok)
+	}
+	if _, ok = s.since(5); ok {
+		t.Fatal("Replayed broadcasts no longer kept")
+	}
+	if _, ok = s.since(s.seq + 1); ok {
+		t.Fatal("Replayed from the future")
+	}
+}
+
+func TestParseResumePoint(t *testing.T) {
+	point, err := ParseResumePoint("a:b:42")
+	if err != nil || point.Stream != "a:b" || point.Seq != 42 {
+		t.Fatal("Wrong resume point: ", point, err)
+	}
+	if point.String() != "a:b:42" {
+		t.Fatal("Wrong resume point string: ", point)
+	}
+	for _, bad := range []string{"", "42", ":42", "a:", "a:-1"} {
+		if _, err = ParseResumePoint(bad); err == nil {
+			t.Error("Parsed the bad resume point ", bad)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package wslogic
+
+import (
+	"encoding/json"
+	"fmt"
+	"local/gintest/apicommands"
+	"local/gintest/services/stats"
+	"log"
+)
+
+var (
+	broadcastsCounter       = stats.NewCounter("ws.broadcasts")
+	remoteBroadcastsCounter = stats.NewCounter("ws.remoteBroadcasts")
+	publicationsCounter     = stats.NewCounter("ws.publications")
+	messagesSentCounter     = stats.NewCounter("ws.messagesSent")
+	bytesSentCounter        = stats.NewCounter("ws.bytesSent")
+	dropsCounter            = stats.NewCounter("ws.drops")
+	registeredCounter       = stats.NewCounter("ws.registered")
+	unregisteredCounter     = stats.NewCounter("ws.unregistered")
+	connectionsGauge        = stats.NewGauge("ws.connections")
+	clusterClientsGauge     = stats.NewGauge("ws.clusterClients")
+)
+
+// commandLatency returns the latency of the handler of a command.
+func commandLatency(command apicommands.CommandType) *stats.Latency {
+	name := command.Name()
+	if name == "" {
+		name = fmt.Sprint(int(command))
+	}
+	return stats.GetLatency("command." + name)
+}
+
+type StatsResponse struct {
+	ApiResponseHeader
+	stats.Snapshot
+}
+
+func NewStatsResponse(snapshot stats.Snapshot) StatsResponse {
+	return StatsResponse{
+		ApiResponseHeader: ApiResponseHeader{
+			Command: apicommands.ClientStats,
+		},
+		Snapshot: snapshot,
+	}
+}
+
+func (r *StatsResponse) Stringify() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func requestStatsCommand(request CommandRequest) RawResponseData {
+	responseStruct := NewStatsResponse(stats.TakeSnapshot())
+	bytes, err := responseStruct.Stringify()
+	if err != nil {
+		log.Println("ERROR requestStatsCommand >>>> Couldn't stringify the response structure!")
+	}
+	return bytes
+}
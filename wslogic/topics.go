@@ -0,0 +1,254 @@
+package wslogic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"local/gintest/apicommands"
+	"log"
+	"sort"
+)
+
+const (
+	maxTopicsPerConnection = 32
+	maxTopicNameLength     = 128
+)
+
+const (
+	errorTopicsStatus ResponseStatusType = -1
+)
+
+// TopicAuthorizer returns an error explaining why roles can't join a topic, or nil if they can.
+type TopicAuthorizer func(roles []string, topic string) error
+
+var topicAuthorizer TopicAuthorizer = func([]string, string) error { return nil }
+
+// SetTopicAuthorizer sets which topics the users may join, every one by default. It must be called before Init.
+func SetTopicAuthorizer(authorizer TopicAuthorizer) {
+	topicAuthorizer = authorizer
+}
+
+type ApiTopicsRequest struct {
+	ApiRequestHeader
+	Topics []string `json:"topics"`
+}
+
+func (r *ApiTopicsRequest) Validate() error {
+	if len(r.Topics) == 0 {
+		return errors.New("No topics given")
+	}
+	for _, topic := range r.Topics {
+		if topic == "" || len(topic) > maxTopicNameLength {
+			return fmt.Errorf("Topic names must have between 1 and %d characters", maxTopicNameLength)
+		}
+	}
+	return nil
+}
+
+type ApiTopics struct {
+	Topics []string `json:"topics"`
+}
+
+// TopicsResponse answers the join and leave commands with the topics the connection is in.
+type TopicsResponse struct {
+	ApiResponseHeader
+	ApiTopics
+}
+
+func NewTopicsResponse(command apicommands.CommandType, topics []string) TopicsResponse {
+	return TopicsResponse{
+		ApiResponseHeader: ApiResponseHeader{
+			Command: command,
+		},
+		ApiTopics: ApiTopics{Topics: topics},
+	}
+}
+
+func (r *TopicsResponse) Stringify() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+type ApiTopicPush struct {
+	Topic string          `json:"topic"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// TopicPush carries a message published on a topic to the connections in it.
+type TopicPush struct {
+	ApiResponseHeader
+	ApiTopicPush
+}
+
+func NewTopicPush(topic string, data []byte) TopicPush {
+	return TopicPush{
+		ApiResponseHeader: ApiResponseHeader{
+			Command: apicommands.ServerTopicPush,
+		},
+		ApiTopicPush: ApiTopicPush{Topic: topic, Data: data},
+	}
+}
+
+func (r *TopicPush) Stringify() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+type topicPublication struct {
+	topic   string
+	message []byte
+}
+
+// topicMembership asks the hub to make a connection join or leave topics. It's answered with the topics the
+// connection ends up in, or an error.
+type topicMembership struct {
+	connID connectionID
+	topics []string
+	join   bool
+
+	response chan topicMembershipResult
+}
+
+type topicMembershipResult struct {
+	topics []string
+	err    error
+}
+
+// topicsMap holds the connections in every topic. It belongs to the connections hub goroutine.
+type topicsMap map[string]map[connectionID]*Conn
+
+func (t topicsMap) join(conn *Conn, topics []string) error {
+	for _, topic := range topics {
+		if _, ok := conn.topics[topic]; ok {
+			continue
+		}
+		if len(conn.topics) >= maxTopicsPerConnection {
+			return fmt.Errorf("A connection can't be in more than %d topics", maxTopicsPerConnection)
+		}
+		if err := topicAuthorizer(conn.Roles(), topic); err != nil {
+			return err
+		}
+		members, ok := t[topic]
+		if !ok {
+			members = make(map[connectionID]*Conn)
+			t[topic] = members
+		}
+		members[conn.connID] = conn
+		conn.topics[topic] = struct{}{}
+	}
+	return nil
+}
+
+func (t topicsMap) leave(conn *Conn, topics []string) {
+	for _, topic := range topics {
+		delete(conn.topics, topic)
+		if members, ok := t[topic]; ok {
+			delete(members, conn.connID)
+			if len(members) == 0 {
+				delete(t, topic)
+			}
+		}
+	}
+}
+
+// removeConnection takes a connection out of every topic it's in.
+func (t topicsMap) removeConnection(conn *Conn) {
+	for topic := range conn.topics {
+		if members, ok := t[topic]; ok {
+			delete(members, conn.connID)
+			if len(members) == 0 {
+				delete(t, topic)
+			}
+		}
+	}
+	conn.topics = make(map[string]struct{})
+}
+
+// sweep forgets the members that are no longer registered, like the ones removed because their queue was full.
+func (t topicsMap) sweep(connectionsMap map[connectionID]*Conn) {
+	for topic, members := range t {
+		for id, conn := range members {
+			if connectionsMap[id] != conn {
+				delete(members, id)
+			}
+		}
+		if len(members) == 0 {
+			delete(t, topic)
+		}
+	}
+}
+
+func connectionTopics(conn *Conn) []string {
+	topics := make([]string, 0, len(conn.topics))
+	for topic := range conn.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Publish sends message, which must be valid JSON, to the connections in topic within a TopicPush. The
+// connections of the other instances get it through the backplane.
+func Publish(topic string, message []byte) {
+	select {
+	case connectionsHub.publish <- topicPublication{topic: topic, message: message}:
+		relay.publishTopic(topic, message)
+	case <-connectionsHub.done:
+	}
+}
+
+func changeTopics(connID connectionID, topics []string, join bool) ([]string, error) {
+	membership := topicMembership{
+		connID:   connID,
+		topics:   topics,
+		join:     join,
+		response: make(chan topicMembershipResult, 1),
+	}
+	select {
+	case connectionsHub.membership <- membership:
+		result := <-membership.response
+		return result.topics, result.err
+	case <-connectionsHub.done:
+		return nil, errors.New("The connections hub is shut down")
+	}
+}
+
+// JoinTopics makes the connection request came from join topics, and returns every topic it's in.
+func JoinTopics(request CommandRequest, topics ...string) ([]string, error) {
+	return changeTopics(request.connID, topics, true)
+}
+
+// LeaveTopics makes the connection request came from leave topics, and returns the topics it's still in.
+func LeaveTopics(request CommandRequest, topics ...string) ([]string, error) {
+	return changeTopics(request.connID, topics, false)
+}
+
+func requestTopicsCommand(request CommandRequest) RawResponseData {
+	var topicsRequest ApiTopicsRequest
+	if err := json.Unmarshal(request.data, &topicsRequest); err != nil {
+		return NewErrorResponse(request.command, errorTopicsStatus, "The Topics request is unrecognizable")
+	}
+	topics, err := changeTopics(request.connID, topicsRequest.Topics, request.command == apicommands.ClientJoinTopics)
+	if err != nil {
+		return NewErrorResponse(request.command, errorTopicsStatus, err.Error())
+	}
+
+	responseStruct := NewTopicsResponse(request.command, topics)
+	bytes, err := responseStruct.Stringify()
+	if err != nil {
+		log.Println("ERROR requestTopicsCommand >>>> Couldn't stringify the response structure!")
+	}
+	return bytes
+}
+
+func processTopicMembership(membership topicMembership, topics topicsMap, connectionsMap map[connectionID]*Conn) topicMembershipResult {
+	conn, ok := connectionsMap[membership.connID]
+	if !ok {
+		return topicMembershipResult{err: errors.New("The connection is not registered")}
+	}
+	var err error
+	if membership.join {
+		err = topics.join(conn, membership.topics)
+	} else {
+		topics.leave(conn, membership.topics)
+	}
+	return topicMembershipResult{topics: connectionTopics(conn), err: err}
+}
@@ -0,0 +1,121 @@
+package wslogic
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"local/gintest/apicommands"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopicsMap(t *testing.T) {
+	topics := make(topicsMap)
+	a := NewEventStreamConn(Session{UserID: "a", ExpiresAt: time.Now()}, nil)
+	b := NewEventStreamConn(Session{UserID: "b", ExpiresAt: time.Now()}, nil)
+
+	if err := topics.join(a, []string{"alarms", "chat"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := topics.join(b, []string{"alarms"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(topics["alarms"]) != 2 || len(topics["chat"]) != 1 {
+		t.Fatal("Wrong members: ", topics)
+	}
+	if got := strings.Join(connectionTopics(a), ","); got != "alarms,chat" {
+		t.Fatal("Wrong topics of a: ", got)
+	}
+
+	topics.leave(a, []string{"chat"})
+	if _, ok := topics["chat"]; ok {
+		t.Fatal("The empty topic was kept")
+	}
+
+	// b is no longer registered
+	topics.sweep(map[connectionID]*Conn{a.connID: a})
+	if len(topics["alarms"]) != 1 {
+		t.Fatal("The unregistered connection was kept: ", topics["alarms"])
+	}
+	topics.removeConnection(a)
+	if len(topics) != 0 || len(a.topics) != 0 {
+		t.Fatal("The connection was kept: ", topics)
+	}
+}
+
+func TestTopicsLimit(t *testing.T) {
+	topics := make(topicsMap)
+	conn := NewEventStreamConn(Session{UserID: "a", ExpiresAt: time.Now()}, nil)
+	names := make([]string, maxTopicsPerConnection+1)
+	for i := range names {
+		names[i] = strings.Repeat("t", i+1)
+	}
+	if err := topics.join(conn, names); err == nil {
+		t.Fatal("Joined more than ", maxTopicsPerConnection, " topics")
+	}
+	if len(conn.topics) != maxTopicsPerConnection {
+		t.Fatal("Wrong number of topics: ", len(conn.topics))
+	}
+}
+
+func TestPublishMessage(t *testing.T) {
+	topics := make(topicsMap)
+	connectionsList := list.New()
+	connectionsMap := make(map[connectionID]*Conn)
+	var conns []*Conn
+	for _, user := range []string{"a", "b", "c"} {
+		conn := NewEventStreamConn(Session{UserID: user, ExpiresAt: time.Now()}, nil)
+		connectionsList.PushBack(conn)
+		connectionsMap[conn.connID] = conn
+		conns = append(conns, conn)
+	}
+	a, b, c := conns[0], conns[1], conns[2]
+	if err := topics.join(a, []string{"alarms"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := topics.join(b, []string{"alarms", "chat"}); err != nil {
+		t.Fatal(err)
+	}
+
+	hub := &ConnectionsHub{}
+	hub.publishMessage(topicPublication{topic: "alarms", message: []byte(`{"level":2}`)}, topics, connectionsList, connectionsMap)
+	for _, member := range []*Conn{a, b} {
+		select {
+		case message := <-member.send:
+			var push TopicPush
+			if err := json.Unmarshal(message, &push); err != nil {
+				t.Fatal(err)
+			}
+			if push.Command != apicommands.ServerTopicPush || push.Topic != "alarms" || string(push.Data) != `{"level":2}` {
+				t.Error("Wrong push: ", string(message))
+			}
+		default:
+			t.Error("The member ", member.userID, " didn't get the message")
+		}
+	}
+	select {
+	case message := <-c.send:
+		t.Error("A connection out of the topic got the message: ", string(message))
+	default:
+	}
+}
+
+func TestTopicAuthorizer(t *testing.T) {
+	defer SetTopicAuthorizer(topicAuthorizer)
+	SetTopicAuthorizer(func(roles []string, topic string) error {
+		if strings.HasPrefix(topic, "admin.") && !(len(roles) == 1 && roles[0] == "admin") {
+			return errors.New("Admins only")
+		}
+		return nil
+	})
+	topics := make(topicsMap)
+	viewer := NewEventStreamConn(Session{UserID: "v", Roles: []string{"viewer"}, ExpiresAt: time.Now()}, nil)
+	admin := NewEventStreamConn(Session{UserID: "a", Roles: []string{"admin"}, ExpiresAt: time.Now()}, nil)
+	if err := topics.join(viewer, []string{"admin.users"}); err == nil {
+		t.Error("A viewer joined an admin topic")
+	}
+	if err := topics.join(admin, []string{"admin.users"}); err != nil {
+		t.Error(err)
+	}
+}